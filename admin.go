@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const maxAdminBody = 1 << 20
+
+// AdminHandler serves the runtime admin API. Every request must carry
+// "Authorization: Bearer <token>".
+func (g *Gateway) AdminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/services", g.adminListServices)
+	mux.HandleFunc("GET /admin/services/{name}", g.adminGetService)
+	mux.HandleFunc("POST /admin/services", g.adminAddService)
+	mux.HandleFunc("PUT /admin/services/{name}", g.adminUpdateService)
+	mux.HandleFunc("DELETE /admin/services/{name}", g.adminRemoveService)
+	mux.HandleFunc("POST /admin/services/{name}/maintenance", g.adminMaintenance)
+	mux.HandleFunc("DELETE /admin/services/{name}/cache", g.adminPurgeCache)
+	mux.HandleFunc("POST /admin/reload", g.adminReload)
+	mux.HandleFunc("GET /admin/generation", g.adminGeneration)
+	mux.HandleFunc("GET /admin/history", g.adminHistory)
+	mux.Handle("GET /metrics", g.metrics.Handler())
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			JSONBadResponse(w, "invalid admin token", http.StatusUnauthorized, nil)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// effectiveConfig renders a service with its YAML field names, the way it
+// would be written in aimas.yml after defaults. Fields set through ${...}
+// references keep the reference rather than the value it resolved to.
+func effectiveConfig(svc *Service) map[string]interface{} {
+	out := map[string]interface{}{}
+	data, err := yaml.Marshal(svc)
+	if err == nil {
+		_ = yaml.Unmarshal(data, &out)
+	}
+	restoreRawFields(out, "", svc.rawFields)
+	return out
+}
+
+// restoreRawFields puts the written text back into the fields of a rendered
+// service that were interpolated.
+func restoreRawFields(v interface{}, path string, raw map[string]string) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			p := k
+			if path != "" {
+				p = path + "." + k
+			}
+			if text, ok := raw[p]; ok {
+				v[k] = text
+				continue
+			}
+			restoreRawFields(child, p, raw)
+		}
+	case []interface{}:
+		for i, child := range v {
+			p := path + "[" + strconv.Itoa(i) + "]"
+			if text, ok := raw[p]; ok {
+				v[i] = text
+				continue
+			}
+			restoreRawFields(child, p, raw)
+		}
+	}
+}
+
+func (g *Gateway) liveServices() []*Service {
+	table := g.atomicRoutes.Load().(*routeTable)
+	out := make([]*Service, 0, len(table.routes))
+	for _, rt := range table.routes {
+		out = append(out, rt.svc)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func (g *Gateway) adminListServices(w http.ResponseWriter, r *http.Request) {
+	var list []map[string]interface{}
+	for _, svc := range g.liveServices() {
+		list = append(list, effectiveConfig(svc))
+	}
+	JSONSuccess(w, "services", list, http.StatusOK)
+}
+
+func (g *Gateway) adminGetService(w http.ResponseWriter, r *http.Request) {
+	for _, svc := range g.liveServices() {
+		if svc.Name == r.PathValue("name") {
+			JSONSuccess(w, "service", effectiveConfig(svc), http.StatusOK)
+			return
+		}
+	}
+	JSONBadResponse(w, "service not found", http.StatusNotFound, nil)
+}
+
+func (g *Gateway) adminAddService(w http.ResponseWriter, r *http.Request) {
+	node, err := readServiceNode(r)
+	if err != nil {
+		JSONBadResponse(w, "invalid service definition", http.StatusBadRequest, err.Error())
+		return
+	}
+	name := mappingValue(node, "name")
+	err = g.mutateConfig(persistRequested(r), func(services *yaml.Node) error {
+		if findServiceNode(services, name) >= 0 {
+			return fmt.Errorf("%w: %s", ErrorServiceExists, name)
+		}
+		services.Content = append(services.Content, node)
+		return nil
+	})
+	g.adminResult(w, err, "service added", http.StatusCreated)
+}
+
+func (g *Gateway) adminUpdateService(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	node, err := readServiceNode(r)
+	if err != nil {
+		JSONBadResponse(w, "invalid service definition", http.StatusBadRequest, err.Error())
+		return
+	}
+	if n := mappingValue(node, "name"); n == "" {
+		setMappingValue(node, "name", name, "!!str")
+	} else if n != name {
+		JSONBadResponse(w, "service name in body does not match path", http.StatusBadRequest, nil)
+		return
+	}
+	err = g.mutateConfig(persistRequested(r), func(services *yaml.Node) error {
+		i := findServiceNode(services, name)
+		if i < 0 {
+			return fmt.Errorf("%w: %s", ErrorServiceNotFound, name)
+		}
+		services.Content[i] = node
+		return nil
+	})
+	g.adminResult(w, err, "service updated", http.StatusOK)
+}
+
+func (g *Gateway) adminRemoveService(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	err := g.mutateConfig(persistRequested(r), func(services *yaml.Node) error {
+		i := findServiceNode(services, name)
+		if i < 0 {
+			return fmt.Errorf("%w: %s", ErrorServiceNotFound, name)
+		}
+		services.Content = append(services.Content[:i], services.Content[i+1:]...)
+		return nil
+	})
+	g.adminResult(w, err, "service removed", http.StatusOK)
+}
+
+func (g *Gateway) adminMaintenance(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	var body struct {
+		Enabled bool `yaml:"enabled"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(r.Body, maxAdminBody))
+	if err := yaml.Unmarshal(data, &body); err != nil {
+		JSONBadResponse(w, "invalid body", http.StatusBadRequest, err.Error())
+		return
+	}
+	err := g.mutateConfig(persistRequested(r), func(services *yaml.Node) error {
+		i := findServiceNode(services, name)
+		if i < 0 {
+			return fmt.Errorf("%w: %s", ErrorServiceNotFound, name)
+		}
+		setMappingValue(services.Content[i], "maintenance", fmt.Sprint(body.Enabled), "!!bool")
+		return nil
+	})
+	message := "maintenance disabled"
+	if body.Enabled {
+		message = "maintenance enabled"
+	}
+	g.adminResult(w, err, message, http.StatusOK)
+}
+
+// adminPurgeCache drops a service's cached responses, only those under
+// ?path= when it is given.
+func (g *Gateway) adminPurgeCache(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	purged, ok := g.caches.purge(name, r.URL.Query().Get("path"))
+	if !ok {
+		JSONBadResponse(w, "service not found or not cached", http.StatusNotFound, nil)
+		return
+	}
+	JSONSuccess(w, "cache purged", map[string]interface{}{"service": name, "purged": purged}, http.StatusOK)
+}
+
+func (g *Gateway) adminReload(w http.ResponseWriter, r *http.Request) {
+	live := g.live.Load()
+	if live == nil {
+		JSONBadResponse(w, "no configuration loaded", http.StatusConflict, nil)
+		return
+	}
+	g.adminResult(w, g.reloadFromPath(live.path), "configuration reloaded", http.StatusOK)
+}
+
+func (g *Gateway) adminGeneration(w http.ResponseWriter, r *http.Request) {
+	live := g.live.Load()
+	if live == nil {
+		JSONBadResponse(w, "no configuration loaded", http.StatusConflict, nil)
+		return
+	}
+	JSONSuccess(w, "generation", map[string]interface{}{
+		"generation": live.generation,
+		"config":     live.path,
+		"loaded_at":  live.loadedAt.Format(time.RFC3339),
+		"services":   len(live.cfg.Routes),
+	}, http.StatusOK)
+}
+
+func (g *Gateway) adminHistory(w http.ResponseWriter, r *http.Request) {
+	JSONSuccess(w, "reload history", g.history.list(), http.StatusOK)
+}
+
+func (g *Gateway) adminResult(w http.ResponseWriter, err error, message string, status int) {
+	var ve ValidationError
+	switch {
+	case err == nil:
+		live := g.live.Load()
+		JSONSuccess(w, message, map[string]interface{}{"generation": live.generation}, status)
+	case errors.As(err, &ve):
+		JSONBadResponse(w, "configuration rejected", http.StatusUnprocessableEntity, ve)
+	case errors.Is(err, ErrorServiceNotFound):
+		JSONBadResponse(w, err.Error(), http.StatusNotFound, nil)
+	case errors.Is(err, ErrorServiceExists):
+		JSONBadResponse(w, err.Error(), http.StatusConflict, nil)
+	default:
+		JSONBadResponse(w, "admin operation failed", http.StatusInternalServerError, err.Error())
+	}
+}
+
+func persistRequested(r *http.Request) bool {
+	v := r.URL.Query().Get("persist")
+	return v == "true" || v == "1"
+}
+
+// mutateConfig edits the services list of the live configuration and
+// applies the result with the same validation and atomic swap as a file
+// reload. A service stays in the file that defines it; new services go to
+// the main file, or to <name>.yml in a config directory. With persist the
+// files that changed are also written back.
+func (g *Gateway) mutateConfig(persist bool, fn func(services *yaml.Node) error) error {
+	g.configMu.Lock()
+	defer g.configMu.Unlock()
+
+	live := g.live.Load()
+	if live == nil {
+		return errors.New("no configuration loaded")
+	}
+	src := live.source
+	docs := make([]*yaml.Node, len(src.files))
+	encoded := make([][]byte, len(src.files))
+	owner := map[string]string{}
+	merged := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	for i, f := range src.files {
+		docs[i] = &yaml.Node{}
+		if err := yaml.Unmarshal(f.data, docs[i]); err != nil {
+			return err
+		}
+		var err error
+		if encoded[i], err = encodeNode(docs[i]); err != nil {
+			return err
+		}
+		if len(docs[i].Content) == 0 || !hasMappingKey(docs[i].Content[0], "services") {
+			continue
+		}
+		for _, item := range servicesNode(docs[i]).Content {
+			owner[mappingValue(item, "name")] = f.path
+			merged.Content = append(merged.Content, item)
+		}
+	}
+	if err := fn(merged); err != nil {
+		return err
+	}
+
+	placed := map[string][]*yaml.Node{}
+	for _, item := range merged.Content {
+		name := mappingValue(item, "name")
+		file, ok := owner[name]
+		if !ok {
+			file = src.defaultFile(name)
+		}
+		placed[file] = append(placed[file], item)
+	}
+
+	next := configSource{root: src.root, dir: src.dir}
+	var changed []sourceFile
+	for i, f := range src.files {
+		data, err := placeServices(docs[i], placed[f.path], encoded[i], f.data)
+		if err != nil {
+			return err
+		}
+		delete(placed, f.path)
+		next.files = append(next.files, sourceFile{path: f.path, data: data})
+		if !bytes.Equal(data, f.data) {
+			changed = append(changed, next.files[len(next.files)-1])
+		}
+	}
+	for file, items := range placed {
+		data, err := placeServices(&yaml.Node{}, items, nil, nil)
+		if err != nil {
+			return err
+		}
+		next.files = append(next.files, sourceFile{path: file, data: data})
+		changed = append(changed, next.files[len(next.files)-1])
+	}
+
+	if err := g.applySourceLocked(next, "admin"); err != nil {
+		return err
+	}
+	if persist {
+		for _, f := range changed {
+			if err := writeFileAtomic(f.path, f.data); err != nil {
+				return fmt.Errorf("change applied but not persisted: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// placeServices sets the services of one file and encodes it, returning
+// the original bytes when the encoding matches the one taken before the
+// edit.
+func placeServices(doc *yaml.Node, items []*yaml.Node, before, original []byte) ([]byte, error) {
+	if len(items) > 0 || (len(doc.Content) > 0 && hasMappingKey(doc.Content[0], "services")) {
+		servicesNode(doc).Content = items
+	}
+	after, err := encodeNode(doc)
+	if err != nil {
+		return nil, err
+	}
+	if original != nil && bytes.Equal(before, after) {
+		return original, nil
+	}
+	return after, nil
+}
+
+func encodeNode(n *yaml.Node) ([]byte, error) {
+	if n.Kind == 0 {
+		return nil, nil
+	}
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(n); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func readServiceNode(r *http.Request) (*yaml.Node, error) {
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxAdminBody))
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, errors.New("body must be a service object")
+	}
+	node := doc.Content[0]
+	blockStyle(node)
+	return node, nil
+}
+
+// blockStyle drops the flow style and quoting JSON bodies decode with, so a
+// persisted file stays in the usual block layout. Tags are kept, so strings
+// that would read as another type are still quoted when encoded.
+func blockStyle(n *yaml.Node) {
+	n.Style &^= yaml.FlowStyle | yaml.DoubleQuotedStyle | yaml.SingleQuotedStyle
+	for _, c := range n.Content {
+		blockStyle(c)
+	}
+}
+
+// servicesNode returns the services sequence of a document, creating the
+// document, its root mapping or the sequence as needed.
+func servicesNode(root *yaml.Node) *yaml.Node {
+	if root.Kind != yaml.DocumentNode {
+		*root = yaml.Node{Kind: yaml.DocumentNode}
+	}
+	if len(root.Content) == 0 || root.Content[0].Kind != yaml.MappingNode {
+		root.Content = []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}
+	}
+	m := root.Content[0]
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == "services" {
+			if m.Content[i+1].Kind != yaml.SequenceNode {
+				m.Content[i+1] = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+			}
+			return m.Content[i+1]
+		}
+	}
+	seq := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "services"}, seq)
+	return seq
+}
+
+func findServiceNode(services *yaml.Node, name string) int {
+	for i, n := range services.Content {
+		if mappingValue(n, "name") == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func hasMappingKey(n *yaml.Node, key string) bool {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return true
+		}
+	}
+	return false
+}
+
+func mappingValue(n *yaml.Node, key string) string {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			if v, err := interpolate(n.Content[i+1].Value); err == nil {
+				return v
+			}
+			return n.Content[i+1].Value
+		}
+	}
+	return ""
+}
+
+func setMappingValue(n *yaml.Node, key, value, tag string) {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			n.Content[i+1] = &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: value}
+			return
+		}
+	}
+	n.Content = append(n.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key},
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: value},
+	)
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
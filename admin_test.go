@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func adminRequest(t *testing.T, h http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestAdmin_ServiceLifecycle(t *testing.T) {
+	path := writeConfig(t, "services:\n  - name: user\n    host: http://localhost:9001\n    prefix: /user\n")
+	gw := setupGateway(t, map[string]*Service{})
+	if err := gw.reloadFromPath(path); err != nil {
+		t.Fatal(err)
+	}
+	admin := gw.AdminHandler("admin-secret")
+
+	if w := adminRequest(t, admin, http.MethodGet, "/admin/services", ""); w.Code != http.StatusOK {
+		t.Fatalf("list: expected 200, got %d", w.Code)
+	}
+
+	w := adminRequest(t, admin, http.MethodPost, "/admin/services",
+		`{"name":"rec","host":"http://localhost:9004","prefix":"/rec","auth":"none","middlewares":["recover"]}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("add: expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	if _, ok := gw.atomicRoutes.Load().(*routeTable).routes["/rec"]; !ok {
+		t.Fatal("added service should be routed")
+	}
+
+	w = adminRequest(t, admin, http.MethodPut, "/admin/services/rec", `{"host":"http://localhost:9004","prefix":"/rec","rate_limit":{"requests_per_minute":-1}}`)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("invalid update: expected 422, got %d", w.Code)
+	}
+
+	w = adminRequest(t, admin, http.MethodPost, "/admin/services/rec/maintenance?persist=true", `{"enabled":true}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("maintenance: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	resp := httptest.NewRecorder()
+	gw.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/rec/items", nil))
+	if resp.Code != http.StatusServiceUnavailable {
+		t.Fatalf("service in maintenance should return 503, got %d", resp.Code)
+	}
+	data, _ := os.ReadFile(path)
+	if !strings.Contains(string(data), "maintenance: true") || !strings.Contains(string(data), "name: rec") {
+		t.Fatalf("persisted file missing changes:\n%s", data)
+	}
+
+	if w := adminRequest(t, admin, http.MethodDelete, "/admin/services/missing", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("remove missing: expected 404, got %d", w.Code)
+	}
+}
+
+func TestAdmin_RequiresToken(t *testing.T) {
+	gw := setupGateway(t, map[string]*Service{})
+	w := httptest.NewRecorder()
+	gw.AdminHandler("admin-secret").ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/generation", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", w.Code)
+	}
+}
+
+func TestAdmin_ServicesShowReferencesNotSecrets(t *testing.T) {
+	t.Setenv("ADMIN_TEST_SECRET", "s3cr3t-value")
+	path := writeConfig(t, `services:
+  - name: user
+    prefix: /user
+    request_headers:
+      set: {X-Upstream-Key: "${ADMIN_TEST_SECRET}"}
+    backends:
+      - {name: stable, host: "http://${ADMIN_TEST_HOST:-localhost}:9001", weight: 1}
+`)
+	gw := setupGateway(t, map[string]*Service{})
+	if err := gw.reloadFromPath(path); err != nil {
+		t.Fatal(err)
+	}
+	w := adminRequest(t, gw.AdminHandler("admin-secret"), http.MethodGet, "/admin/services/user", "")
+	body := w.Body.String()
+	if strings.Contains(body, "s3cr3t-value") {
+		t.Errorf("resolved secret leaked: %s", body)
+	}
+	for _, want := range []string{`"X-Upstream-Key":"${ADMIN_TEST_SECRET}"`, `"host":"http://${ADMIN_TEST_HOST:-localhost}:9001"`, `"prefix":"/user"`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %s in %s", want, body)
+		}
+	}
+}
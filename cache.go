@@ -0,0 +1,626 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultCacheBytes      = 64 << 20
+	defaultCacheEntryBytes = 1 << 20
+)
+
+// CacheConfig keeps responses to GET and HEAD requests in memory, for as
+// long as the upstream's Cache-Control or Expires allows, or for TTL when
+// the upstream says nothing. Vary lists request headers that are part of
+// the cache key besides those the upstream names in its Vary header.
+// Authenticated sets how requests carrying an identity are cached:
+// per_user (the default) keeps a copy per user, shared lets users share
+// copies, and bypass never caches them.
+type CacheConfig struct {
+	Enabled       bool          `yaml:"enabled"`
+	MaxBytes      int64         `yaml:"max_bytes"`
+	MaxEntryBytes int64         `yaml:"max_entry_bytes"`
+	TTL           time.Duration `yaml:"ttl"`
+	// StaleWhileRevalidate is how long an expired response may still be
+	// served while it is refreshed in the background, unless the upstream
+	// sets its own stale-while-revalidate.
+	StaleWhileRevalidate time.Duration `yaml:"stale_while_revalidate"`
+	Vary                 []string      `yaml:"vary"`
+	Authenticated        string        `yaml:"authenticated"`
+}
+
+func (c CacheConfig) equal(o CacheConfig) bool {
+	return c.Enabled == o.Enabled && c.MaxBytes == o.MaxBytes && c.MaxEntryBytes == o.MaxEntryBytes &&
+		c.TTL == o.TTL && c.StaleWhileRevalidate == o.StaleWhileRevalidate &&
+		slices.Equal(c.Vary, o.Vary) && c.Authenticated == o.Authenticated
+}
+
+// cacheableStatus are the statuses stored when the response allows it.
+var cacheableStatus = map[int]bool{
+	http.StatusOK: true, http.StatusNonAuthoritativeInfo: true, http.StatusNoContent: true,
+	http.StatusMultipleChoices: true, http.StatusMovedPermanently: true, http.StatusPermanentRedirect: true,
+	http.StatusNotFound: true, http.StatusGone: true,
+}
+
+type cacheEntry struct {
+	key, base, path string
+	identity        string
+	vary            []string
+	status          int
+	header          http.Header
+	body            []byte
+	etag            string
+	stored          time.Time // when the upstream generated the response
+	fresh, stale    time.Duration
+	revalidating    atomic.Bool
+	elem            *list.Element
+}
+
+func (e *cacheEntry) size() int64 {
+	n := int64(len(e.key) + len(e.body))
+	for k, vv := range e.header {
+		for _, v := range vv {
+			n += int64(len(k) + len(v))
+		}
+	}
+	return n
+}
+
+// cacheBase counts the entries of one URL and remembers the request
+// headers its upstream varies on.
+type cacheBase struct {
+	vary    []string
+	entries int
+}
+
+// responseCache is the LRU store of one service.
+type responseCache struct {
+	cfg        CacheConfig
+	configured CacheConfig
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	bases   map[string]*cacheBase
+	lru     *list.List // front is most recently used
+	size    int64
+}
+
+func newResponseCache(cfg CacheConfig) *responseCache {
+	configured := cfg
+	if cfg.MaxBytes == 0 {
+		cfg.MaxBytes = defaultCacheBytes
+	}
+	if cfg.MaxEntryBytes == 0 {
+		cfg.MaxEntryBytes = min(defaultCacheEntryBytes, cfg.MaxBytes)
+	}
+	cfg.Vary = append([]string(nil), cfg.Vary...)
+	for i, h := range cfg.Vary {
+		cfg.Vary[i] = textproto.CanonicalMIMEHeaderKey(h)
+	}
+	return &responseCache{
+		cfg:        cfg,
+		configured: configured,
+		entries:    map[string]*cacheEntry{},
+		bases:      map[string]*cacheBase{},
+		lru:        list.New(),
+	}
+}
+
+// CacheManager holds the response caches of services by name, so cached
+// responses survive reloads that leave a service's cache settings alone.
+type CacheManager struct {
+	mu     sync.Mutex
+	stores map[string]*responseCache
+}
+
+func NewCacheManager() *CacheManager {
+	return &CacheManager{stores: make(map[string]*responseCache)}
+}
+
+// get returns the cache of a service, starting an empty one when the
+// service's cache settings changed.
+func (c *CacheManager) get(serviceName string, cfg CacheConfig) *responseCache {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.stores[serviceName]
+	if !ok || !s.configured.equal(cfg) {
+		s = newResponseCache(cfg)
+		c.stores[serviceName] = s
+	}
+	return s
+}
+
+func (c *CacheManager) retain(keep map[string]*Service) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	names := make(map[string]bool, len(keep))
+	for _, svc := range keep {
+		if svc.Cache.Enabled {
+			names[svc.Name] = true
+		}
+	}
+	for name := range c.stores {
+		if !names[name] {
+			delete(c.stores, name)
+		}
+	}
+}
+
+// purge drops the cached responses of a service whose path starts with
+// prefix, or all of them when prefix is empty. ok is false when the
+// service has no cache.
+func (c *CacheManager) purge(serviceName, prefix string) (purged int, ok bool) {
+	c.mu.Lock()
+	s, ok := c.stores[serviceName]
+	c.mu.Unlock()
+	if !ok {
+		return 0, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.entries {
+		if strings.HasPrefix(e.path, prefix) {
+			s.removeLocked(e)
+			purged++
+		}
+	}
+	return purged, true
+}
+
+// Handler serves the service's cacheable requests from its cache, and
+// stores the responses of next that may be cached. It wraps the upstream,
+// so auth and the other middlewares run for hits too.
+func (c *CacheManager) Handler(svc *Service, next http.Handler) http.Handler {
+	if !svc.Cache.Enabled {
+		return next
+	}
+	return &cacheHandler{store: c.get(svc.Name, svc.Cache), next: next}
+}
+
+type cacheHandler struct {
+	store *responseCache
+	next  http.Handler
+}
+
+func (h *cacheHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s := h.store
+	identity := cacheIdentity(r)
+	reqCC := parseCacheControl(r.Header)
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) || streamKind(r) != "" ||
+		r.Header.Get("Range") != "" || reqCC.has("no-store") ||
+		(identity != "" && s.cfg.Authenticated == "bypass") {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	if s.cfg.Authenticated == "shared" {
+		identity = ""
+	}
+
+	base := cacheBaseKey(r, identity)
+	now := time.Now()
+	// no-cache and max-age=0 ask for a response from the upstream, which
+	// is then stored as usual.
+	refresh := reqCC.has("no-cache") || reqCC["max-age"] == "0"
+	if e := s.lookup(r, base); e != nil && !refresh {
+		age := now.Sub(e.stored)
+		switch {
+		case age < e.fresh:
+			s.serve(w, r, e, age, "HIT")
+			return
+		case age < e.fresh+e.stale:
+			s.serve(w, r, e, age, "STALE")
+			h.revalidate(r, e)
+			return
+		}
+	}
+
+	// Fetch the full response even for a conditional request, so it can be
+	// stored; the client still gets its 304.
+	fetch := r.Clone(r.Context())
+	fetch.Header.Del("If-None-Match")
+	fetch.Header.Del("If-Modified-Since")
+	cw := s.newCacheWriter(w, r, base, identity)
+	h.next.ServeHTTP(cw.capture, fetch)
+	cw.finish()
+}
+
+// revalidate refreshes a stale entry in the background, once at a time,
+// with the entry's ETag so an unchanged response costs a 304.
+func (h *cacheHandler) revalidate(r *http.Request, e *cacheEntry) {
+	if !e.revalidating.CompareAndSwap(false, true) {
+		return
+	}
+	req := r.Clone(context.WithoutCancel(r.Context()))
+	req.Body = http.NoBody
+	req.Header.Del("If-None-Match")
+	req.Header.Del("If-Modified-Since")
+	req.Header.Del("Cache-Control")
+	if e.etag != "" {
+		req.Header.Set("If-None-Match", e.etag)
+	}
+	go func() {
+		defer e.revalidating.Store(false)
+		// The proxy aborts the handler when the upstream body fails; that
+		// must not take the gateway down with it. Any other panic is a bug
+		// and is not hidden.
+		defer func() {
+			if rec := recover(); rec != nil && rec != http.ErrAbortHandler {
+				panic(rec)
+			}
+		}()
+		rec := &cacheRecorder{header: http.Header{}, status: http.StatusOK}
+		h.next.ServeHTTP(rec, req)
+		h.store.revalidated(e, req, rec.status, rec.header, rec.body.Bytes())
+	}()
+}
+
+// lookup returns the entry for r, if one is stored.
+func (s *responseCache) lookup(r *http.Request, base string) *cacheEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var vary []string
+	if b, ok := s.bases[base]; ok {
+		vary = b.vary
+	}
+	e, ok := s.entries[cacheKey(r, base, s.varyNames(vary))]
+	if !ok {
+		return nil
+	}
+	s.lru.MoveToFront(e.elem)
+	return e
+}
+
+func (s *responseCache) serve(w http.ResponseWriter, r *http.Request, e *cacheEntry, age time.Duration, state string) {
+	h := w.Header()
+	for k, v := range e.header {
+		h[k] = v
+	}
+	h.Set("Age", strconv.Itoa(int(age.Seconds())))
+	h.Set("X-Cache", state)
+	if e.etag != "" && etagMatches(r.Header.Get("If-None-Match"), e.etag) {
+		h.Del("Content-Length")
+		h.Del("Content-Type")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(e.status)
+	if r.Method != http.MethodHead {
+		w.Write(e.body)
+	}
+}
+
+// varyNames returns the configured Vary headers together with those the
+// upstream named, sorted and without duplicates.
+func (s *responseCache) varyNames(upstream []string) []string {
+	names := append(append([]string(nil), s.cfg.Vary...), upstream...)
+	sort.Strings(names)
+	return slices.Compact(names)
+}
+
+// entryFor builds the entry for a response to r, or returns nil when the
+// response may not be stored.
+func (s *responseCache) entryFor(r *http.Request, base, identity string, status int, header http.Header, body []byte) *cacheEntry {
+	if !cacheableStatus[status] || header.Get("Set-Cookie") != "" || header.Get("Trailer") != "" {
+		return nil
+	}
+	cc := parseCacheControl(header)
+	if cc.has("no-store") || cc.has("no-cache") || (cc.has("private") && identity == "") {
+		return nil
+	}
+	var vary []string
+	for _, v := range header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))
+			if name == "*" {
+				return nil
+			}
+			if name != "" {
+				vary = append(vary, name)
+			}
+		}
+	}
+	now := time.Now()
+	stored := now
+	if age, err := strconv.Atoi(header.Get("Age")); err == nil && age > 0 {
+		stored = now.Add(-time.Duration(age) * time.Second)
+	}
+	fresh, ok := cc.seconds("s-maxage")
+	if !ok {
+		fresh, ok = cc.seconds("max-age")
+	}
+	if !ok && header.Get("Expires") != "" {
+		ok = true
+		if expires, err := http.ParseTime(header.Get("Expires")); err == nil {
+			date, err := http.ParseTime(header.Get("Date"))
+			if err != nil {
+				date = now
+			}
+			fresh = expires.Sub(date)
+		}
+	}
+	if !ok {
+		fresh = s.cfg.TTL
+	}
+	if fresh <= 0 {
+		return nil
+	}
+	stale, ok := cc.seconds("stale-while-revalidate")
+	if !ok {
+		stale = s.cfg.StaleWhileRevalidate
+	}
+	if cc.has("must-revalidate") || cc.has("proxy-revalidate") {
+		stale = 0
+	}
+	e := &cacheEntry{
+		base:     base,
+		path:     r.URL.Path,
+		identity: identity,
+		vary:     vary,
+		status:   status,
+		header:   header.Clone(),
+		body:     body,
+		etag:     header.Get("ETag"),
+		stored:   stored,
+		fresh:    fresh,
+		stale:    stale,
+	}
+	e.key = cacheKey(r, base, s.varyNames(vary))
+	return e
+}
+
+func (s *responseCache) put(e *cacheEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.entries[e.key]; ok {
+		s.removeLocked(old)
+	}
+	b, ok := s.bases[e.base]
+	if !ok {
+		b = &cacheBase{}
+		s.bases[e.base] = b
+	}
+	b.vary = e.vary
+	b.entries++
+	e.elem = s.lru.PushFront(e)
+	s.entries[e.key] = e
+	s.size += e.size()
+	for s.size > s.cfg.MaxBytes {
+		s.removeLocked(s.lru.Back().Value.(*cacheEntry))
+	}
+}
+
+func (s *responseCache) removeLocked(e *cacheEntry) {
+	if s.entries[e.key] != e {
+		return
+	}
+	delete(s.entries, e.key)
+	s.lru.Remove(e.elem)
+	s.size -= e.size()
+	if b := s.bases[e.base]; b != nil {
+		if b.entries--; b.entries == 0 {
+			delete(s.bases, e.base)
+		}
+	}
+}
+
+// revalidated applies the upstream's answer to a background refresh: a
+// 304 extends the entry, another storable response replaces it, anything
+// else drops it.
+func (s *responseCache) revalidated(e *cacheEntry, r *http.Request, status int, header http.Header, body []byte) {
+	if status == http.StatusNotModified {
+		merged := e.header.Clone()
+		for _, k := range []string{"Cache-Control", "Expires", "Date", "Etag", "Age"} {
+			if v, ok := header[k]; ok {
+				merged[k] = v
+			} else if k == "Age" {
+				delete(merged, k)
+			}
+		}
+		header, status, body = merged, e.status, e.body
+	}
+	s.mu.Lock()
+	current := s.entries[e.key] == e
+	s.mu.Unlock()
+	if !current {
+		return
+	}
+	if next := s.entryFor(r, e.base, e.identity, status, header, body); next != nil && next.key == e.key {
+		s.put(next)
+		return
+	}
+	s.mu.Lock()
+	s.removeLocked(e)
+	s.mu.Unlock()
+}
+
+// cacheWriter stores the response captured on its way to the client.
+// Headers the upstream sets replace the gateway's, so a cacheable response
+// keeps its own Cache-Control.
+type cacheWriter struct {
+	capture  *captureWriter
+	store    *responseCache
+	req      *http.Request
+	base     string
+	identity string
+}
+
+func (s *responseCache) newCacheWriter(w http.ResponseWriter, r *http.Request, base, identity string) *cacheWriter {
+	c := &cacheWriter{capture: newCaptureWriter(w, s.cfg.MaxEntryBytes), store: s, req: r, base: base, identity: identity}
+	c.capture.replace = true
+	c.capture.sending = c.sending
+	return c
+}
+
+// sending marks the response as a miss, and answers a conditional request
+// the response matches with 304.
+func (c *cacheWriter) sending(code int) int {
+	h := c.capture.ResponseWriter.Header()
+	h.Set("X-Cache", "MISS")
+	if etag := c.capture.header.Get("ETag"); code == http.StatusOK && etag != "" && etagMatches(c.req.Header.Get("If-None-Match"), etag) {
+		c.capture.discard = true
+		h.Del("Content-Length")
+		h.Del("Content-Type")
+		return http.StatusNotModified
+	}
+	return code
+}
+
+// finish stores the response once it has been passed on in full.
+func (c *cacheWriter) finish() {
+	cw := c.capture
+	if !cw.wroteHeader || !cw.keep {
+		return
+	}
+	if e := c.store.entryFor(c.req, c.base, c.identity, cw.status, cw.header, cw.body.Bytes()); e != nil {
+		c.store.put(e)
+	}
+}
+
+// cacheRecorder buffers the response to a background revalidation.
+type cacheRecorder struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (c *cacheRecorder) Header() http.Header { return c.header }
+
+func (c *cacheRecorder) WriteHeader(code int) {
+	if !c.wroteHeader && code >= 200 {
+		c.wroteHeader = true
+		c.status = code
+	}
+}
+
+func (c *cacheRecorder) Write(p []byte) (int, error) {
+	c.WriteHeader(http.StatusOK)
+	return c.body.Write(p)
+}
+
+func (c *cacheRecorder) Flush() {}
+
+// cacheIdentity names who a request was authenticated as, or returns ""
+// for anonymous requests.
+func cacheIdentity(r *http.Request) string {
+	if id := r.Header.Get("X-User-ID"); id != "" {
+		return "user:" + id
+	}
+	if id := r.Header.Get("X-Consumer-ID"); id != "" {
+		return "consumer:" + id
+	}
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		sum := sha256.Sum256([]byte(auth))
+		return "authorization:" + hex.EncodeToString(sum[:8])
+	}
+	return ""
+}
+
+// cacheBaseKey identifies the URL of a request, and the user for per-user
+// entries. Query parameters are sorted, so their order does not matter.
+func cacheBaseKey(r *http.Request, identity string) string {
+	return fmt.Sprintf("%s %s%s?%s\x00%s", r.Method, r.Host, r.URL.EscapedPath(), r.URL.Query().Encode(), identity)
+}
+
+func cacheKey(r *http.Request, base string, vary []string) string {
+	var b strings.Builder
+	b.WriteString(base)
+	for _, name := range vary {
+		b.WriteString("\x00")
+		b.WriteString(name)
+		b.WriteString("=")
+		b.WriteString(strings.Join(r.Header.Values(name), ","))
+	}
+	return b.String()
+}
+
+// etagMatches applies the weak comparison of If-None-Match.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, t := range strings.Split(ifNoneMatch, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheControl holds the directives of a Cache-Control header, lowercased,
+// with their values unquoted.
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(d), "=")
+			if name != "" {
+				cc[strings.ToLower(name)] = strings.Trim(value, `"`)
+			}
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	v, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+func validateCache(c *configIssues, cfg CacheConfig, path []interface{}) {
+	if cfg.MaxBytes < 0 {
+		c.addf(appendPath(path, "max_bytes"), "must not be negative, got %d", cfg.MaxBytes)
+	}
+	if cfg.MaxEntryBytes < 0 {
+		c.addf(appendPath(path, "max_entry_bytes"), "must not be negative, got %d", cfg.MaxEntryBytes)
+	}
+	if cfg.MaxBytes > 0 && cfg.MaxEntryBytes > cfg.MaxBytes {
+		c.addf(appendPath(path, "max_entry_bytes"), "must not be larger than max_bytes (%d)", cfg.MaxBytes)
+	}
+	if cfg.TTL < 0 {
+		c.addf(appendPath(path, "ttl"), "must not be negative, got %s", cfg.TTL)
+	}
+	if cfg.StaleWhileRevalidate < 0 {
+		c.addf(appendPath(path, "stale_while_revalidate"), "must not be negative, got %s", cfg.StaleWhileRevalidate)
+	}
+	for i, h := range cfg.Vary {
+		if h == "" || strings.ContainsAny(h, " \t:,") {
+			c.addf(appendPath(appendPath(path, "vary"), i), "invalid header name %q", h)
+		}
+	}
+	switch cfg.Authenticated {
+	case "", "per_user", "shared", "bypass":
+	default:
+		c.addf(appendPath(path, "authenticated"), "unknown mode %q, expected per_user, shared or bypass", cfg.Authenticated)
+	}
+}
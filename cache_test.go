@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestCache_HitsConditionalRequestsAndPerUserEntries(t *testing.T) {
+	var calls atomic.Int64
+	gw := serviceGateway(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if strings.HasSuffix(r.URL.Path, "/private") {
+			w.Header().Set("Cache-Control", "no-store")
+		} else {
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("ETag", `"v1"`)
+		}
+		fmt.Fprintf(w, "list for %s", r.Header.Get("X-User-ID"))
+	}), "auth: jwt\ncache: {enabled: true}")
+	tokens := map[string]string{
+		"ada": signedToken(t, jwt.MapClaims{"user_id": "ada", "exp": time.Now().Add(time.Hour).Unix()}),
+		"bob": signedToken(t, jwt.MapClaims{"user_id": "bob", "exp": time.Now().Add(time.Hour).Unix()}),
+	}
+	get := func(user, path, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer "+tokens[user])
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		gw.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := get("ada", "/recs/list?b=2&a=1", ""); w.Header().Get("X-Cache") != "MISS" || w.Body.String() != "list for ada" {
+		t.Fatalf("first request: %s %q", w.Header().Get("X-Cache"), w.Body.String())
+	}
+	w := get("ada", "/recs/list?a=1&b=2", "")
+	if w.Header().Get("X-Cache") != "HIT" || w.Body.String() != "list for ada" || calls.Load() != 1 {
+		t.Fatalf("expected a hit with reordered query, got %s %q after %d calls", w.Header().Get("X-Cache"), w.Body.String(), calls.Load())
+	}
+	if cc := w.Header().Values("Cache-Control"); len(cc) != 1 || cc[0] != "max-age=60" {
+		t.Errorf("expected the upstream's Cache-Control, got %q", cc)
+	}
+	if w := get("ada", "/recs/list?a=1&b=2", `"v1"`); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("expected 304 for a matching If-None-Match, got %d", w.Code)
+	}
+	if w := get("bob", "/recs/list?a=1&b=2", ""); w.Header().Get("X-Cache") != "MISS" || w.Body.String() != "list for bob" {
+		t.Errorf("users must not share entries, got %s %q", w.Header().Get("X-Cache"), w.Body.String())
+	}
+	// A conditional miss is fetched in full, stored, and still answered 304.
+	if w := get("bob", "/recs/other", `"v1"`); w.Code != http.StatusNotModified {
+		t.Errorf("expected 304 on a conditional miss, got %d", w.Code)
+	}
+	if w := get("bob", "/recs/other", ""); w.Header().Get("X-Cache") != "HIT" || w.Body.String() != "list for bob" {
+		t.Errorf("conditional miss was not stored: %s %q", w.Header().Get("X-Cache"), w.Body.String())
+	}
+	get("ada", "/recs/private", "")
+	if w := get("ada", "/recs/private", ""); w.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("no-store response was cached")
+	}
+
+	admin := gw.AdminHandler("admin-secret")
+	if w := adminRequest(t, admin, http.MethodDelete, "/admin/services/recs/cache?path=/recs/list", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"purged":2`) {
+		t.Fatalf("purge: %d %s", w.Code, w.Body.String())
+	}
+	if w := get("ada", "/recs/list?a=1&b=2", ""); w.Header().Get("X-Cache") != "MISS" {
+		t.Error("purged entry was served")
+	}
+	if w := get("bob", "/recs/other", ""); w.Header().Get("X-Cache") != "HIT" {
+		t.Error("purge dropped an entry outside its path")
+	}
+	if w := adminRequest(t, admin, http.MethodDelete, "/admin/services/missing/cache", ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 purging an uncached service, got %d", w.Code)
+	}
+}
+
+func TestCache_StaleWhileRevalidateAndVary(t *testing.T) {
+	var calls atomic.Int64
+	revalidated := make(chan string, 1)
+	gw := serviceGateway(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) > 1 && r.Header.Get("Accept-Language") == "" {
+			revalidated <- r.Header.Get("If-None-Match")
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		// Already a second old, so it is stale at once.
+		w.Header().Set("Cache-Control", "max-age=1, stale-while-revalidate=30")
+		w.Header().Set("Age", "1")
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprintf(w, "list in %q", r.Header.Get("Accept-Language"))
+	}), "auth: none\ncache: {enabled: true, vary: [accept-language]}")
+	get := func(lang string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/recs/list", nil)
+		if lang != "" {
+			req.Header.Set("Accept-Language", lang)
+		}
+		w := httptest.NewRecorder()
+		gw.ServeHTTP(w, req)
+		return w
+	}
+
+	get("")
+	if w := get(""); w.Header().Get("X-Cache") != "STALE" || w.Body.String() != `list in ""` {
+		t.Fatalf("expected the stale copy, got %s %q", w.Header().Get("X-Cache"), w.Body.String())
+	}
+	select {
+	case etag := <-revalidated:
+		if etag != `"v1"` {
+			t.Errorf("revalidation sent If-None-Match %q", etag)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("stale entry was not revalidated")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for get("").Header().Get("X-Cache") != "HIT" {
+		if time.Now().After(deadline) {
+			t.Fatal("304 did not refresh the entry")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if w := get("fr"); w.Header().Get("X-Cache") != "MISS" || w.Body.String() != `list in "fr"` {
+		t.Errorf("Accept-Language should be part of the key, got %s %q", w.Header().Get("X-Cache"), w.Body.String())
+	}
+}
+
+func TestValidate_Cache(t *testing.T) {
+	_, err := loadConfigFile(writeConfig(t, `services:
+  - name: recs
+    host: http://recs:8080
+    prefix: /recs
+    cache:
+      enabled: true
+      max_bytes: 1024
+      max_entry_bytes: 4096
+      ttl: -1s
+      vary: ["Accept Language"]
+      authenticated: everyone
+`))
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, want := range []string{"must not be larger than max_bytes", "ttl: must not be negative", `invalid header name "Accept Language"`, `unknown mode "everyone"`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in:\n%v", want, err)
+		}
+	}
+}
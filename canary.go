@@ -0,0 +1,202 @@
+package main
+
+import (
+	"hash/fnv"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Backend is one version of a service's upstream. Requests are split
+// across the backends of a service in proportion to their weights; a
+// backend with weight 0 only receives requests that ask for it by name.
+type Backend struct {
+	Name   string `yaml:"name"`
+	Host   string `yaml:"host"`
+	Weight int    `yaml:"weight"`
+}
+
+// SplitConfig controls how requests are assigned to backends. A request
+// naming a backend in the override header or cookie goes to that backend.
+// Otherwise the sticky claim, or failing that the sticky cookie, keeps a
+// client on the same backend for as long as the weights are unchanged.
+type SplitConfig struct {
+	StickyClaim    string `yaml:"sticky_claim"`
+	StickyCookie   string `yaml:"sticky_cookie"`
+	OverrideHeader string `yaml:"override_header"`
+	OverrideCookie string `yaml:"override_cookie"`
+}
+
+type splitBackend struct {
+	name   string
+	weight int
+	proxy  http.Handler
+}
+
+// splitter proxies each request to one of the backends of a service and
+// records per-backend metrics.
+type splitter struct {
+	service  string
+	prefix   string
+	cfg      SplitConfig
+	backends []*splitBackend
+	byName   map[string]*splitBackend
+	total    int
+	metrics  *Metrics
+}
+
+// newUpstream returns the proxy for svc: a single reverse proxy, or a
+// splitter when the service has backends, wrapped by the transcoder, the
+// mirror if one is configured, and the stream limits. transportFor returns the transport
+// to reach an upstream URL.
+func (g *Gateway) newUpstream(svc *Service, transportFor func(*url.URL) http.RoundTripper) http.Handler {
+	var h http.Handler
+	if len(svc.Backends) == 0 {
+		h = g.newReverseProxy(svc, transportFor(svc.URL))
+	} else {
+		h = g.newSplitter(svc, transportFor)
+	}
+	if svc.transcoder != nil {
+		h = g.newTranscoder(svc, h, transportFor)
+	}
+	if svc.Mirror.Host != "" {
+		h = g.newMirror(svc, h, transportFor)
+	}
+	return g.newStreamHandler(svc, h)
+}
+
+func (g *Gateway) newSplitter(svc *Service, transportFor func(*url.URL) http.RoundTripper) *splitter {
+	s := &splitter{
+		service: svc.Name,
+		prefix:  svc.Prefix,
+		cfg:     svc.Split,
+		byName:  map[string]*splitBackend{},
+		metrics: g.metrics,
+	}
+	for _, b := range svc.Backends {
+		u, err := url.Parse(b.Host)
+		if err != nil {
+			continue // rejected by validation
+		}
+		bs := *svc
+		bs.URL = u
+		sb := &splitBackend{name: b.Name, weight: b.Weight, proxy: g.newReverseProxy(&bs, transportFor(u))}
+		s.backends = append(s.backends, sb)
+		s.byName[b.Name] = sb
+		s.total += b.Weight
+	}
+	return s
+}
+
+func (s *splitter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b := s.pick(w, r)
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w}
+	b.proxy.ServeHTTP(sw, r)
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	s.metrics.observeBackend(s.service, b.name, sw.status, time.Since(start))
+}
+
+// stickyBuckets is the fixed range sticky keys are hashed into. A key keeps
+// its bucket whatever the weights add up to.
+const stickyBuckets = 1 << 20
+
+// pick chooses the backend for r. Clients without a sticky key are spread
+// at random; with one, the key is hashed into a fixed bucket, which falls
+// in a backend's share of the bucket range. Raising the weight of the last
+// backend, the canary, only moves clients onto it.
+func (s *splitter) pick(w http.ResponseWriter, r *http.Request) *splitBackend {
+	if h := s.cfg.OverrideHeader; h != "" {
+		if b := s.byName[r.Header.Get(h)]; b != nil {
+			return b
+		}
+	}
+	if name := s.cfg.OverrideCookie; name != "" {
+		if c, err := r.Cookie(name); err == nil {
+			if b := s.byName[c.Value]; b != nil {
+				return b
+			}
+		}
+	}
+
+	var key string
+	if s.cfg.StickyClaim != "" {
+		if c := claimsFromRequest(r); c != nil {
+			key = c.Get(s.cfg.StickyClaim)
+		}
+	}
+	if key == "" && s.cfg.StickyCookie != "" {
+		if c, err := r.Cookie(s.cfg.StickyCookie); err == nil && c.Value != "" {
+			key = c.Value
+		} else {
+			key = uuid.NewString()
+			http.SetCookie(w, &http.Cookie{
+				Name:     s.cfg.StickyCookie,
+				Value:    key,
+				Path:     s.prefix,
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+	}
+
+	var n int
+	if key != "" {
+		h := fnv.New64a()
+		h.Write([]byte(s.service))
+		h.Write([]byte{0})
+		h.Write([]byte(key))
+		n = int(h.Sum64() % stickyBuckets * uint64(s.total) / stickyBuckets)
+	} else {
+		n = rand.IntN(s.total)
+	}
+	for _, b := range s.backends {
+		if n < b.weight {
+			return b
+		}
+		n -= b.weight
+	}
+	return s.backends[len(s.backends)-1]
+}
+
+func validateBackends(c *configIssues, svc Service, path []interface{}) {
+	if len(svc.Backends) == 0 {
+		return
+	}
+	if svc.Host != "" {
+		c.add("set either host or backends, not both", appendPath(path, "host")...)
+	}
+	seen := map[string]bool{}
+	total := 0
+	for i, b := range svc.Backends {
+		at := func(p ...interface{}) []interface{} { return append(appendPath(appendPath(path, "backends"), i), p...) }
+		switch {
+		case b.Name == "":
+			c.add("name is required", at("name")...)
+		case seen[b.Name]:
+			c.addf(at("name"), "duplicate backend %q", b.Name)
+		}
+		seen[b.Name] = true
+		u, err := url.Parse(b.Host)
+		switch {
+		case b.Host == "":
+			c.add("host is required", at("host")...)
+		case err != nil || u.Host == "":
+			c.addf(at("host"), "invalid host %q", b.Host)
+		case !validateScheme(u):
+			c.addf(at("host"), "unsupported scheme %q, expected http or https", u.Scheme)
+		}
+		if b.Weight < 0 {
+			c.addf(at("weight"), "must not be negative, got %d", b.Weight)
+		}
+		total += max(b.Weight, 0)
+	}
+	if total == 0 {
+		c.add("at least one backend needs a positive weight", appendPath(path, "backends")...)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSplit_WeightsOverridesAndStickyCookie(t *testing.T) {
+	stable := mockService(t, "stable", http.StatusOK)
+	canary := mockService(t, "canary", http.StatusOK)
+	yml := fmt.Sprintf(`services:
+  - name: orders
+    prefix: /orders
+    auth: none
+    middlewares: []
+    backends:
+      - {name: stable, host: %s, weight: 95}
+      - {name: canary, host: %s, weight: 5}
+    split:
+      sticky_cookie: aimas_split
+      override_header: X-Version
+`, stable.URL, canary.URL)
+	cfg, err := loadConfigFile(writeConfig(t, yml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw := setupGateway(t, cfg.Routes)
+
+	get := func(header, cookie string) (string, *httptest.ResponseRecorder) {
+		req := httptest.NewRequest(http.MethodGet, "/orders/1", nil)
+		if header != "" {
+			req.Header.Set("X-Version", header)
+		}
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "aimas_split", Value: cookie})
+		}
+		w := httptest.NewRecorder()
+		gw.ServeHTTP(w, req)
+		body, _ := io.ReadAll(w.Body)
+		return string(body), w
+	}
+
+	if got, _ := get("canary", "client-1"); got != "canary" {
+		t.Errorf("override header: expected canary, got %q", got)
+	}
+
+	_, w := get("", "")
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "aimas_split" || cookies[0].Value == "" {
+		t.Fatalf("expected a sticky cookie to be issued, got %v", cookies)
+	}
+
+	counts := map[string]int{}
+	for i := 0; i < 400; i++ {
+		key := fmt.Sprintf("client-%d", i)
+		first, w := get("", key)
+		if len(w.Result().Cookies()) != 0 {
+			t.Fatalf("cookie reissued to a client that sent one")
+		}
+		if again, _ := get("", key); again != first {
+			t.Fatalf("%s moved from %s to %s", key, first, again)
+		}
+		counts[first]++
+	}
+	if counts["canary"] == 0 || counts["canary"] > 60 {
+		t.Errorf("expected about 5%% of clients on the canary, got %v", counts)
+	}
+
+	var metrics strings.Builder
+	gw.metrics.WritePrometheus(&metrics)
+	if !strings.Contains(metrics.String(), `aimas_backend_requests_total{service="orders",backend="canary"}`) {
+		t.Errorf("missing per-backend metrics:\n%s", metrics.String())
+	}
+}
+
+func TestSplit_StickyClientsOnlyMoveOntoAGrowingCanary(t *testing.T) {
+	splitterWith := func(stable, canary int) *splitter {
+		s := &splitter{service: "orders", cfg: SplitConfig{StickyCookie: "aimas_split"}, total: stable + canary}
+		s.backends = []*splitBackend{{name: "stable", weight: stable}, {name: "canary", weight: canary}}
+		return s
+	}
+	pick := func(s *splitter, key string) string {
+		req := httptest.NewRequest(http.MethodGet, "/orders/1", nil)
+		req.AddCookie(&http.Cookie{Name: "aimas_split", Value: key})
+		return s.pick(httptest.NewRecorder(), req).name
+	}
+
+	before, after := splitterWith(90, 10), splitterWith(90, 20)
+	moved := 0
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("client-%d", i)
+		was, is := pick(before, key), pick(after, key)
+		switch {
+		case was == "canary" && is != "canary":
+			t.Fatalf("%s left the canary when its weight grew", key)
+		case was != is:
+			moved++
+		}
+	}
+	// 90/10 to 90/20 moves about 8% of all clients onto the canary.
+	if moved < 80 || moved > 260 {
+		t.Errorf("expected about 160 clients to move onto the canary, got %d", moved)
+	}
+}
+
+func TestSplit_ReloadKeepsTransports(t *testing.T) {
+	stable := mockService(t, "stable", http.StatusOK)
+	canary := mockService(t, "canary", http.StatusOK)
+	load := func(stableWeight, canaryWeight int) map[string]*Service {
+		cfg, err := loadConfigFile(writeConfig(t, fmt.Sprintf(`services:
+  - name: orders
+    prefix: /orders
+    auth: none
+    backends:
+      - {name: stable, host: %s, weight: %d}
+      - {name: canary, host: %s, weight: %d}
+`, stable.URL, stableWeight, canary.URL, canaryWeight)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg.Routes
+	}
+
+	gw := setupGateway(t, load(95, 5))
+	first := gw.atomicRoutes.Load().(*routeTable).routes["/orders"]
+	second := gw.applyRoutes(load(50, 50)).routes["/orders"]
+	if first == second {
+		t.Fatal("expected the route to be rebuilt after a weight change")
+	}
+	for host, tr := range first.transports {
+		if second.transports[host] != tr {
+			t.Errorf("transport for %s was replaced on reload", host)
+		}
+	}
+}
+
+func TestValidate_Backends(t *testing.T) {
+	_, err := loadConfigFile(writeConfig(t, `services:
+  - name: orders
+    host: http://orders:8080
+    prefix: /orders
+    backends:
+      - {name: v1, host: http://orders-v1:8080, weight: 0}
+      - {name: v1, host: orders-v2, weight: -1}
+`))
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, want := range []string{"set either host or backends", `duplicate backend "v1"`, `invalid host "orders-v2"`, "must not be negative", "positive weight"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in:\n%v", want, err)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// captureWriter passes a response through to the client while keeping a
+// copy of its status, its headers and, up to limit, its body, for the
+// response cache and for coalesced requests to replay.
+type captureWriter struct {
+	http.ResponseWriter
+	header http.Header
+	limit  int64
+	// replace makes the captured headers replace those already set for
+	// the client instead of adding to them.
+	replace bool
+	// sending runs once the headers are copied for the client, just before
+	// they are sent, and returns the status to send.
+	sending func(code int) int
+	// dropped runs when the copy is given up.
+	dropped func()
+
+	wroteHeader bool
+	status      int
+	keep        bool
+	discard     bool // the client gets the headers but not the body
+	body        bytes.Buffer
+}
+
+func newCaptureWriter(w http.ResponseWriter, limit int64) *captureWriter {
+	return &captureWriter{ResponseWriter: w, header: http.Header{}, limit: limit, keep: true}
+}
+
+// drop gives up the copy, for a response that is too large or cannot be
+// replayed.
+func (c *captureWriter) drop() {
+	if c.keep {
+		c.keep = false
+		c.body = bytes.Buffer{}
+		if c.dropped != nil {
+			c.dropped()
+		}
+	}
+}
+
+func (c *captureWriter) Header() http.Header {
+	if c.wroteHeader {
+		// Trailers are set after the body.
+		return c.ResponseWriter.Header()
+	}
+	return c.header
+}
+
+func (c *captureWriter) WriteHeader(code int) {
+	if c.wroteHeader || code < 200 {
+		return
+	}
+	c.wroteHeader = true
+	c.status = code
+	h := c.ResponseWriter.Header()
+	for k, v := range c.header {
+		if c.replace {
+			h[k] = v
+		} else {
+			h[k] = append(h[k], v...)
+		}
+	}
+	if c.sending != nil {
+		code = c.sending(code)
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *captureWriter) Write(p []byte) (int, error) {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.keep {
+		if int64(c.body.Len()+len(p)) > c.limit {
+			c.drop()
+		} else {
+			c.body.Write(p)
+		}
+	}
+	if c.discard {
+		return len(p), nil
+	}
+	n, err := c.ResponseWriter.Write(p)
+	if err != nil {
+		// The client left, and the proxy will stop copying the body.
+		c.drop()
+	}
+	return n, err
+}
+
+func (c *captureWriter) Flush() {
+	_ = http.NewResponseController(c.ResponseWriter).Flush()
+}
+
+func (c *captureWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"net/textproto"
+	"sync"
+)
+
+const defaultCoalesceBodyBytes = 1 << 20
+
+// CoalesceConfig collapses identical GET and HEAD requests that arrive
+// while one of them is already on its way to the upstream: they wait for
+// that call and get a copy of its response. Responses larger than
+// MaxBodyBytes, event streams and responses that were cut short are not
+// shared; the requests that waited for them make their own calls.
+type CoalesceConfig struct {
+	Enabled      bool  `yaml:"enabled"`
+	MaxBodyBytes int64 `yaml:"max_body_bytes"`
+}
+
+// coalesceHeaders are the request headers besides the identity and the
+// cache's vary headers whose values must match for requests to share a
+// response.
+var coalesceHeaders = []string{
+	"Accept", "Accept-Encoding", "Accept-Language", "Cookie", "If-Modified-Since", "If-None-Match",
+}
+
+type coalescer struct {
+	limit  int64
+	shared bool
+	vary   []string
+	next   http.Handler
+
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+// coalescedCall is one upstream call and the response it got. ok is set
+// before done is closed when the response can be replayed.
+type coalescedCall struct {
+	done   chan struct{}
+	once   sync.Once
+	ok     bool
+	status int
+	header http.Header
+	body   []byte
+}
+
+// release wakes the waiting requests, at most once. A response is shared
+// only when it was passed on in full.
+func (call *coalescedCall) release(cw *captureWriter, complete bool) {
+	call.once.Do(func() {
+		if complete && cw.wroteHeader && cw.keep {
+			call.ok, call.status, call.header, call.body = true, cw.status, cw.header, cw.body.Bytes()
+		}
+		close(call.done)
+	})
+}
+
+// newCoalescer wraps next for a service or route with coalescing enabled.
+// Requests are keyed like cache entries: per user unless the cache is set
+// to share entries between users.
+func newCoalescer(svc *Service, next http.Handler) http.Handler {
+	cfg := svc.Coalesce
+	if !cfg.Enabled {
+		return next
+	}
+	if cfg.MaxBodyBytes == 0 {
+		cfg.MaxBodyBytes = defaultCoalesceBodyBytes
+	}
+	vary := append([]string(nil), coalesceHeaders...)
+	for _, h := range svc.Cache.Vary {
+		vary = append(vary, textproto.CanonicalMIMEHeaderKey(h))
+	}
+	return &coalescer{
+		limit:  cfg.MaxBodyBytes,
+		shared: svc.Cache.Enabled && svc.Cache.Authenticated == "shared",
+		vary:   vary,
+		next:   next,
+		calls:  map[string]*coalescedCall{},
+	}
+}
+
+func (c *coalescer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) || streamKind(r) != "" || r.Header.Get("Range") != "" {
+		c.next.ServeHTTP(w, r)
+		return
+	}
+	identity := ""
+	if !c.shared {
+		identity = cacheIdentity(r)
+	}
+	key := cacheKey(r, cacheBaseKey(r, identity), c.vary)
+
+	c.mu.Lock()
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		select {
+		case <-call.done:
+		case <-r.Context().Done():
+			return
+		}
+		if !call.ok {
+			c.next.ServeHTTP(w, r)
+			return
+		}
+		h := w.Header()
+		for k, v := range call.header {
+			h[k] = append(h[k], v...)
+		}
+		w.WriteHeader(call.status)
+		w.Write(call.body)
+		return
+	}
+	call := &coalescedCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	// The first request streams its response to its own client as usual.
+	// The others are released once it is complete, or as soon as it turns
+	// out not to be shareable, so they need not wait for a long stream.
+	cw := newCaptureWriter(w, c.limit)
+	cw.dropped = func() {
+		c.forget(key, call)
+		call.release(cw, false)
+	}
+	cw.sending = func(code int) int {
+		if unshareable(cw.header) {
+			cw.drop()
+		}
+		return code
+	}
+	complete := false
+	defer func() {
+		c.forget(key, call)
+		call.release(cw, complete)
+	}()
+	c.next.ServeHTTP(cw, r)
+	// When the first client leaves, the proxy cancels the upstream call
+	// and writes a gateway error that says nothing about the upstream.
+	complete = r.Context().Err() == nil
+}
+
+func (c *coalescer) forget(key string, call *coalescedCall) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.calls[key] == call {
+		delete(c.calls, key)
+	}
+}
+
+// unshareable reports whether a response cannot be replayed to other
+// clients: it has trailers, sets a cookie or is an event stream.
+func unshareable(h http.Header) bool {
+	mt, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	return h.Get("Trailer") != "" || h.Get("Set-Cookie") != "" || mt == "text/event-stream"
+}
+
+func validateCoalesce(c *configIssues, cfg CoalesceConfig, path []interface{}) {
+	if cfg.MaxBodyBytes < 0 {
+		c.addf(appendPath(path, "max_body_bytes"), "must not be negative, got %d", cfg.MaxBodyBytes)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// popularRoute is the fragment of a service with coalescing on its
+// /recs/popular route.
+func popularRoute(auth, coalesce string) string {
+	return fmt.Sprintf("auth: %s\nroutes:\n  - path: /recs/popular\n    methods: [GET]\n    coalesce: %s", auth, coalesce)
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCoalesce_ConcurrentRequestsShareOneCallPerUser(t *testing.T) {
+	var calls atomic.Int64
+	release := make(chan struct{})
+	gw := serviceGateway(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		<-release
+		fmt.Fprintf(w, "popular for %s", r.Header.Get("X-User-ID"))
+	}), popularRoute("jwt", "{enabled: true}"))
+	tokens := map[string]string{
+		"ada": signedToken(t, jwt.MapClaims{"user_id": "ada", "exp": time.Now().Add(time.Hour).Unix()}),
+		"bob": signedToken(t, jwt.MapClaims{"user_id": "bob", "exp": time.Now().Add(time.Hour).Unix()}),
+	}
+
+	var wg sync.WaitGroup
+	results := make([]*httptest.ResponseRecorder, 12)
+	users := make([]string, len(results))
+	for i := range results {
+		users[i] = "ada"
+		if i%4 == 3 {
+			users[i] = "bob"
+		}
+		results[i] = httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/recs/popular", nil)
+		req.Header.Set("Authorization", "Bearer "+tokens[users[i]])
+		wg.Add(1)
+		go func(w *httptest.ResponseRecorder, req *http.Request) {
+			defer wg.Done()
+			gw.ServeHTTP(w, req)
+		}(results[i], req)
+	}
+	waitFor(t, "one call per user", func() bool { return calls.Load() == 2 })
+	time.Sleep(50 * time.Millisecond) // let the rest queue behind them
+	close(release)
+	wg.Wait()
+
+	if n := calls.Load(); n != 2 {
+		t.Errorf("expected one upstream call per user, got %d", n)
+	}
+	for i, w := range results {
+		if want := "popular for " + users[i]; w.Code != http.StatusOK || w.Body.String() != want {
+			t.Errorf("request %d: expected %q, got %d %q", i, want, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestCoalesce_StreamedResponsesAreNotShared(t *testing.T) {
+	var calls atomic.Int64
+	start, finish := make(chan struct{}), make(chan struct{})
+	gw := serviceGateway(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		<-start
+		fmt.Fprint(w, strings.Repeat("x", 100))
+		w.(http.Flusher).Flush()
+		<-finish
+		fmt.Fprint(w, "end")
+	}), popularRoute("none", "{enabled: true, max_body_bytes: 10}"))
+
+	var wg sync.WaitGroup
+	results := []*httptest.ResponseRecorder{httptest.NewRecorder(), httptest.NewRecorder()}
+	serve := func(w *httptest.ResponseRecorder) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			gw.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/recs/popular", nil))
+		}()
+	}
+	serve(results[0])
+	waitFor(t, "the first call", func() bool { return calls.Load() == 1 })
+	serve(results[1])
+	time.Sleep(50 * time.Millisecond)
+	close(start)
+	// The waiting request gives up on sharing as soon as the body outgrows
+	// max_body_bytes, without waiting for the stream to end.
+	waitFor(t, "the waiting request's own call", func() bool { return calls.Load() == 2 })
+	close(finish)
+	wg.Wait()
+	for i, w := range results {
+		if w.Body.Len() != 103 {
+			t.Errorf("request %d: expected the full body, got %d bytes", i, w.Body.Len())
+		}
+	}
+}
+
+func TestCoalesce_CanceledLeaderIsNotShared(t *testing.T) {
+	var calls atomic.Int64
+	release := make(chan struct{})
+	gw := serviceGateway(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		select {
+		case <-release:
+			fmt.Fprint(w, "popular")
+		case <-r.Context().Done():
+		}
+	}), popularRoute("none", "{enabled: true}"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := make(chan struct{})
+	go func() {
+		defer close(leader)
+		gw.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/recs/popular", nil).WithContext(ctx))
+	}()
+	waitFor(t, "the first call", func() bool { return calls.Load() == 1 })
+
+	waiter := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		gw.ServeHTTP(waiter, httptest.NewRequest(http.MethodGet, "/recs/popular", nil))
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-leader
+	waitFor(t, "the waiting request's own call", func() bool { return calls.Load() == 2 })
+	close(release)
+	<-done
+	if waiter.Code != http.StatusOK || waiter.Body.String() != "popular" {
+		t.Errorf("the waiting request should not get the canceled call's error, got %d %q", waiter.Code, waiter.Body.String())
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+const defaultCompressMinBytes = 1024
+
+// CompressionConfig compresses a service's responses for clients that
+// accept it. Encodings are offered in order of preference when the client
+// accepts several equally; Level is fastest, default or best for all of
+// them. Responses are compressed when their type matches ContentTypes
+// (entries such as text/* or application/*+json) and they are at least
+// MinBytes long.
+type CompressionConfig struct {
+	Enabled      bool     `yaml:"enabled"`
+	Encodings    []string `yaml:"encodings"`
+	Level        string   `yaml:"level"`
+	MinBytes     int      `yaml:"min_bytes"`
+	ContentTypes []string `yaml:"content_types"`
+	// DecompressRequests inflates gzip request bodies for upstreams that
+	// cannot.
+	DecompressRequests bool `yaml:"decompress_requests"`
+}
+
+var (
+	defaultEncodings    = []string{"br", "zstd", "gzip"}
+	defaultCompressible = []string{
+		"text/*", "application/json", "application/*+json", "application/x-ndjson", "application/javascript",
+		"application/xml", "application/*+xml", "image/svg+xml",
+	}
+)
+
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+var newEncoder = map[string]func(level string) encoder{
+	"gzip": func(level string) encoder {
+		l := gzip.DefaultCompression
+		switch level {
+		case "fastest":
+			l = gzip.BestSpeed
+		case "best":
+			l = gzip.BestCompression
+		}
+		w, _ := gzip.NewWriterLevel(io.Discard, l)
+		return w
+	},
+	"br": func(level string) encoder {
+		// Quality 5 rather than the library default of 6 is the usual
+		// trade-off for compressing on the fly.
+		l := 5
+		switch level {
+		case "fastest":
+			l = 1
+		case "best":
+			l = brotli.BestCompression
+		}
+		return brotli.NewWriterLevel(io.Discard, l)
+	},
+	"zstd": func(level string) encoder {
+		l := zstd.SpeedDefault
+		switch level {
+		case "fastest":
+			l = zstd.SpeedFastest
+		case "best":
+			l = zstd.SpeedBestCompression
+		}
+		// Browsers decode windows of up to 8 MiB.
+		w, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(l), zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(4<<20))
+		return w
+	},
+}
+
+// encoderPools keeps idle encoders by encoding and level, shared by all
+// services.
+var encoderPools sync.Map
+
+func encoderPool(encoding, level string) *sync.Pool {
+	key := encoding + " " + level
+	if p, ok := encoderPools.Load(key); ok {
+		return p.(*sync.Pool)
+	}
+	p, _ := encoderPools.LoadOrStore(key, &sync.Pool{New: func() any { return newEncoder[encoding](level) }})
+	return p.(*sync.Pool)
+}
+
+type compressor struct {
+	cfg  CompressionConfig
+	next http.Handler
+}
+
+func newCompressor(svc *Service, next http.Handler) http.Handler {
+	cfg := svc.Compression
+	if !cfg.Enabled && !cfg.DecompressRequests {
+		return next
+	}
+	if cfg.Encodings == nil {
+		cfg.Encodings = defaultEncodings
+	}
+	if cfg.Level == "" {
+		cfg.Level = "default"
+	}
+	if cfg.MinBytes == 0 {
+		cfg.MinBytes = defaultCompressMinBytes
+	}
+	if cfg.ContentTypes == nil {
+		cfg.ContentTypes = defaultCompressible
+	}
+	return &compressor{cfg: cfg, next: next}
+}
+
+func (c *compressor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if c.cfg.DecompressRequests && r.Body != nil && strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			JSONBadResponse(w, "invalid request body", http.StatusBadRequest, "body is not valid gzip")
+			return
+		}
+		defer zr.Close()
+		r.Body = readCloser{zr, r.Body}
+		r.ContentLength = -1
+		r.Header.Del("Content-Encoding")
+		r.Header.Del("Content-Length")
+	}
+	if !c.cfg.Enabled || requestedStream(r) == "upgrade" {
+		c.next.ServeHTTP(w, r)
+		return
+	}
+	cw := &compressWriter{ResponseWriter: w, c: c, encoding: c.negotiate(r.Header.Get("Accept-Encoding")), head: r.Method == http.MethodHead}
+	c.next.ServeHTTP(cw, r)
+	cw.close()
+}
+
+// negotiate picks the configured encoding the client prefers, by q-value
+// and then by the configured order, or "" to send the response as is.
+func (c *compressor) negotiate(accept string) string {
+	if accept == "" {
+		return ""
+	}
+	weights := map[string]float64{}
+	star := 0.0
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		if name == "*" {
+			star = q
+			continue
+		}
+		weights[name] = q
+	}
+	best, bestQ := "", 0.0
+	for _, e := range c.cfg.Encodings {
+		q, ok := weights[e]
+		if !ok {
+			q = star
+		}
+		if q > bestQ {
+			best, bestQ = e, q
+		}
+	}
+	return best
+}
+
+// typeCompressible reports whether a Content-Type is one the service
+// compresses. Event streams never are.
+func (c *compressor) typeCompressible(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mt == "text/event-stream" {
+		return false
+	}
+	for _, pattern := range c.cfg.ContentTypes {
+		prefix, suffix, wildcard := strings.Cut(pattern, "*")
+		if !wildcard && mt == pattern ||
+			wildcard && len(mt) >= len(prefix)+len(suffix) && strings.HasPrefix(mt, prefix) && strings.HasSuffix(mt, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	compressUndecided = iota
+	compressPassthrough
+	compressEncoding
+)
+
+// compressWriter compresses a response as it is written. Until MinBytes
+// have been written or the handler flushes, the start of the body is held
+// back to decide; after that every write goes straight to the encoder.
+type compressWriter struct {
+	http.ResponseWriter
+	c        *compressor
+	encoding string
+	head     bool
+
+	wroteHeader bool
+	status      int
+	state       int
+	buf         []byte
+	enc         encoder
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.wroteHeader {
+		return
+	}
+	if code < 200 {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	cw.wroteHeader = true
+	cw.status = code
+	h := cw.Header()
+	ct := h.Get("Content-Type")
+	switch {
+	case !cw.eligible(), ct != "" && !cw.c.typeCompressible(ct):
+		cw.passthrough()
+	case ct == "":
+		// Decided once the first bytes show the type.
+	case cw.encoding == "", cw.head:
+		cw.passthrough()
+	default:
+		if cl, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); err == nil {
+			if cl < int64(cw.c.cfg.MinBytes) {
+				cw.passthrough()
+			} else {
+				cw.start()
+			}
+		}
+	}
+}
+
+// eligible reports whether the response may be compressed, whatever its
+// type and length.
+func (cw *compressWriter) eligible() bool {
+	h := cw.Header()
+	switch cw.status {
+	case http.StatusNoContent, http.StatusNotModified, http.StatusPartialContent:
+		return false
+	}
+	if ce := h.Get("Content-Encoding"); ce != "" && !strings.EqualFold(ce, "identity") {
+		return false
+	}
+	return !headerHasToken(h, "Cache-Control", "no-transform")
+}
+
+// decide settles an undecided response with the body held back so far.
+// final is set when the handler has returned.
+func (cw *compressWriter) decide(final bool) {
+	h := cw.Header()
+	if h.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		// Set it now, as the server would sniff the compressed bytes.
+		h.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+	switch {
+	case !cw.c.typeCompressible(h.Get("Content-Type")), cw.encoding == "", cw.head:
+		cw.passthrough()
+	case final && len(cw.buf) < cw.c.cfg.MinBytes:
+		if h.Get("Content-Length") == "" {
+			h.Set("Content-Length", strconv.Itoa(len(cw.buf)))
+		}
+		cw.passthrough()
+	default:
+		cw.start()
+	}
+}
+
+func (cw *compressWriter) varyAccept() {
+	h := cw.Header()
+	if !headerHasToken(h, "Vary", "Accept-Encoding") && !headerHasToken(h, "Vary", "*") {
+		h.Add("Vary", "Accept-Encoding")
+	}
+}
+
+func (cw *compressWriter) passthrough() {
+	cw.state = compressPassthrough
+	if cw.eligible() && cw.c.typeCompressible(cw.Header().Get("Content-Type")) {
+		cw.varyAccept()
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+	if len(cw.buf) > 0 {
+		cw.ResponseWriter.Write(cw.buf)
+		cw.buf = nil
+	}
+}
+
+func (cw *compressWriter) start() {
+	cw.state = compressEncoding
+	h := cw.Header()
+	cw.varyAccept()
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", cw.encoding)
+	// The compressed body is a different representation of the resource.
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+	cw.enc = encoderPool(cw.encoding, cw.c.cfg.Level).Get().(encoder)
+	cw.enc.Reset(cw.ResponseWriter)
+	if len(cw.buf) > 0 {
+		cw.enc.Write(cw.buf)
+		cw.buf = nil
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	switch cw.state {
+	case compressPassthrough:
+		return cw.ResponseWriter.Write(p)
+	case compressEncoding:
+		return cw.enc.Write(p)
+	}
+	cw.buf = append(cw.buf, p...)
+	if len(cw.buf) >= cw.c.cfg.MinBytes {
+		cw.decide(false)
+	}
+	return len(p), nil
+}
+
+// Flush sends what has been written so far; a streamed response is
+// compressed from its first flush on.
+func (cw *compressWriter) Flush() {
+	if cw.wroteHeader && cw.state == compressUndecided {
+		cw.decide(false)
+	}
+	if cw.state == compressEncoding {
+		cw.enc.Flush()
+	}
+	_ = http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// close finishes the body once the handler has returned.
+func (cw *compressWriter) close() {
+	switch {
+	case !cw.wroteHeader:
+	case cw.state == compressUndecided:
+		cw.decide(true)
+		if cw.state == compressEncoding {
+			cw.close()
+		}
+	case cw.state == compressEncoding:
+		cw.enc.Close()
+		cw.enc.Reset(io.Discard)
+		encoderPool(cw.encoding, cw.c.cfg.Level).Put(cw.enc)
+		cw.enc = nil
+	}
+}
+
+func validateCompression(c *configIssues, cfg CompressionConfig, path []interface{}) {
+	seen := map[string]bool{}
+	for i, e := range cfg.Encodings {
+		switch {
+		case newEncoder[e] == nil:
+			c.addf(appendPath(appendPath(path, "encodings"), i), "unknown encoding %q, expected br, zstd or gzip", e)
+		case seen[e]:
+			c.addf(appendPath(appendPath(path, "encodings"), i), "duplicate encoding %q", e)
+		}
+		seen[e] = true
+	}
+	switch cfg.Level {
+	case "", "fastest", "default", "best":
+	default:
+		c.addf(appendPath(path, "level"), "unknown level %q, expected fastest, default or best", cfg.Level)
+	}
+	if cfg.MinBytes < 0 {
+		c.addf(appendPath(path, "min_bytes"), "must not be negative, got %d", cfg.MinBytes)
+	}
+	for i, t := range cfg.ContentTypes {
+		if !strings.Contains(t, "/") {
+			c.addf(appendPath(appendPath(path, "content_types"), i), "invalid content type %q", t)
+		}
+	}
+}
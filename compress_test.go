@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+func decodeBody(t *testing.T, encoding string, body []byte) string {
+	t.Helper()
+	var r io.Reader = bytes.NewReader(body)
+	switch encoding {
+	case "gzip":
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = zr
+	case "br":
+		r = brotli.NewReader(r)
+	case "zstd":
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("decoding %s: %v", encoding, err)
+	}
+	return string(out)
+}
+
+func TestCompression_NegotiatesEncodingsAndSkipsIneligibleResponses(t *testing.T) {
+	big := `{"items":[` + strings.Repeat(`{"id":"book","score":4.5},`, 200) + `{}]}`
+	gw := serviceGateway(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/recs/big":
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("ETag", `"v1"`)
+			fmt.Fprint(w, big)
+		case "/recs/small":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"items":[]}`)
+		case "/recs/image":
+			w.Header().Set("Content-Type", "image/png")
+			fmt.Fprint(w, big)
+		case "/recs/encoded":
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Encoding", "gzip")
+			fmt.Fprint(w, "already gzip")
+		}
+	}), "auth: none\ncompression: {enabled: true}")
+
+	cases := []struct {
+		path, accept, encoding string
+		vary                   bool
+	}{
+		{"/recs/big", "gzip, br;q=0.9", "gzip", true},
+		{"/recs/big", "br", "br", true},
+		{"/recs/big", "zstd, gzip;q=0.5", "zstd", true},
+		{"/recs/big", "gzip;q=0, *", "br", true},
+		{"/recs/big", "", "", true},
+		{"/recs/small", "gzip", "", true},
+		{"/recs/image", "gzip", "", false},
+		{"/recs/encoded", "br", "gzip", false},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, c.path, nil)
+		if c.accept != "" {
+			req.Header.Set("Accept-Encoding", c.accept)
+		}
+		w := httptest.NewRecorder()
+		gw.ServeHTTP(w, req)
+		name := c.path + " " + c.accept
+		if got := w.Header().Get("Content-Encoding"); got != c.encoding {
+			t.Errorf("%s: expected encoding %q, got %q", name, c.encoding, got)
+			continue
+		}
+		if vary := headerHasToken(w.Header(), "Vary", "Accept-Encoding"); vary != c.vary {
+			t.Errorf("%s: expected Vary: Accept-Encoding %v, got %q", name, c.vary, w.Header().Values("Vary"))
+		}
+		if c.path != "/recs/big" {
+			continue
+		}
+		if body := decodeBody(t, c.encoding, w.Body.Bytes()); body != big {
+			t.Errorf("%s: body did not round-trip (%d bytes)", name, len(body))
+		}
+		if c.encoding != "" {
+			if w.Header().Get("Content-Length") != "" || w.Header().Get("ETag") != `W/"v1"` {
+				t.Errorf("%s: expected no Content-Length and a weak ETag, got %q %q", name, w.Header().Get("Content-Length"), w.Header().Get("ETag"))
+			}
+			if w.Body.Len() >= len(big) {
+				t.Errorf("%s: %d bytes is not smaller than %d", name, w.Body.Len(), len(big))
+			}
+		}
+	}
+}
+
+func TestCompression_StreamsFlushedChunks(t *testing.T) {
+	release := make(chan struct{})
+	gw := serviceGateway(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, "first chunk\n")
+		w.(http.Flusher).Flush()
+		<-release
+		fmt.Fprint(w, "second chunk\n")
+	}), "auth: none\ncompression: {enabled: true, encodings: [gzip], level: fastest}")
+	srv := httptest.NewServer(gw)
+	t.Cleanup(srv.Close)
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/recs/feed", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := (&http.Client{Transport: &http.Transport{DisableCompression: true}}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected a gzip stream, got %q", resp.Header.Get("Content-Encoding"))
+	}
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first chunk arrives while the upstream is still holding the rest.
+	first := make([]byte, len("first chunk\n"))
+	if _, err := io.ReadFull(zr, first); err != nil || string(first) != "first chunk\n" {
+		t.Fatalf("first chunk: %q, %v", first, err)
+	}
+	close(release)
+	rest, err := io.ReadAll(zr)
+	if err != nil || string(rest) != "second chunk\n" {
+		t.Errorf("rest: %q, %v", rest, err)
+	}
+}
+
+func TestCompression_RequestBodiesAndValidation(t *testing.T) {
+	gw := serviceGateway(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s|%s", r.Header.Get("Content-Encoding"), body)
+	}), "auth: none\ncompression: {decompress_requests: true}")
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(`{"rating":5}`))
+	zw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/recs/ratings", &buf)
+	req.Header.Set("Content-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	gw.ServeHTTP(w, req)
+	if w.Body.String() != `|{"rating":5}` {
+		t.Errorf("expected the inflated body, got %q", w.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/recs/ratings", strings.NewReader("not gzip"))
+	req.Header.Set("Content-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	gw.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a corrupt gzip body, got %d", w.Code)
+	}
+
+	_, err := loadConfigFile(writeConfig(t, `services:
+  - name: recs
+    host: http://recs:8080
+    prefix: /recs
+    compression:
+      enabled: true
+      encodings: [br, deflate, br]
+      level: max
+      content_types: [json]
+`))
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, want := range []string{`unknown encoding "deflate"`, `duplicate encoding "br"`, `unknown level "max"`, `invalid content type "json"`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in:\n%v", want, err)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type ConcurrencyLimit struct {
+	MaxInFlight  int           `yaml:"max_in_flight"`
+	QueueSize    int           `yaml:"queue_size"`
+	QueueTimeout time.Duration `yaml:"queue_timeout"`
+	Adaptive     AdaptiveLimit `yaml:"adaptive"`
+}
+
+// AdaptiveLimit moves the in-flight limit between MinLimit and MaxLimit
+// based on observed upstream latency. Mode is "aimd" or "gradient".
+type AdaptiveLimit struct {
+	Mode          string        `yaml:"mode"`
+	MinLimit      int           `yaml:"min_limit"`
+	MaxLimit      int           `yaml:"max_limit"`
+	LatencyTarget time.Duration `yaml:"latency_target"`
+	BackoffRatio  float64       `yaml:"backoff_ratio"`
+}
+
+func (c ConcurrencyLimit) enabled() bool {
+	return c.MaxInFlight > 0 || c.Adaptive.Mode != ""
+}
+
+type concurrencyLimiter struct {
+	cfg        ConcurrencyLimit
+	configured ConcurrencyLimit
+
+	mu       sync.Mutex
+	limit    float64
+	inFlight int
+	waiters  []chan struct{}
+
+	minRTT      time.Duration
+	minRTTReset time.Time
+}
+
+func newConcurrencyLimiter(cfg ConcurrencyLimit) *concurrencyLimiter {
+	a := &cfg.Adaptive
+	configured := cfg
+	if cfg.MaxInFlight <= 0 {
+		cfg.MaxInFlight = 100
+	}
+	if cfg.QueueSize > 0 && cfg.QueueTimeout <= 0 {
+		cfg.QueueTimeout = time.Second
+	}
+	if a.Mode != "" {
+		if a.MinLimit <= 0 {
+			a.MinLimit = 1
+		}
+		if a.MaxLimit <= 0 {
+			a.MaxLimit = cfg.MaxInFlight * 4
+		}
+		if a.LatencyTarget <= 0 {
+			a.LatencyTarget = time.Second
+		}
+		if a.BackoffRatio <= 0 || a.BackoffRatio >= 1 {
+			a.BackoffRatio = 0.9
+		}
+	}
+	return &concurrencyLimiter{cfg: cfg, configured: configured, limit: float64(cfg.MaxInFlight)}
+}
+
+func (l *concurrencyLimiter) currentLimit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.limit)
+}
+
+// acquire reserves an in-flight slot, waiting in the bounded queue when the
+// limit is reached. It returns false when the request should be shed.
+func (l *concurrencyLimiter) acquire(ctx context.Context) bool {
+	l.mu.Lock()
+	if l.inFlight < int(l.limit) && len(l.waiters) == 0 {
+		l.inFlight++
+		l.mu.Unlock()
+		return true
+	}
+	if len(l.waiters) >= l.cfg.QueueSize {
+		l.mu.Unlock()
+		return false
+	}
+	ch := make(chan struct{})
+	l.waiters = append(l.waiters, ch)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.cfg.QueueTimeout)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, w := range l.waiters {
+		if w == ch {
+			l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+			return false
+		}
+	}
+	// Granted between the timeout firing and taking the lock; hand the slot
+	// straight to the next waiter instead of leaking it.
+	l.inFlight--
+	l.admitLocked()
+	return false
+}
+
+func (l *concurrencyLimiter) release(latency time.Duration, failed bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+	l.observeLocked(latency, failed)
+	l.admitLocked()
+}
+
+func (l *concurrencyLimiter) admitLocked() {
+	for len(l.waiters) > 0 && l.inFlight < int(l.limit) {
+		ch := l.waiters[0]
+		l.waiters = l.waiters[1:]
+		l.inFlight++
+		close(ch)
+	}
+}
+
+func (l *concurrencyLimiter) observeLocked(latency time.Duration, failed bool) {
+	a := l.cfg.Adaptive
+	switch a.Mode {
+	case "aimd":
+		if failed || latency > a.LatencyTarget {
+			l.limit *= a.BackoffRatio
+		} else {
+			l.limit += 1 / l.limit
+		}
+	case "gradient":
+		now := time.Now()
+		if l.minRTT == 0 || latency < l.minRTT || now.After(l.minRTTReset) {
+			l.minRTT = latency
+			l.minRTTReset = now.Add(30 * time.Second)
+		}
+		if failed {
+			l.limit *= a.BackoffRatio
+			break
+		}
+		gradient := math.Max(0.5, math.Min(1, float64(l.minRTT)/float64(latency)))
+		if latency > a.LatencyTarget {
+			gradient = math.Min(gradient, float64(a.LatencyTarget)/float64(latency))
+		}
+		next := l.limit*gradient + math.Sqrt(l.limit)
+		// Smooth so one slow response doesn't halve the limit.
+		l.limit = l.limit*0.8 + next*0.2
+	default:
+		return
+	}
+	l.limit = math.Max(float64(a.MinLimit), math.Min(float64(a.MaxLimit), l.limit))
+}
+
+type ConcurrencyManager struct {
+	mu       sync.Mutex
+	limiters map[string]*concurrencyLimiter
+}
+
+func NewConcurrencyManager() *ConcurrencyManager {
+	return &ConcurrencyManager{limiters: make(map[string]*concurrencyLimiter)}
+}
+
+// get returns the limiter for a service, replacing it when the service's
+// concurrency settings changed. Requests already holding a slot on the old
+// limiter release it there.
+func (c *ConcurrencyManager) get(serviceName string, cfg ConcurrencyLimit) *concurrencyLimiter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	l, ok := c.limiters[serviceName]
+	if !ok || l.configured != cfg {
+		l = newConcurrencyLimiter(cfg)
+		c.limiters[serviceName] = l
+	}
+	return l
+}
+
+func (c *ConcurrencyManager) retain(keep map[string]*Service) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	names := make(map[string]bool, len(keep))
+	for _, svc := range keep {
+		names[svc.Name] = true
+	}
+	for name := range c.limiters {
+		if !names[name] {
+			delete(c.limiters, name)
+		}
+	}
+}
+
+func (c *ConcurrencyManager) Middleware(serviceName string, cfg ConcurrencyLimit) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if !cfg.enabled() {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			// Streams would hold a slot for their whole life and skew the
+			// latency the adaptive limit is based on; they have their own
+			// cap in StreamConfig.
+			if streamKind(req) != "" {
+				next.ServeHTTP(w, req)
+				return
+			}
+			limiter := c.get(serviceName, cfg)
+			if !limiter.acquire(req.Context()) {
+				w.Header().Set("Retry-After", "1")
+				w.Header().Set("X-Concurrency-Limit", strconv.Itoa(limiter.currentLimit()))
+				JSONBadResponse(w, "service overloaded", http.StatusServiceUnavailable,
+					"too many in-flight requests for "+serviceName)
+				return
+			}
+			start := time.Now()
+			sw := &statusWriter{ResponseWriter: w}
+			defer func() {
+				limiter.release(time.Since(start), sw.status >= 500)
+			}()
+			next.ServeHTTP(sw, req)
+		})
+	}
+}
+
+// statusWriter records the response status while keeping the underlying
+// writer reachable for flushing and hijacking via http.ResponseController.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusWriter) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusWriter) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(p)
+	s.bytes += int64(n)
+	return n, err
+}
+
+func (s *statusWriter) Flush() {
+	_ = http.NewResponseController(s.ResponseWriter).Flush()
+}
+
+func (s *statusWriter) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
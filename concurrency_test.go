@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConcurrency_ShedsWhenQueueFull(t *testing.T) {
+	cm := NewConcurrencyManager()
+	release := make(chan struct{})
+	entered := make(chan struct{})
+	h := cm.Middleware("rec", ConcurrencyLimit{MaxInFlight: 1})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+	}))
+
+	go h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/rec", nil))
+	<-entered
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/rec", nil))
+	close(release)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", w.Code)
+	}
+}
+
+func TestConcurrency_QueuedRequestIsAdmitted(t *testing.T) {
+	l := newConcurrencyLimiter(ConcurrencyLimit{MaxInFlight: 1, QueueSize: 1, QueueTimeout: time.Second})
+	if !l.acquire(context.Background()) {
+		t.Fatal("first acquire should succeed")
+	}
+	done := make(chan bool)
+	go func() { done <- l.acquire(context.Background()) }()
+	time.Sleep(20 * time.Millisecond)
+	l.release(time.Millisecond, false)
+	if !<-done {
+		t.Fatal("queued request should be admitted after release")
+	}
+}
+
+func TestConcurrency_AIMDBacksOffOnSlowResponses(t *testing.T) {
+	l := newConcurrencyLimiter(ConcurrencyLimit{
+		MaxInFlight: 50,
+		Adaptive:    AdaptiveLimit{Mode: "aimd", MinLimit: 5, LatencyTarget: 100 * time.Millisecond},
+	})
+	for i := 0; i < 30; i++ {
+		l.acquire(context.Background())
+		l.release(time.Second, false)
+	}
+	if got := l.currentLimit(); got >= 50 || got < 5 {
+		t.Fatalf("expected limit to shrink towards min, got %d", got)
+	}
+}
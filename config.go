@@ -6,15 +6,38 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
-	"github.com/stretchr/testify/assert/yaml"
+	"gopkg.in/yaml.v3"
 )
 
 type ServiceConfigFile struct {
-	Services []Service `yaml:"services"`
+	Defaults       Service        `yaml:"defaults"`
+	Services       []Service      `yaml:"services"`
+	Quotas         QuotaConfig    `yaml:"quotas"`
+	TrustedProxies []string       `yaml:"trusted_proxies"`
+	IPFilter       IPFilterConfig `yaml:"ip_filter"`
+	Reload         ReloadConfig   `yaml:"reload"`
+	Include        []string       `yaml:"include"`
+
+	// Routes holds the services by routeKey.
+	Routes  map[string]*Service `yaml:"-"`
+	network *networkPolicy
+	// document is the merged configuration before defaults were applied.
+	document *yaml.Node
+}
+
+// liveConfig is the configuration document behind the current generation,
+// kept so admin changes can be applied on top of it.
+type liveConfig struct {
+	path       string
+	source     configSource
+	cfg        *ServiceConfigFile
+	generation uint64
+	loadedAt   time.Time
 }
 
 type RateLimit struct {
@@ -22,69 +45,193 @@ type RateLimit struct {
 }
 
 type Service struct {
-	Name       string    `yaml:"name"`
-	Host       string    `yaml:"host"`
-	Prefix     string    `yaml:"prefix"`
-	RateLimit  RateLimit `yaml:"rate_limit"`
-	StripPefix bool      `yaml:"strip_prefix"`
-	URL        *url.URL  `yaml:"-"`
+	Name        string           `yaml:"name"`
+	Host        string           `yaml:"host"`
+	Prefix      string           `yaml:"prefix"`
+	RateLimit   RateLimit        `yaml:"rate_limit"`
+	StripPefix  bool             `yaml:"strip_prefix"`
+	Concurrency ConcurrencyLimit `yaml:"concurrency"`
+	IPFilter    IPFilterConfig   `yaml:"ip_filter"`
+	Middlewares []string         `yaml:"middlewares"`
+	Maintenance bool             `yaml:"maintenance"`
+	Timeout     time.Duration    `yaml:"timeout"`
+	Auth        string           `yaml:"auth"`
+	CORS        CORSConfig       `yaml:"cors"`
+	Retries     RetryConfig      `yaml:"retries"`
+
+	Rewrite         []RewriteRule     `yaml:"rewrite"`
+	Routes          []ServiceRoute    `yaml:"routes"`
+	Unmatched       string            `yaml:"unmatched"`
+	Match           MatchConfig       `yaml:"match"`
+	RequestHeaders  HeaderRules       `yaml:"request_headers"`
+	ResponseHeaders HeaderRules       `yaml:"response_headers"`
+	Backends        []Backend         `yaml:"backends"`
+	Split           SplitConfig       `yaml:"split"`
+	Mirror          MirrorConfig      `yaml:"mirror"`
+	Streams         StreamConfig      `yaml:"streams"`
+	Protocol        string            `yaml:"protocol"`
+	Transcode       TranscodeConfig   `yaml:"transcode"`
+	Cache           CacheConfig       `yaml:"cache"`
+	Coalesce        CoalesceConfig    `yaml:"coalesce"`
+	Compression     CompressionConfig `yaml:"compression"`
+	MaxBodyBytes    int64             `yaml:"max_body_bytes"`
+
+	URL *url.URL `yaml:"-"`
+
+	ipFilter     *ipFilter
+	transcoder   *transcoder
+	rateLimitKey string
+	order        int
+	// rawFields holds the fields set through ${...} references as they
+	// were written, so the admin API does not show the resolved secrets.
+	rawFields map[string]string
 }
 
-func loadConfigFile(path string) (map[string]*Service, error) {
-	data, err := os.ReadFile(path)
+// limitKey names the rate limit buckets of the service, or of a route
+// with its own rate limit.
+func (svc *Service) limitKey() string {
+	if svc.rateLimitKey != "" {
+		return svc.rateLimitKey
+	}
+	return svc.Name
+}
+
+func loadConfigFile(path string) (*ServiceConfigFile, error) {
+	src, err := readConfigSource(path)
 	if err != nil {
 		return nil, err
 	}
+	return parseConfig(src)
+}
+
+// parseConfig decodes and validates a configuration. Every problem found,
+// in any of its files, is returned together as a ValidationError.
+func parseConfig(src configSource) (*ServiceConfigFile, error) {
+	issues := &configIssues{file: src.root, origins: map[*yaml.Node]string{}, interpolated: map[*yaml.Node]string{}}
+	docs := make([]*yaml.Node, 0, len(src.files))
+	parsed := true
+	for _, f := range src.files {
+		root := &yaml.Node{}
+		if err := yaml.Unmarshal(f.data, root); err != nil {
+			issues.errs = append(issues.errs, yamlErrors(f.path, err)...)
+			parsed = false
+			continue
+		}
+		fileIssues := &configIssues{file: f.path, root: root, interpolated: issues.interpolated}
+		if !interpolateNode(fileIssues, root) {
+			parsed = false
+		}
+		checkKnownFields(fileIssues, root, reflect.TypeOf(ServiceConfigFile{}), nil)
+		// Decode each file on its own so type errors carry its name and lines.
+		var probe ServiceConfigFile
+		if len(root.Content) > 0 {
+			if err := root.Decode(&probe); err != nil {
+				fileIssues.errs = append(fileIssues.errs, yamlErrors(f.path, err)...)
+			}
+		}
+		issues.errs = append(issues.errs, fileIssues.errs...)
+		docs = append(docs, root)
+	}
+
+	if len(src.files) == 1 && len(docs) == 1 {
+		issues.file, issues.root = src.files[0].path, docs[0]
+	} else if parsed {
+		issues.root = mergeDocuments(issues, src, docs)
+	}
+
+	document := issues.root
+	if parsed && issues.root != nil {
+		issues.root = applyDefaults(issues, issues.root)
+	}
+
 	var scf ServiceConfigFile
-	if err := yaml.Unmarshal(data, &scf); err != nil {
+	if issues.root != nil && len(issues.root.Content) > 0 {
+		_ = issues.root.Decode(&scf)
+	}
+	if parsed {
+		validateSemantics(issues, &scf)
+	}
+	if err := issues.err(); err != nil {
 		return nil, err
 	}
 
 	out := make(map[string]*Service)
-	for _, svc := range scf.Services {
-		if svc.Prefix == "" {
-			svc.Prefix = "/" + strings.TrimPrefix(svc.Name, "/")
-		}
-		p := "/" + strings.Trim(strings.TrimSpace(svc.Prefix), "/")
-		svc.Prefix = p
-
-		u, err := url.Parse(svc.Host)
-		if err != nil || u.Scheme == "" || u.Host == "" {
-			return nil, fmt.Errorf("invalid host for service %s: %s", svc.Name, svc.Host)
+	nodes := lookupNode(issues.root, "services")
+	for i, svc := range scf.Services {
+		svc.order = i
+		if nodes != nil && nodes.Kind == yaml.SequenceNode && i < len(nodes.Content) {
+			svc.rawFields = map[string]string{}
+			interpolatedFields(issues, nodes.Content[i], "", svc.rawFields)
 		}
-		svc.URL = u
-
-		if _, ok := out[p]; ok {
-			return nil, fmt.Errorf("duplicate service prefix: %s", p)
+		svc.Prefix = normalizePrefix(svc)
+		applyBuiltinDefaults(&svc)
+		svc.URL, _ = url.Parse(svc.Host)
+		if len(svc.Backends) > 0 {
+			svc.URL, _ = url.Parse(svc.Backends[0].Host)
 		}
+		svc.ipFilter, _ = compileIPFilter(svc.IPFilter)
 		s := svc
-		out[p] = &s
+		out[routeKey(&s)] = &s
+	}
+
+	trusted := scf.TrustedProxies
+	if trusted == nil {
+		trusted = defaultTrustedProxies
 	}
+	network := &networkPolicy{}
+	network.trusted, _ = parseCIDRs(trusted)
+	network.filter, _ = compileIPFilter(scf.IPFilter)
 
-	return out, nil
+	scf.Routes = out
+	scf.network = network
+	scf.document = document
+	return &scf, nil
 }
 
+// kubeDataDir is the symlink Kubernetes swaps atomically when a mounted
+// ConfigMap or Secret changes; the config file itself never sees an event.
+const kubeDataDir = "..data"
+
+// WatchConfig reloads the configuration at path when it changes. For a
+// config directory or a file with include globs, every directory that holds
+// part of the configuration is watched.
 func (g *Gateway) WatchConfig(path string, stopCtx context.Context) error {
 	abs, err := filepath.Abs(path)
 	if err != nil {
 		return err
 	}
-	dir := filepath.Dir(abs)
-	file := filepath.Base(abs)
 
 	w, err := fsnotify.NewWatcher()
 	if err != nil {
 		return err
 	}
 
-	if err := w.Add(dir); err != nil {
+	if err := w.Add(filepath.Dir(abs)); err != nil {
 		_ = w.Close()
 		return err
 	}
 
+	// Watch the tree again after every reload, so directories and include
+	// globs added since are picked up.
+	watched := map[string]bool{filepath.Dir(abs): true}
+	var match func(string) bool
+	watchTree := func() {
+		var dirs []string
+		dirs, match = configWatchSet(abs, g.live.Load().descriptors())
+		for _, d := range dirs {
+			if !watched[d] && w.Add(d) == nil {
+				watched[d] = true
+			}
+		}
+	}
 	if err := g.reloadFromPath(abs); err != nil {
 		g.logger.Warning("err", fmt.Sprintf("initial config load failed: %v", err))
 	}
+	watchTree()
+
+	// Follow a symlinked config file to where it really lives, so edits of
+	// the target are seen too.
+	target, _ := filepath.EvalSymlinks(abs)
 
 	go func() {
 		defer w.Close()
@@ -100,12 +247,19 @@ func (g *Gateway) WatchConfig(path string, stopCtx context.Context) error {
 				if !ok {
 					return
 				}
-				if filepath.Base(ev.Name) != file {
+				relevant := match(ev.Name) || filepath.Base(ev.Name) == kubeDataDir ||
+					(target != "" && ev.Name == target)
+				if current, err := filepath.EvalSymlinks(abs); err == nil && current != target {
+					target = current
+					relevant = true
+				}
+				if !relevant {
 					continue
 				}
 				debounce.Reset(200 * time.Millisecond)
 			case <-debounce.C:
-				if err := g.reloadFromPath(abs); err != nil {
+				watchTree()
+				if err := g.reloadIfChanged(abs); err != nil {
 					g.logger.Warning("err", fmt.Sprintf("reload failed: %v", err))
 				}
 			case err := <-w.Errors:
@@ -116,35 +270,175 @@ func (g *Gateway) WatchConfig(path string, stopCtx context.Context) error {
 	return nil
 }
 
-func (g *Gateway) reloadFromPath(path string) error {
-	newRoutes, err := loadConfigFile(path)
+// PollConfig watches path by polling, for filesystems without inotify. A
+// change of modification time or symlink target of any configuration file
+// triggers a content hash comparison; the hash is also compared every few
+// ticks in case the mtime resolution hides a write.
+func (g *Gateway) PollConfig(path string, interval time.Duration, stopCtx context.Context) error {
+	abs, err := filepath.Abs(path)
 	if err != nil {
 		return err
 	}
-	g.atomicRoutes.Store(newRoutes)
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	if err := g.reloadFromPath(abs); err != nil {
+		g.logger.Warning("err", fmt.Sprintf("initial config load failed: %v", err))
+	}
 
-	g.cleanupProxyCache(newRoutes)
+	stamp := func() string {
+		files, _, err := configFiles(abs)
+		if err != nil {
+			return err.Error()
+		}
+		files = append(files, g.live.Load().descriptors()...)
+		var b strings.Builder
+		for _, f := range files {
+			target, _ := filepath.EvalSymlinks(f)
+			if fi, err := os.Stat(f); err == nil {
+				fmt.Fprintf(&b, "%s|%d|%d\n", target, fi.ModTime().UnixNano(), fi.Size())
+			}
+		}
+		return b.String()
+	}
 
-	g.logger.Info("reload", fmt.Sprintf("configuration reloeaded: %d services", len(newRoutes)))
+	go func() {
+		last := stamp()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for tick := 1; ; tick++ {
+			select {
+			case <-stopCtx.Done():
+				return
+			case <-t.C:
+			}
+			cur := stamp()
+			if cur == last && tick%12 != 0 {
+				continue
+			}
+			last = cur
+			if err := g.reloadIfChanged(abs); err != nil {
+				g.logger.Warning("err", fmt.Sprintf("reload failed: %v", err))
+			}
+		}
+	}()
 	return nil
 }
 
-func (g *Gateway) cleanupProxyCache(keep map[string]*Service) {
-	g.proxyCache.Range(func(k, v any) bool {
-		key := k.(string)
-		keepThis := false
-		for _, svc := range keep {
-			if svc.Name == key {
-				keepThis = true
-				break
-			}
+// diskState fingerprints src together with the descriptor sets the live
+// configuration reads, which can change while its files stay the same.
+func (g *Gateway) diskState(src configSource) string {
+	live := g.live.Load()
+	if live == nil {
+		return src.hash()
+	}
+	return src.hash() + "\n" + descriptorsOnDisk(live.descriptors())
+}
+
+// state is the diskState this configuration was loaded from.
+func (l *liveConfig) state() string {
+	return l.source.hash() + "\n" + loadedDescriptors(l.cfg.Routes)
+}
+
+// descriptors returns the descriptor sets the configuration reads.
+func (l *liveConfig) descriptors() []string {
+	if l == nil {
+		return nil
+	}
+	return descriptorFiles(l.cfg.Routes)
+}
+
+// reloadIfChanged reloads path when its content differs from what was last
+// read from disk and from the live generation's source. A configuration
+// that was rejected or rolled back is thus not applied again until the
+// file changes. Explicit reloads (SIGHUP, admin) always reload so
+// interpolated values are re-read.
+func (g *Gateway) reloadIfChanged(path string) error {
+	src, err := readConfigSource(path)
+	if err != nil {
+		return err
+	}
+	g.configMu.Lock()
+	defer g.configMu.Unlock()
+	hash := g.diskState(src)
+	if hash == g.diskHash {
+		return nil
+	}
+	g.diskHash = hash
+	if live := g.live.Load(); live != nil && live.state() == hash {
+		return nil
+	}
+	return g.applySourceLocked(src, "file")
+}
+
+func (g *Gateway) reloadFromPath(path string) error {
+	src, err := readConfigSource(path)
+	if err != nil {
+		return err
+	}
+	g.configMu.Lock()
+	defer g.configMu.Unlock()
+	g.diskHash = g.diskState(src)
+	return g.applySourceLocked(src, "file")
+}
+
+// applySourceLocked validates a configuration and, if it is valid,
+// swaps it in as the next generation. Every attempt is recorded in the
+// reload history. Callers hold configMu.
+func (g *Gateway) applySourceLocked(src configSource, origin string) error {
+	rec := &ReloadRecord{Hash: src.hash(), Timestamp: time.Now(), Origin: origin, source: src}
+	// Everything that can fail is prepared before anything is swapped in,
+	// so a rejected configuration leaves all of the live one in place.
+	cfg, err := parseConfig(src)
+	var quotas *quotaUpdate
+	var blocks blocklistUpdate
+	if err == nil {
+		quotas, err = g.quotas.prepare(cfg.Quotas)
+		if err != nil {
+			err = fmt.Errorf("quota configuration: %w", err)
 		}
-		if !keepThis {
-			g.proxyCache.Delete(key)
-			g.logger.Error("poxy-cache-error", fmt.Sprintf("proxy cache evicted for service: %s", key), nil)
+	}
+	if err == nil {
+		if blocks, err = g.blocklist.prepare(cfg.IPFilter.BlocklistFile, g.logger); err != nil {
+			quotas.discard()
 		}
-		return true
-	})
+	}
+	if err != nil {
+		rec.Outcome = "rejected"
+		rec.Error = err.Error()
+		g.history.add(rec)
+		return err
+	}
+
+	var prevRoutes map[string]*Service
+	if live := g.live.Load(); live != nil {
+		prevRoutes = live.cfg.Routes
+	}
+	rec.Diff = diffServices(prevRoutes, cfg.Routes)
+
+	g.quotas.commit(quotas)
+	g.blocklist.commit(blocks)
+	g.network.Store(cfg.network)
+	table := g.applyRoutes(cfg.Routes)
+	g.concurrency.retain(cfg.Routes)
+	g.caches.retain(cfg.Routes)
+	g.live.Store(&liveConfig{path: src.root, source: src, cfg: cfg, generation: table.generation, loadedAt: rec.Timestamp})
+
+	rec.Generation = table.generation
+	rec.Outcome = "applied"
+	gate := cfg.Reload.HealthGate
+	if gate.Enabled && origin != "rollback" && prevRoutes != nil && len(rec.Diff.services()) > 0 {
+		rec.Outcome = "watching"
+	}
+	g.history.resize(cfg.Reload.HistorySize)
+	g.history.add(rec)
+	if rec.Outcome == "watching" {
+		g.watchHealth(rec, gate)
+	}
+
+	g.logger.Info("reload", fmt.Sprintf("configuration reloaded: generation %d (%s), %d services, added %v removed %v changed %v",
+		table.generation, rec.Hash, len(cfg.Routes), rec.Diff.Added, rec.Diff.Removed, rec.Diff.Changed))
+	return nil
 }
 
 func extractPrefix(p string) string {
@@ -1 +1,119 @@
 package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "aimas.yml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFile_Interpolation(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "rpm")
+	if err := os.WriteFile(secret, []byte("42\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("USER_HOST", "http://users.internal:9001")
+
+	path := writeConfig(t, `
+services:
+  - name: user-service
+    host: ${USER_HOST}
+    prefix: ${USER_PREFIX:-/users}
+    rate_limit:
+      requests_per_minute: ${file:`+secret+`}
+`)
+	cfg, err := loadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := cfg.Routes["/users"]
+	if svc == nil {
+		t.Fatalf("expected /users route, got %v", cfg.Routes)
+	}
+	if svc.URL.Host != "users.internal:9001" {
+		t.Errorf("unexpected host %s", svc.URL.Host)
+	}
+	if svc.RateLimit.RequestsPerMinute != 42 {
+		t.Errorf("expected rpm from secret file, got %d", svc.RateLimit.RequestsPerMinute)
+	}
+}
+
+func TestLoadConfigFile_UnresolvedVariable(t *testing.T) {
+	path := writeConfig(t, `
+services:
+  - name: user-service
+    host: ${AIMAS_TEST_MISSING_HOST}
+`)
+	_, err := loadConfigFile(path)
+	if err == nil {
+		t.Fatal("expected error for unresolved variable")
+	}
+	for _, want := range []string{"user-service", "host", "AIMAS_TEST_MISSING_HOST"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q should mention %q", err, want)
+		}
+	}
+}
+
+func TestLoadConfigFile_StrictValidation(t *testing.T) {
+	path := writeConfig(t, `services:
+  - name: user-service
+    host: http://localhost:9001
+    prefix: /users
+    strip_prefx: true
+    rate_limit:
+      requests_per_minute: -5
+  - name: other
+    host: ftp://files
+    prefix: /users
+`)
+	_, err := loadConfigFile(path)
+	ve, ok := err.(ValidationError)
+	if !ok {
+		t.Fatalf("expected ValidationError, got %v", err)
+	}
+
+	want := map[int]string{
+		5:  "unknown field",
+		7:  "must be positive",
+		9:  "unsupported scheme",
+		10: "duplicate service prefix",
+	}
+	for line, msg := range want {
+		found := false
+		for _, e := range ve {
+			if e.Line == line && strings.Contains(e.Message, msg) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("expected %q on line %d, got %v", msg, line, ve)
+		}
+	}
+}
+
+func TestRunValidate_ExitCode(t *testing.T) {
+	good := writeConfig(t, "services:\n  - name: a\n    host: http://localhost:1\n")
+	var out strings.Builder
+	if code := runValidate([]string{"-config", good}, &out); code != 0 {
+		t.Fatalf("expected exit 0, got %d: %s", code, out.String())
+	}
+
+	bad := writeConfig(t, "servics: []\n")
+	out.Reset()
+	if code := runValidate([]string{"-config", bad}, &out); code != 1 {
+		t.Fatalf("expected exit 1, got %d", code)
+	}
+	if !strings.Contains(out.String(), `"valid": false`) || !strings.Contains(out.String(), `"line": 1`) {
+		t.Fatalf("unexpected report: %s", out.String())
+	}
+}
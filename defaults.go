@@ -0,0 +1,128 @@
+package main
+
+import (
+	"gopkg.in/yaml.v3"
+)
+
+// defaultRequestsPerMinute is the rate limit of a service that sets none,
+// neither itself nor in the defaults block.
+const defaultRequestsPerMinute = 120
+
+// defaultAuthMode is the auth mode of a service that sets none.
+const defaultAuthMode = "jwt"
+
+// serviceOnlyFields identify a single service and cannot be defaulted.
+var serviceOnlyFields = []string{"name", "host", "backends", "prefix", "routes"}
+
+// zeroIsUnset names fields where 0 means "not set" once decoded, so a
+// service writing 0 inherits the default instead of the built-in value.
+var zeroIsUnset = map[string]bool{"requests_per_minute": true}
+
+// applyDefaults returns a copy of doc in which every service is merged
+// over the top-level defaults block. Mappings are merged key by key, so a
+// service setting rate_limit.requests_per_minute keeps the other rate_limit
+// defaults; scalars and lists set by the service replace the default
+// entirely. doc itself is left untouched.
+func applyDefaults(c *configIssues, doc *yaml.Node) *yaml.Node {
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return doc
+	}
+	defaults := lookupNode(doc, "defaults")
+	services := lookupNode(doc, "services")
+	if defaults == doc.Content[0] || defaults.Kind != yaml.MappingNode ||
+		services == doc.Content[0] || services.Kind != yaml.SequenceNode {
+		return doc
+	}
+
+	resolved := *services
+	resolved.Content = make([]*yaml.Node, len(services.Content))
+	for i, item := range services.Content {
+		if item.Kind != yaml.MappingNode {
+			resolved.Content[i] = item
+			continue
+		}
+		merged := mergeMapping(c, defaults, item, c.origins[defaults])
+		if file, ok := c.origins[item]; ok {
+			c.origins[merged] = file
+		}
+		resolved.Content[i] = merged
+	}
+
+	root := *doc.Content[0]
+	root.Content = append([]*yaml.Node(nil), root.Content...)
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "services" {
+			root.Content[i+1] = &resolved
+		}
+	}
+	out := *doc
+	out.Content = []*yaml.Node{&root}
+	return &out
+}
+
+// mergeMapping overlays override on base. Values taken from base are
+// attributed to baseFile so errors in them point at the defaults block.
+func mergeMapping(c *configIssues, base, override *yaml.Node, baseFile string) *yaml.Node {
+	out := *override
+	out.Content = append([]*yaml.Node(nil), override.Content...)
+	for i := 0; i+1 < len(base.Content); i += 2 {
+		key, value := base.Content[i], base.Content[i+1]
+		j := mappingIndex(&out, key.Value)
+		switch {
+		case j < 0:
+			markOrigin(c, value, baseFile)
+			out.Content = append(out.Content, key, value)
+		case value.Kind == yaml.MappingNode && out.Content[j+1].Kind == yaml.MappingNode:
+			out.Content[j+1] = mergeMapping(c, value, out.Content[j+1], baseFile)
+		case zeroIsUnset[key.Value] && out.Content[j+1].Kind == yaml.ScalarNode && out.Content[j+1].Value == "0":
+			markOrigin(c, value, baseFile)
+			out.Content[j+1] = value
+		}
+	}
+	return &out
+}
+
+func mappingIndex(n *yaml.Node, key string) int {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func markOrigin(c *configIssues, n *yaml.Node, file string) {
+	if file == "" {
+		return
+	}
+	c.origins[n] = file
+	for _, child := range n.Content {
+		markOrigin(c, child, file)
+	}
+}
+
+// applyBuiltinDefaults fills in what a service falls back to when neither
+// it nor the defaults block sets a value, so the effective configuration
+// shows it.
+func applyBuiltinDefaults(svc *Service) {
+	if svc.RateLimit.RequestsPerMinute == 0 {
+		svc.RateLimit.RequestsPerMinute = defaultRequestsPerMinute
+	}
+	if svc.Auth == "" {
+		svc.Auth = defaultAuthMode
+	}
+	if svc.Middlewares == nil {
+		svc.Middlewares = append([]string(nil), defaultMiddlewares...)
+	}
+}
+
+// validateDefaults rejects fields that only make sense per service. The
+// other defaults are checked through every service that inherits them.
+func validateDefaults(c *configIssues) {
+	defaults := lookupNode(c.root, "defaults")
+	for _, field := range serviceOnlyFields {
+		if lookupNode(c.root, "defaults", field) != defaults {
+			c.addf([]interface{}{"defaults", field}, "%s cannot be set in defaults", field)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigFile_Defaults(t *testing.T) {
+	path := writeConfig(t, `
+defaults:
+  strip_prefix: true
+  timeout: 5s
+  rate_limit:
+    requests_per_minute: 60
+  concurrency:
+    max_in_flight: 10
+    queue_size: 5
+services:
+  - name: a
+    host: http://localhost:1
+  - name: b
+    host: http://localhost:2
+    strip_prefix: false
+    concurrency:
+      queue_size: 0
+  - name: c
+    host: http://localhost:3
+    rate_limit:
+      requests_per_minute: 0
+`)
+	cfg, err := loadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := cfg.Routes["/a"], cfg.Routes["/b"]
+	if !a.StripPefix || a.Timeout != 5*time.Second || a.RateLimit.RequestsPerMinute != 60 || a.Concurrency.MaxInFlight != 10 {
+		t.Errorf("a should inherit every default, got %+v", a)
+	}
+	if b.StripPefix || b.Concurrency.MaxInFlight != 10 || b.Concurrency.QueueSize != 0 {
+		t.Errorf("b should override strip_prefix and queue_size only, got %+v", b)
+	}
+	if rpm := cfg.Routes["/c"].RateLimit.RequestsPerMinute; rpm != 60 {
+		t.Errorf("c should treat 0 as unset and inherit the default rate limit, got %d", rpm)
+	}
+	if a.Auth != "jwt" || len(a.Middlewares) != len(defaultMiddlewares) {
+		t.Errorf("built-in auth mode and middlewares should be filled in, got %q %v", a.Auth, a.Middlewares)
+	}
+
+	bad := writeConfig(t, "defaults:\n  host: http://localhost:1\n  rate_limit:\n    requests_per_minute: -1\nservices:\n  - name: a\n")
+	_, err = loadConfigFile(bad)
+	if err == nil || !strings.Contains(err.Error(), "host cannot be set in defaults") ||
+		!strings.Contains(err.Error(), ":4: services[0].rate_limit.requests_per_minute") {
+		t.Fatalf("expected defaults errors pointing at the defaults block, got %v", err)
+	}
+}
+
+func TestRunConfig_DumpEffective(t *testing.T) {
+	path := writeConfig(t, "defaults:\n  auth: none\nservices:\n  - name: a\n    host: http://localhost:1\n")
+	var out bytes.Buffer
+	if code := runConfig([]string{"dump", "--effective", "-config", path}, &out); code != 0 {
+		t.Fatalf("expected exit 0, got %d: %s", code, out.String())
+	}
+	for _, want := range []string{"name: a", "auth: none", "requests_per_minute: 120", "prefix: /a"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("effective dump missing %q:\n%s", want, out.String())
+		}
+	}
+
+	out.Reset()
+	if code := runConfig([]string{"dump", "-config", path}, &out); code != 0 || !strings.Contains(out.String(), "defaults:") {
+		t.Errorf("plain dump should print the document as written, got %d:\n%s", code, out.String())
+	}
+}
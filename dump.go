@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// runConfig implements `aimas-gateway config dump [--effective]`. Without
+// --effective it prints the configuration as loaded, with all files merged
+// and variables interpolated; with it, every service as the gateway runs
+// it, defaults and built-in fallbacks applied. Resolved secrets are
+// printed too, so treat the output accordingly.
+func runConfig(args []string, stdout io.Writer) int {
+	if len(args) == 0 || args[0] != "dump" {
+		fmt.Fprintln(stdout, "usage: aimas-gateway config dump [--effective] [-config path]")
+		return 2
+	}
+	fs := flag.NewFlagSet("config dump", flag.ContinueOnError)
+	fs.SetOutput(stdout)
+	configFile := fs.String("config", "aimas.yml", "configuration file or directory")
+	effective := fs.Bool("effective", false, "print every service with defaults applied")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	cfg, err := loadConfigFile(*configFile)
+	if err != nil {
+		var ve ValidationError
+		if errors.As(err, &ve) {
+			for _, e := range ve {
+				fmt.Fprintln(stdout, e.Error())
+			}
+		} else {
+			fmt.Fprintf(stdout, "%s: %v\n", *configFile, err)
+		}
+		return 1
+	}
+
+	enc := yaml.NewEncoder(stdout)
+	enc.SetIndent(2)
+	defer enc.Close()
+	if !*effective {
+		if cfg.document == nil {
+			return 0
+		}
+		if err := enc.Encode(cfg.document); err != nil {
+			fmt.Fprintln(stdout, err)
+			return 1
+		}
+		return 0
+	}
+
+	services := make([]*Service, 0, len(cfg.Routes))
+	for _, svc := range cfg.Routes {
+		services = append(services, svc)
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+	if err := enc.Encode(map[string]interface{}{"services": services}); err != nil {
+		fmt.Fprintln(stdout, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ServiceRoute narrows part of a service to certain methods and lets it
+// override the service's rate limit, auth mode, timeout, body size limit
+// and rewrites, or turn on request coalescing for its paths.
+// Path is a pattern like the rewrite path, e.g. /orders/{id}, and includes
+// the service prefix.
+type ServiceRoute struct {
+	Path         string         `yaml:"path"`
+	Methods      []string       `yaml:"methods"`
+	RateLimit    RateLimit      `yaml:"rate_limit"`
+	Auth         string         `yaml:"auth"`
+	Timeout      time.Duration  `yaml:"timeout"`
+	Rewrite      []RewriteRule  `yaml:"rewrite"`
+	Coalesce     CoalesceConfig `yaml:"coalesce"`
+	MaxBodyBytes int64          `yaml:"max_body_bytes"`
+}
+
+var knownMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true, http.MethodPut: true,
+	http.MethodPatch: true, http.MethodDelete: true, http.MethodOptions: true,
+}
+
+// endpoint is a compiled ServiceRoute with its own middleware chain.
+type endpoint struct {
+	pattern *regexp.Regexp
+	methods map[string]bool // empty allows every method
+	handler http.Handler
+}
+
+func (e *endpoint) allows(method string) bool {
+	return len(e.methods) == 0 || e.methods[method]
+}
+
+// forRoute returns the service as seen by one of its routes: the settings
+// the route sets replace the service's. A route with its own rate limit
+// gets its own buckets.
+func (svc *Service) forRoute(r ServiceRoute) *Service {
+	d := *svc
+	d.Routes = nil
+	if r.RateLimit.RequestsPerMinute > 0 {
+		d.RateLimit = r.RateLimit
+		d.rateLimitKey = svc.Name + " " + r.Path
+	}
+	if r.Auth != "" {
+		d.Auth = r.Auth
+	}
+	if r.Timeout > 0 {
+		d.Timeout = r.Timeout
+	}
+	if r.MaxBodyBytes > 0 {
+		d.MaxBodyBytes = r.MaxBodyBytes
+	}
+	if r.Rewrite != nil {
+		d.Rewrite = r.Rewrite
+	}
+	if r.Coalesce.Enabled {
+		d.Coalesce = r.Coalesce
+	}
+	return &d
+}
+
+// compileEndpoints builds the proxy and chain of every route of svc on the
+// service's transports.
+func (g *Gateway) compileEndpoints(svc *Service, transportFor func(*url.URL) http.RoundTripper) []*endpoint {
+	out := make([]*endpoint, 0, len(svc.Routes))
+	for _, r := range svc.Routes {
+		re, err := compilePathPattern(r.Path)
+		if err != nil {
+			continue // rejected by validation
+		}
+		rs := svc.forRoute(r)
+		ep := &endpoint{pattern: re, methods: map[string]bool{}}
+		for _, m := range r.Methods {
+			ep.methods[strings.ToUpper(m)] = true
+		}
+		if ep.methods[http.MethodGet] {
+			ep.methods[http.MethodHead] = true
+		}
+		ep.handler = g.compileChain(rs, g.serviceHandler(rs, g.newUpstream(rs, transportFor)))
+		out = append(out, ep)
+	}
+	return out
+}
+
+// dispatch picks the handler for r among the routes of a service. The
+// first route whose path and method match wins. When only the path
+// matches, the request gets a 405 listing the methods that would.
+// Unmatched paths go to fallback, or get a 404 when it is nil.
+func dispatch(endpoints []*endpoint, fallback http.Handler, w http.ResponseWriter, r *http.Request) {
+	path := r.URL.EscapedPath()
+	allowed := map[string]bool{}
+	var preflight *endpoint
+	for _, ep := range endpoints {
+		m := ep.pattern.FindStringSubmatchIndex(path)
+		if m == nil {
+			continue
+		}
+		if ep.allows(r.Method) {
+			ep.handler.ServeHTTP(w, withRouteParams(r, captureParams(ep.pattern, path, m)))
+			return
+		}
+		if preflight == nil {
+			preflight = ep
+		}
+		for method := range ep.methods {
+			allowed[method] = true
+		}
+	}
+
+	if preflight != nil {
+		// CORS preflights are answered by the route's chain, whatever
+		// methods it allows.
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			preflight.handler.ServeHTTP(w, r)
+			return
+		}
+		methods := make([]string, 0, len(allowed))
+		for method := range allowed {
+			methods = append(methods, method)
+		}
+		sort.Strings(methods)
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		JSONBadResponse(w, "method not allowed", http.StatusMethodNotAllowed, nil)
+		return
+	}
+	if fallback == nil {
+		JSONBadResponse(w, "route not found", http.StatusNotFound, nil)
+		return
+	}
+	fallback.ServeHTTP(w, r)
+}
+
+// captureParams returns the named groups of a match on an escaped path,
+// unescaped.
+func captureParams(re *regexp.Regexp, path string, m []int) map[string]string {
+	var params map[string]string
+	for i, name := range re.SubexpNames() {
+		if name == "" || m[2*i] < 0 {
+			continue
+		}
+		if params == nil {
+			params = map[string]string{}
+		}
+		v := path[m[2*i]:m[2*i+1]]
+		if u, err := url.PathUnescape(v); err == nil {
+			v = u
+		}
+		params[name] = v
+	}
+	return params
+}
+
+func validateServiceRoutes(c *configIssues, svc Service, path []interface{}) {
+	switch svc.Unmatched {
+	case "", "forward", "reject":
+	default:
+		c.addf(appendPath(path, "unmatched"), "unknown value %q, expected forward or reject", svc.Unmatched)
+	}
+	prefix := normalizePrefix(svc)
+	for i, r := range svc.Routes {
+		at := func(p ...interface{}) []interface{} { return append(appendPath(appendPath(path, "routes"), i), p...) }
+		if _, err := compilePathPattern(r.Path); err != nil || r.Path == "" {
+			c.add("path must be a pattern such as /orders/{id}", at("path")...)
+		} else if r.Path != prefix && !strings.HasPrefix(r.Path, prefix+"/") {
+			c.addf(at("path"), "path %q is outside the service prefix %s", r.Path, prefix)
+		}
+		for j, m := range r.Methods {
+			if !knownMethods[strings.ToUpper(m)] {
+				c.addf(at("methods", j), "unknown method %q", m)
+			}
+		}
+		if r.RateLimit.RequestsPerMinute < 0 {
+			c.addf(at("rate_limit", "requests_per_minute"), "must be positive, got %d", r.RateLimit.RequestsPerMinute)
+		}
+		switch r.Auth {
+		case "", "jwt", "api_key", "none":
+		default:
+			c.addf(at("auth"), "unknown auth mode %q, expected jwt, api_key or none", r.Auth)
+		}
+		if r.Timeout < 0 {
+			c.addf(at("timeout"), "must not be negative, got %s", r.Timeout)
+		}
+		if r.MaxBodyBytes < 0 {
+			c.addf(at("max_body_bytes"), "must not be negative, got %d", r.MaxBodyBytes)
+		}
+		validateRewrites(c, r.Rewrite, at("rewrite"))
+		validateCoalesce(c, r.Coalesce, at("coalesce"))
+	}
+}
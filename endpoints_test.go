@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestServiceRoutes_MethodsOverridesAndUnmatched(t *testing.T) {
+	var gotPath string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+	}))
+	t.Cleanup(upstream.Close)
+	u, _ := url.Parse(upstream.URL)
+	svc := &Service{Name: "orders", URL: u, Prefix: "/orders", StripPefix: true, Auth: "jwt",
+		Middlewares: []string{"auth"},
+		Routes: []ServiceRoute{
+			{Path: "/orders/public/{id}", Methods: []string{"GET"}, Auth: "none",
+				Rewrite: []RewriteRule{{Path: "/orders/public/{id}", To: "/v2/orders/{id}"}}},
+			{Path: "/orders/{id}", Methods: []string{"GET", "DELETE"}},
+		},
+	}
+	gw := setupGateway(t, map[string]*Service{"/orders": svc})
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		gw.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+
+	if w := serve(http.MethodGet, "/orders/public/7"); w.Code != http.StatusOK || gotPath != "/v2/orders/7" {
+		t.Errorf("public route should skip auth and rewrite, got %d %q", w.Code, gotPath)
+	}
+	if w := serve(http.MethodGet, "/orders/7"); w.Code != http.StatusUnauthorized {
+		t.Errorf("route without auth override should inherit jwt, got %d", w.Code)
+	}
+	w := serve(http.MethodPost, "/orders/public/7")
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET, HEAD" {
+		t.Errorf("expected 405 with Allow: GET, HEAD, got %d %q", w.Code, w.Header().Get("Allow"))
+	}
+	if w := serve(http.MethodPatch, "/orders/7"); !strings.Contains(w.Header().Get("Allow"), "DELETE") {
+		t.Errorf("Allow should list every method of the matching route, got %q", w.Header().Get("Allow"))
+	}
+
+	// Unknown sub-paths fall through to the service chain by default.
+	if w := serve(http.MethodGet, "/orders/a/b"); w.Code != http.StatusUnauthorized {
+		t.Errorf("unmatched path should be forwarded through the service chain, got %d", w.Code)
+	}
+	svc2 := *svc
+	svc2.Unmatched = "reject"
+	gw = setupGateway(t, map[string]*Service{"/orders": &svc2})
+	if w := serve(http.MethodGet, "/orders/a/b"); w.Code != http.StatusNotFound {
+		t.Errorf("unmatched path should be rejected, got %d", w.Code)
+	}
+}
+
+func TestServiceRoutes_OwnRateLimitIsThrottledSeparately(t *testing.T) {
+	mock := mockService(t, "ok", http.StatusOK)
+	u, _ := url.Parse(mock.URL)
+	svc := &Service{Name: "orders", URL: u, Prefix: "/orders", Auth: "none",
+		Middlewares: []string{"rate_limit"},
+		RateLimit:   RateLimit{RequestsPerMinute: 3},
+		Routes:      []ServiceRoute{{Path: "/orders/exports", RateLimit: RateLimit{RequestsPerMinute: 1}}},
+	}
+	gw := setupGateway(t, map[string]*Service{"/orders": svc})
+	serve := func(path string) int {
+		w := httptest.NewRecorder()
+		gw.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code
+	}
+
+	if code := serve("/orders/exports"); code != http.StatusOK {
+		t.Fatalf("first export: expected 200, got %d", code)
+	}
+	if code := serve("/orders/exports"); code != http.StatusTooManyRequests {
+		t.Fatalf("second export: expected 429, got %d", code)
+	}
+	// The route's exhausted bucket leaves the service's alone, and calls to
+	// the service do not refill or resize the route's.
+	for i := 0; i < 3; i++ {
+		if code := serve("/orders/1"); code != http.StatusOK {
+			t.Fatalf("service request %d: expected 200, got %d", i, code)
+		}
+	}
+	if code := serve("/orders/1"); code != http.StatusTooManyRequests {
+		t.Errorf("fourth service request: expected 429, got %d", code)
+	}
+	if code := serve("/orders/exports"); code != http.StatusTooManyRequests {
+		t.Errorf("export after service calls: expected 429, got %d", code)
+	}
+}
+
+func TestLoadConfigFile_ServiceRouteErrors(t *testing.T) {
+	path := writeConfig(t, `services:
+  - name: orders
+    host: http://localhost:1
+    unmatched: drop
+    routes:
+      - path: /billing/{id}
+        methods: [GET, FETCH]
+`)
+	_, err := loadConfigFile(path)
+	if err == nil {
+		t.Fatal("expected errors")
+	}
+	for _, want := range []string{"unmatched: unknown value", "routes[0].path: path \"/billing/{id}\" is outside", "routes[0].methods[1]: unknown method"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("missing %q in:\n%v", want, err)
+		}
+	}
+}
@@ -4,3 +4,6 @@ import "errors"
 
 var ErrorConfigFileNotFound = errors.New("config file is missing")
 var ErrorConfigMissingPort = errors.New("missing port number")
+var ErrorServiceNotFound = errors.New("service not found")
+var ErrorServiceExists = errors.New("service already exists")
+var ErrorAdminTokenMissing = errors.New("admin token is not configured")
@@ -8,6 +8,7 @@ import (
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/netip"
 	"os"
 	"os/signal"
 	"strings"
@@ -22,18 +23,39 @@ import (
 
 type Gateway struct {
 	atomicRoutes atomic.Value
+	network      atomic.Pointer[networkPolicy]
+	blocklist    blocklistHolder
+	live         atomic.Pointer[liveConfig]
 
 	rateLimiter *RateLimiter
-	proxyCache  sync.Map
+	quotas      *QuotaManager
+	concurrency *ConcurrencyManager
+	caches      *CacheManager
+	metrics     *Metrics
+	history     reloadHistory
+	streams     sync.Map // service name -> *atomic.Int64 of open streams
 	mu          sync.Mutex
+	configMu    sync.Mutex
+	diskHash    string // of the configuration last read from disk; configMu
+	generation  uint64
 	logger      *Log
 }
 
 func main() {
 	godotenv.Load()
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(runValidate(os.Args[2:], os.Stdout))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(runConfig(os.Args[2:], os.Stdout))
+	}
 	logger := NewLogger()
 
-	configFile := flag.String("config", "aimas.yml", "configuration file path")
+	configFile := flag.String("config", "aimas.yml", "configuration file or directory")
+	watchMode := flag.String("watch", "auto", "config watching: auto, fsnotify, poll or off")
+	pollInterval := flag.Duration("poll-interval", 5*time.Second, "config polling interval when -watch=poll")
+	h2c := flag.Bool("h2c", true, "also accept HTTP/2 without TLS (h2c), as gRPC clients use")
+	server := serverFlags(flag.CommandLine)
 	flag.Parse()
 
 	gw := NewGateway(logger)
@@ -45,18 +67,48 @@ func main() {
 		logger.Fatal("config", fmt.Sprintf("failed to load config: %v", err), err)
 	}
 
-	if err := gw.WatchConfig(*configFile, ctx); err != nil {
-		logger.Fatal("config", fmt.Sprintf("failed to watch config: %v", err), err)
+	switch *watchMode {
+	case "off":
+	case "poll":
+		if err := gw.PollConfig(*configFile, *pollInterval, ctx); err != nil {
+			logger.Fatal("config", fmt.Sprintf("failed to poll config: %v", err), err)
+		}
+	case "fsnotify", "auto":
+		err := gw.WatchConfig(*configFile, ctx)
+		if err != nil && *watchMode == "auto" {
+			logger.Warning("config", fmt.Sprintf("fsnotify unavailable (%v), polling every %s", err, *pollInterval))
+			err = gw.PollConfig(*configFile, *pollInterval, ctx)
+		}
+		if err != nil {
+			logger.Fatal("config", fmt.Sprintf("failed to watch config: %v", err), err)
+		}
+	default:
+		logger.Fatal("config", fmt.Sprintf("unknown -watch mode %q", *watchMode), nil)
 	}
 
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			logger.Info("config", "SIGHUP received, reloading configuration")
+			if err := gw.reloadFromPath(*configFile); err != nil {
+				logger.Warning("config", fmt.Sprintf("reload failed: %v", err))
+			}
+		}
+	}()
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
 	srv := &http.Server{
-		Addr:    ":" + port,
-		Handler: gw,
+		Addr:      ":" + port,
+		Handler:   gw,
+		Protocols: new(http.Protocols),
 	}
+	server.apply(srv)
+	srv.Protocols.SetHTTP1(true)
+	srv.Protocols.SetUnencryptedHTTP2(*h2c)
 
 	go func() {
 		logger.Info("gateway", fmt.Sprintf("gateway starting on %s", srv.Addr))
@@ -65,64 +117,77 @@ func main() {
 		}
 	}()
 
+	var adminSrv *http.Server
+	if addr := os.Getenv("ADMIN_ADDR"); addr != "" {
+		token := os.Getenv("ADMIN_TOKEN")
+		if token == "" {
+			logger.Fatal("admin", "ADMIN_TOKEN is required when ADMIN_ADDR is set", ErrorAdminTokenMissing)
+		}
+		adminSrv = &http.Server{Addr: addr, Handler: gw.AdminHandler(token)}
+		server.apply(adminSrv)
+		go func() {
+			logger.Info("admin", fmt.Sprintf("admin API starting on %s", addr))
+			if err := adminSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Fatal("admin", fmt.Sprintf("admin listen error: %v", err), err)
+			}
+		}()
+	}
+
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
 	<-stop
 	logger.Info("server", "shutting down...")
 	ctxShutdown, cancelShutdown := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancelShutdown()
+	if adminSrv != nil {
+		_ = adminSrv.Shutdown(ctxShutdown)
+	}
 	if err := srv.Shutdown(ctxShutdown); err != nil {
 		logger.Fatal("server", fmt.Sprintf("shutdown error: %v", err), err)
 	}
+	gw.blocklist.Close()
+	if err := gw.quotas.Close(); err != nil {
+		logger.Warning("quota", fmt.Sprintf("failed to persist quota counters: %v", err))
+	}
 	logger.Info("server", "server stopped")
 }
 
 func NewGateway(logger *Log) *Gateway {
-	g := &Gateway{logger: logger, rateLimiter: NewRateLimiter()}
-	g.atomicRoutes.Store(map[string]*Service{})
+	g := &Gateway{logger: logger, rateLimiter: NewRateLimiter(), quotas: NewQuotaManager(), concurrency: NewConcurrencyManager(), caches: NewCacheManager(), metrics: NewMetrics()}
+	g.atomicRoutes.Store(&routeTable{routes: map[string]*route{}})
+	trusted, _ := parseCIDRs(defaultTrustedProxies)
+	g.network.Store(&networkPolicy{trusted: trusted})
 	return g
 }
 
-func (g *Gateway) getReverseProxy(svc *Service) *httputil.ReverseProxy {
-	if v, ok := g.proxyCache.Load(svc.Name); ok {
-		return v.(*httputil.ReverseProxy)
-	}
-
-	g.mu.Lock()
-	defer g.mu.Unlock()
-	if v, ok := g.proxyCache.Load(svc.Name); ok {
-		return v.(*httputil.ReverseProxy)
-	}
-
+func (g *Gateway) newReverseProxy(svc *Service, transport http.RoundTripper) *httputil.ReverseProxy {
 	target := svc.URL
+	// Rules are validated with the config, so compiling cannot fail here.
+	requestHeaders, _ := compileHeaderRules(svc.RequestHeaders)
+	responseHeaders, _ := compileHeaderRules(svc.ResponseHeaders)
+	rewrites, _ := compileRewrites(svc.Rewrite)
 
 	director := func(req *http.Request) {
-		origPath := req.URL.Path
-		prefix := svc.Prefix
-
-		var trimmed string
-
-		if svc.StripPefix {
-			trimmed = strings.TrimPrefix(origPath, prefix)
-			if trimmed == "" {
-				trimmed = "/"
+		// Work on the escaped path so encoded characters such as %2F survive
+		// stripping and rewriting.
+		escaped := req.URL.EscapedPath()
+		path, _, rewritten := rewrites.apply(escaped)
+		switch {
+		case rewritten:
+			if before, query, ok := strings.Cut(path, "?"); ok {
+				path = before
+				req.URL.RawQuery = mergeQuery(query, req.URL.RawQuery)
+			}
+		case svc.StripPefix:
+			path = strings.TrimPrefix(escaped, svc.Prefix)
+			if path == "" {
+				path = "/"
 			}
-		} else {
-			trimmed = origPath
 		}
 
 		req.URL.Scheme = target.Scheme
 		req.URL.Host = target.Host
-		req.URL.Path = trimmed
-
-		// origHeaders := req.Header.Clone()
-
-		// req.Header = make(http.Header)
-		// for k, v := range origHeaders {
-		// 	for _, hv := range v {
-		// 		req.Header.Add(k, hv)
-		// 	}
-		// }
+		setEscapedPath(req.URL, joinURLPath(target.EscapedPath(), path))
 
 		if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
 			if prior := req.Header.Get("X-Forwarded-For"); prior != "" {
@@ -132,6 +197,7 @@ func (g *Gateway) getReverseProxy(svc *Service) *httputil.ReverseProxy {
 			}
 		}
 
+		requestHeaders.apply(req.Header, req)
 		signRequest(req, *svc)
 
 		req.Host = target.Host
@@ -139,22 +205,38 @@ func (g *Gateway) getReverseProxy(svc *Service) *httputil.ReverseProxy {
 	}
 
 	proxy := &httputil.ReverseProxy{
-		Director: director,
+		Director:      director,
+		Transport:     transport,
+		FlushInterval: svc.Streams.FlushInterval,
+		ModifyResponse: func(resp *http.Response) error {
+			responseHeaders.apply(resp.Header, resp.Request)
+			return nil
+		},
 		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				bodyTooLarge(w, svc.Name, tooLarge.Limit)
+				return
+			}
 			g.logger.Error("proxy-error",
 				fmt.Sprintf("proxy error for service %s: %v", svc.Name, err),
 				err,
 			)
+			if errors.Is(err, context.DeadlineExceeded) {
+				JSONBadResponse(w, "gateway timeout", http.StatusGatewayTimeout,
+					fmt.Sprintf("service %s did not respond within %s", svc.Name, svc.Timeout))
+				return
+			}
+			// The transport error names internal addresses; it is logged
+			// above and not sent to the client.
 			message := map[string]interface{}{
 				"message":     fmt.Sprintf("failed to reach service %s", svc.Name),
-				"error":       err.Error(),
 				"status_code": http.StatusBadGateway,
 			}
 			JSONBadResponse(w, "bad gateway", http.StatusBadGateway, message)
 		},
 	}
 
-	g.proxyCache.Store(svc.Name, proxy)
 	return proxy
 }
 
@@ -166,25 +248,49 @@ func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	r.Header.Set("X-Request-ID", uuid.NewString())
-	routes := g.atomicRoutes.Load().(map[string]*Service)
+
+	// gRPC clients get gateway errors as a gRPC status.
+	var grpcw *grpcWriter
+	if isGRPCRequest(r) {
+		grpcw = &grpcWriter{ResponseWriter: w}
+		w = grpcw
+	}
+
+	network := g.network.Load()
+	clientIP := resolveClientIP(r, network.trusted)
+	r = withClientIP(r, clientIP)
+	addr, _ := netip.ParseAddr(clientIP)
+	if !network.filter.permits(addr) || g.blocklist.get().contains(addr) {
+		g.denyIP(w, clientIP)
+		return
+	}
+
+	table := g.atomicRoutes.Load().(*routeTable)
 	prefix := extractPrefix(r.URL.Path)
-	svc, ok := routes[prefix]
-	if !ok {
+	rt := table.lookup(r, prefix, addr)
+	if rt == nil {
 		JSONBadResponse(w, "service not found", http.StatusNotFound, nil)
 		return
 	}
 
-	proxy := g.getReverseProxy(svc)
+	if grpcw == nil && rt.svc.Protocol == "grpc" && rt.svc.transcoder == nil {
+		grpcw = &grpcWriter{ResponseWriter: w}
+		w = grpcw
+	}
 
-	h := applyMiddleWare(
-		http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-			proxy.ServeHTTP(w, req)
-		}),
-		LoggingMiddleware(*svc, g.logger),
-		g.rateLimiter.Middleware(svc.Name, svc.RateLimit.RequestsPerMinute),
-		g.AuthMiddleware,
-		RecoverMiddleware,
-		SecurityHeadersMiddleware,
-	)
-	h.ServeHTTP(w, r)
+	if rt.svc.Maintenance {
+		w.Header().Set("Retry-After", "60")
+		JSONBadResponse(w, "service under maintenance", http.StatusServiceUnavailable, nil)
+		return
+	}
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w}
+	rt.serve(sw, r)
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	if grpcw != nil && grpcw.status != 0 {
+		sw.status = grpcw.status
+	}
+	g.metrics.observe(rt.svc.Name, sw.status, time.Since(start))
 }
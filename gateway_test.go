@@ -2,10 +2,12 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 )
 
@@ -24,9 +26,28 @@ func setupGateway(t *testing.T, services map[string]*Service) *Gateway {
 	logger := NewLogger()
 	gw := NewGateway(logger)
 	gw.rateLimiter = NewRateLimiter()
-	gw.atomicRoutes.Store(services)
+	gw.applyRoutes(services)
 	return gw
 }
+
+// serviceGateway loads a configuration with one service, recs at /recs,
+// proxying to upstream. fields holds the rest of the service's YAML,
+// unindented.
+func serviceGateway(t *testing.T, upstream http.Handler, fields string) *Gateway {
+	t.Helper()
+	srv := httptest.NewServer(upstream)
+	t.Cleanup(srv.Close)
+	yml := fmt.Sprintf("services:\n  - name: recs\n    host: %s\n    prefix: /recs\n", srv.URL)
+	for _, line := range strings.Split(strings.TrimSpace(fields), "\n") {
+		yml += "    " + line + "\n"
+	}
+	cfg, err := loadConfigFile(writeConfig(t, yml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return setupGateway(t, cfg.Routes)
+}
+
 func TestGateway_SingleServiceRoute(t *testing.T) {
 	mock := mockService(t, `{"message":"user service ok"}`, http.StatusOK)
 
@@ -125,3 +146,19 @@ func TestGateway_UnknownRoute(t *testing.T) {
 		t.Fatalf("expected 404, got %d", resp.StatusCode)
 	}
 }
+
+func TestGateway_BadGatewayHidesTransportError(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	svcURL, _ := url.Parse(down.URL)
+	gw := setupGateway(t, map[string]*Service{"/down": {Name: "down", URL: svcURL, Prefix: "/down", Auth: "none"}})
+	w := httptest.NewRecorder()
+	gw.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/down/x", nil))
+
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("expected 502, got %d", w.Code)
+	}
+	if body := w.Body.String(); bytes.Contains([]byte(body), []byte(svcURL.Host)) {
+		t.Errorf("the upstream address leaked to the client: %s", body)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gRPC status codes, from google.golang.org/grpc/codes.
+const (
+	grpcOK                 = 0
+	grpcCanceled           = 1
+	grpcUnknown            = 2
+	grpcInvalidArgument    = 3
+	grpcDeadlineExceeded   = 4
+	grpcNotFound           = 5
+	grpcAlreadyExists      = 6
+	grpcPermissionDenied   = 7
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcAborted            = 10
+	grpcOutOfRange         = 11
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnavailable        = 14
+	grpcDataLoss           = 15
+	grpcUnauthenticated    = 16
+)
+
+var grpcCodeNames = []string{
+	"OK", "CANCELLED", "UNKNOWN", "INVALID_ARGUMENT", "DEADLINE_EXCEEDED", "NOT_FOUND",
+	"ALREADY_EXISTS", "PERMISSION_DENIED", "RESOURCE_EXHAUSTED", "FAILED_PRECONDITION", "ABORTED",
+	"OUT_OF_RANGE", "UNIMPLEMENTED", "INTERNAL", "UNAVAILABLE", "DATA_LOSS", "UNAUTHENTICATED",
+}
+
+// grpcHTTPStatus maps a gRPC code to the HTTP status a REST client gets,
+// as in google.rpc.Code.
+func grpcHTTPStatus(code int) int {
+	switch code {
+	case grpcOK:
+		return http.StatusOK
+	case grpcCanceled:
+		return 499
+	case grpcInvalidArgument, grpcFailedPrecondition, grpcOutOfRange:
+		return http.StatusBadRequest
+	case grpcDeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case grpcNotFound:
+		return http.StatusNotFound
+	case grpcAlreadyExists, grpcAborted:
+		return http.StatusConflict
+	case grpcPermissionDenied:
+		return http.StatusForbidden
+	case grpcResourceExhausted:
+		return http.StatusTooManyRequests
+	case grpcUnimplemented:
+		return http.StatusNotImplemented
+	case grpcUnavailable:
+		return http.StatusServiceUnavailable
+	case grpcUnauthenticated:
+		return http.StatusUnauthorized
+	}
+	return http.StatusInternalServerError
+}
+
+// newTransport returns a transport speaking the upstream protocol of a
+// service: grpc and h2c use HTTP/2, without TLS for http:// hosts; http1
+// never upgrades to HTTP/2; the default negotiates.
+func newTransport(protocol string) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	switch protocol {
+	case "grpc", "h2c":
+		t.Protocols = new(http.Protocols)
+		t.Protocols.SetHTTP2(true)
+		t.Protocols.SetUnencryptedHTTP2(true)
+	case "http1":
+		t.Protocols = new(http.Protocols)
+		t.Protocols.SetHTTP1(true)
+	}
+	return t
+}
+
+func isGRPCRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// grpcWriter marks the response to a gRPC client: JSONBadResponse writes a
+// gRPC status instead of a JSON body. status keeps the HTTP status of such
+// an error for metrics.
+type grpcWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (g *grpcWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+// grpcResponse finds the grpcWriter beneath the wrappers of w, if any.
+func grpcResponse(w http.ResponseWriter) *grpcWriter {
+	for {
+		switch v := w.(type) {
+		case *grpcWriter:
+			return v
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = v.Unwrap()
+		default:
+			return nil
+		}
+	}
+}
+
+// writeError answers with a trailers-only gRPC response carrying the
+// status that corresponds to an HTTP error. It is written through w so the
+// wrappers above the grpcWriter see it.
+func (g *grpcWriter) writeError(w http.ResponseWriter, message string, status int, detail interface{}) {
+	if s, ok := detail.(string); ok && s != "" {
+		message += ": " + s
+	}
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/grpc")
+	h.Set("Grpc-Status", strconv.Itoa(grpcCode(status)))
+	h.Set("Grpc-Message", grpcEncodeMessage(message))
+	g.status = status
+	w.WriteHeader(http.StatusOK)
+}
+
+// grpcCode maps the HTTP status of a gateway error to a gRPC code.
+func grpcCode(status int) int {
+	switch status {
+	case http.StatusBadRequest:
+		return grpcInvalidArgument
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusForbidden:
+		return grpcPermissionDenied
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return grpcUnimplemented
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		return grpcDeadlineExceeded
+	case http.StatusConflict:
+		return grpcAborted
+	case http.StatusRequestEntityTooLarge, http.StatusTooManyRequests:
+		return grpcResourceExhausted
+	case 499:
+		return grpcCanceled
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return grpcUnavailable
+	case http.StatusInternalServerError:
+		return grpcInternal
+	}
+	if status >= 400 && status < 500 {
+		return grpcFailedPrecondition
+	}
+	return grpcUnknown
+}
+
+// grpcEncodeMessage percent-encodes a Grpc-Message value as the gRPC HTTP/2
+// protocol requires.
+func grpcEncodeMessage(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+func validateProtocol(c *configIssues, protocol string, path []interface{}) {
+	switch protocol {
+	case "", "http1", "h2c", "grpc":
+	default:
+		c.addf(path, "unknown protocol %q, expected http1, h2c or grpc", protocol)
+	}
+}
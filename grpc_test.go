@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func h2cServer(t *testing.T, h http.Handler) *httptest.Server {
+	srv := httptest.NewUnstartedServer(h)
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetHTTP1(true)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestGRPC_TrailersAndStatusMapping(t *testing.T) {
+	upstream := h2cServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.Header.Get("Te") != "trailers" {
+			t.Errorf("upstream got %s with TE %q", r.Proto, r.Header.Get("Te"))
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("Grpc-Message", "ok")
+	}))
+	cfg, err := loadConfigFile(writeConfig(t, fmt.Sprintf(`services:
+  - name: recommendations
+    host: %s
+    prefix: /recommendations.v1.Recommender
+    protocol: grpc
+    auth: none
+  - name: private
+    host: %s
+    prefix: /private.v1.Private
+    protocol: grpc
+  - name: down
+    host: http://127.0.0.1:1
+    prefix: /down.v1.Down
+    protocol: grpc
+    auth: none
+`, upstream.URL, upstream.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw := h2cServer(t, setupGateway(t, cfg.Routes))
+
+	client := &http.Client{Transport: newTransport("h2c")}
+	call := func(path string) *http.Response {
+		req, _ := http.NewRequest(http.MethodPost, gw.URL+path, strings.NewReader("\x00\x00\x00\x00\x00"))
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("Te", "trailers")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	resp := call("/recommendations.v1.Recommender/List")
+	body, _ := io.ReadAll(resp.Body)
+	if resp.ProtoMajor != 2 || string(body) != "\x00\x00\x00\x00\x00" {
+		t.Errorf("expected the message back over HTTP/2, got %s %q", resp.Proto, body)
+	}
+	if resp.Trailer.Get("Grpc-Status") != "0" || resp.Trailer.Get("Grpc-Message") != "ok" {
+		t.Errorf("trailers not passed through: %v", resp.Trailer)
+	}
+
+	for _, c := range []struct {
+		path, code string
+	}{
+		{"/private.v1.Private/Get", "16"},
+		{"/down.v1.Down/Get", "14"},
+		{"/unknown.v1.Service/Get", "12"},
+	} {
+		resp := call(c.path)
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/grpc" ||
+			resp.Header.Get("Grpc-Status") != c.code || resp.Header.Get("Grpc-Message") == "" {
+			t.Errorf("%s: expected grpc-status %s, got %d %v", c.path, c.code, resp.StatusCode, resp.Header)
+		}
+	}
+}
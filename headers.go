@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// HeaderRules rewrite the headers of proxied requests or responses. They
+// run in the order rename, remove, set, add. Values of set and add may use
+// templates such as {{client_ip}}; see headerTemplateVars.
+type HeaderRules struct {
+	Set    map[string]string `yaml:"set"`
+	Add    map[string]string `yaml:"add"`
+	Remove []string          `yaml:"remove"`
+	Rename map[string]string `yaml:"rename"`
+}
+
+// headerTemplateVars are the plain template variables. Prefixed ones are
+// claim.<name> (JWT claim), param.<name> (route parameter) and
+// header.<name> (incoming request header).
+var headerTemplateVars = map[string]func(r *http.Request) string{
+	"client_ip":  getClientIP,
+	"request_id": func(r *http.Request) string { return r.Header.Get("X-Request-ID") },
+	"method":     func(r *http.Request) string { return r.Method },
+}
+
+type templatePart struct {
+	literal string
+	value   func(r *http.Request) string
+}
+
+// headerTemplate is a header value compiled once per route.
+type headerTemplate []templatePart
+
+func parseHeaderTemplate(s string) (headerTemplate, error) {
+	var t headerTemplate
+	for {
+		start := strings.Index(s, "{{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(s[start:], "}}")
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated template in %q", s)
+		}
+		if start > 0 {
+			t = append(t, templatePart{literal: s[:start]})
+		}
+		name := strings.TrimSpace(s[start+2 : start+end])
+		value, err := templateValue(name)
+		if err != nil {
+			return nil, err
+		}
+		t = append(t, templatePart{value: value})
+		s = s[start+end+2:]
+	}
+	if s != "" {
+		t = append(t, templatePart{literal: s})
+	}
+	return t, nil
+}
+
+func templateValue(name string) (func(r *http.Request) string, error) {
+	if f, ok := headerTemplateVars[name]; ok {
+		return f, nil
+	}
+	kind, key, ok := strings.Cut(name, ".")
+	if ok && key != "" {
+		switch kind {
+		case "claim":
+			return func(r *http.Request) string {
+				if c := claimsFromRequest(r); c != nil {
+					return c.Get(key)
+				}
+				return ""
+			}, nil
+		case "param":
+			return func(r *http.Request) string { return routeParams(r)[key] }, nil
+		case "header":
+			return func(r *http.Request) string { return r.Header.Get(key) }, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown template variable %q", name)
+}
+
+func (t headerTemplate) render(r *http.Request) string {
+	if len(t) == 1 && t[0].value == nil {
+		return t[0].literal
+	}
+	var b strings.Builder
+	for _, p := range t {
+		if p.value != nil {
+			b.WriteString(p.value(r))
+		} else {
+			b.WriteString(p.literal)
+		}
+	}
+	return b.String()
+}
+
+type headerValue struct {
+	name     string
+	template headerTemplate
+}
+
+// headerTransform is a compiled HeaderRules.
+type headerTransform struct {
+	rename [][2]string
+	remove []string
+	set    []headerValue
+	add    []headerValue
+}
+
+func compileHeaderRules(rules HeaderRules) (*headerTransform, error) {
+	if len(rules.Set)+len(rules.Add)+len(rules.Remove)+len(rules.Rename) == 0 {
+		return nil, nil
+	}
+	t := &headerTransform{}
+	for _, from := range sortedKeys(rules.Rename) {
+		t.rename = append(t.rename, [2]string{from, rules.Rename[from]})
+	}
+	t.remove = rules.Remove
+	for _, op := range []struct {
+		values map[string]string
+		into   *[]headerValue
+	}{{rules.Set, &t.set}, {rules.Add, &t.add}} {
+		for _, name := range sortedKeys(op.values) {
+			tmpl, err := parseHeaderTemplate(op.values[name])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			*op.into = append(*op.into, headerValue{name: name, template: tmpl})
+		}
+	}
+	return t, nil
+}
+
+// apply rewrites h. Templates are rendered against r, the request sent
+// upstream, which carries the client request's context.
+func (t *headerTransform) apply(h http.Header, r *http.Request) {
+	if t == nil {
+		return
+	}
+	for _, rn := range t.rename {
+		if v, ok := h[http.CanonicalHeaderKey(rn[0])]; ok {
+			h.Del(rn[0])
+			h[http.CanonicalHeaderKey(rn[1])] = v
+		}
+	}
+	for _, name := range t.remove {
+		h.Del(name)
+	}
+	for _, v := range t.set {
+		h.Set(v.name, v.template.render(r))
+	}
+	for _, v := range t.add {
+		h.Add(v.name, v.template.render(r))
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func validateHeaderRules(c *configIssues, rules HeaderRules, path []interface{}) {
+	for _, op := range []struct {
+		name   string
+		values map[string]string
+	}{{"set", rules.Set}, {"add", rules.Add}} {
+		for _, name := range sortedKeys(op.values) {
+			if _, err := parseHeaderTemplate(op.values[name]); err != nil {
+				c.add(err.Error(), appendPath(appendPath(path, op.name), name)...)
+			}
+		}
+	}
+	for _, from := range sortedKeys(rules.Rename) {
+		if strings.TrimSpace(rules.Rename[from]) == "" {
+			c.add("rename target must not be empty", appendPath(appendPath(path, "rename"), from)...)
+		}
+	}
+}
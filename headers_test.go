@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestHeaderRules_RequestAndResponse(t *testing.T) {
+	var got http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.Header().Set("Server", "nginx/1.2")
+		w.Header().Set("X-Powered-By", "PHP")
+		w.Header().Set("X-Legacy-Trace", "t-1")
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(upstream.Close)
+	u, _ := url.Parse(upstream.URL)
+	svc := &Service{Name: "hdr", URL: u, Prefix: "/hdr", Middlewares: []string{"auth"},
+		RequestHeaders: HeaderRules{
+			Set:    map[string]string{"X-Client-Version": "2", "X-Caller": "{{claim.user_id}}@{{client_ip}}"},
+			Add:    map[string]string{"X-Trace": "req-{{request_id}}"},
+			Remove: []string{"Cookie"},
+			Rename: map[string]string{"X-Old-Name": "X-New-Name"},
+		},
+		ResponseHeaders: HeaderRules{
+			Remove: []string{"Server", "X-Powered-By"},
+			Rename: map[string]string{"X-Legacy-Trace": "X-Trace-ID"},
+		},
+	}
+	gw := setupGateway(t, map[string]*Service{"/hdr": svc})
+
+	req := httptest.NewRequest(http.MethodGet, "/hdr/x", nil)
+	req.RemoteAddr = "203.0.113.9:4000"
+	req.Header.Set("Authorization", "Bearer "+signedToken(t, jwt.MapClaims{"user_id": "u42"}))
+	req.Header.Set("Cookie", "session=secret")
+	req.Header.Set("X-Old-Name", "legacy")
+	w := httptest.NewRecorder()
+	gw.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	if got.Get("X-Client-Version") != "2" || got.Get("X-Caller") != "u42@203.0.113.9" {
+		t.Errorf("set rules not applied: %v", got)
+	}
+	if got.Get("X-Trace") != "req-"+got.Get("X-Request-ID") || got.Get("X-Request-ID") == "" {
+		t.Errorf("request id template not rendered: %q", got.Get("X-Trace"))
+	}
+	if got.Get("Cookie") != "" || got.Get("X-Old-Name") != "" || got.Get("X-New-Name") != "legacy" {
+		t.Errorf("remove/rename not applied: %v", got)
+	}
+	if w.Header().Get("Server") != "" || w.Header().Get("X-Powered-By") != "" || w.Header().Get("X-Trace-ID") != "t-1" {
+		t.Errorf("response rules not applied: %v", w.Header())
+	}
+}
+
+func TestLoadConfigFile_HeaderTemplateErrors(t *testing.T) {
+	path := writeConfig(t, "services:\n  - name: a\n    host: http://localhost:1\n    request_headers:\n      set:\n        X-A: \"{{nope}}\"\n        X-B: \"{{client_ip\"\n")
+	_, err := loadConfigFile(path)
+	if err == nil {
+		t.Fatal("expected template errors")
+	}
+	ve := err.(ValidationError)
+	if len(ve) != 2 || ve[0].Line != 6 || ve[0].Path != "services[0].request_headers.set.X-A" {
+		t.Fatalf("unexpected errors: %v", err)
+	}
+}
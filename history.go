@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+type ReloadConfig struct {
+	HistorySize int              `yaml:"history_size"`
+	HealthGate  HealthGateConfig `yaml:"health_gate"`
+}
+
+// HealthGateConfig rolls a reload back when the services it changed start
+// failing. The gate watches for Window after each reload.
+type HealthGateConfig struct {
+	Enabled      bool          `yaml:"enabled"`
+	Window       time.Duration `yaml:"window"`
+	MaxErrorRate float64       `yaml:"max_error_rate"`
+	MinRequests  int64         `yaml:"min_requests"`
+}
+
+const defaultHistorySize = 20
+
+type ConfigDiff struct {
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	Changed []string `json:"changed,omitempty"`
+}
+
+func (d ConfigDiff) services() []string {
+	return append(append([]string{}, d.Added...), d.Changed...)
+}
+
+type ReloadRecord struct {
+	Generation uint64     `json:"generation,omitempty"`
+	Hash       string     `json:"hash"`
+	Timestamp  time.Time  `json:"timestamp"`
+	Origin     string     `json:"origin"`
+	Outcome    string     `json:"outcome"`
+	Error      string     `json:"error,omitempty"`
+	Diff       ConfigDiff `json:"diff"`
+
+	source configSource
+}
+
+type reloadHistory struct {
+	mu      sync.Mutex
+	size    int
+	records []*ReloadRecord
+}
+
+func (h *reloadHistory) add(rec *ReloadRecord) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	size := h.size
+	if size <= 0 {
+		size = defaultHistorySize
+	}
+	h.records = append(h.records, rec)
+	if over := len(h.records) - size; over > 0 {
+		h.records = append([]*ReloadRecord(nil), h.records[over:]...)
+	}
+}
+
+func (h *reloadHistory) resize(size int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.size = size
+}
+
+// list returns copies of the records, newest first.
+func (h *reloadHistory) list() []ReloadRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := make([]ReloadRecord, 0, len(h.records))
+	for i := len(h.records) - 1; i >= 0; i-- {
+		out = append(out, *h.records[i])
+	}
+	return out
+}
+
+// previousApplied returns the last successfully applied record before
+// generation, which is what a rollback restores.
+func (h *reloadHistory) previousApplied(generation uint64) *ReloadRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := len(h.records) - 1; i >= 0; i-- {
+		r := h.records[i]
+		if r.Generation != 0 && r.Generation < generation && r.Outcome == "applied" {
+			return r
+		}
+	}
+	return nil
+}
+
+func (h *reloadHistory) markRolledBack(generation uint64, reason string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, r := range h.records {
+		if r.Generation == generation {
+			r.Outcome = "rolled_back"
+			r.Error = reason
+		}
+	}
+}
+
+// settle marks a generation that passed (or outlived) its health gate.
+func (h *reloadHistory) settle(generation uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, r := range h.records {
+		if r.Generation == generation && r.Outcome == "watching" {
+			r.Outcome = "applied"
+		}
+	}
+}
+
+func diffServices(prev, next map[string]*Service) ConfigDiff {
+	before := map[string]string{}
+	for _, svc := range prev {
+		before[svc.Name] = serviceHash(svc)
+	}
+	var d ConfigDiff
+	after := map[string]bool{}
+	for _, svc := range next {
+		after[svc.Name] = true
+		h, ok := before[svc.Name]
+		switch {
+		case !ok:
+			d.Added = append(d.Added, svc.Name)
+		case h != serviceHash(svc):
+			d.Changed = append(d.Changed, svc.Name)
+		}
+	}
+	for name := range before {
+		if !after[name] {
+			d.Removed = append(d.Removed, name)
+		}
+	}
+	sort.Strings(d.Added)
+	sort.Strings(d.Removed)
+	sort.Strings(d.Changed)
+	return d
+}
+
+// watchHealth rolls the reload of rec back if its added or changed services
+// exceed the gate's error rate before the window closes. It gives up as
+// soon as another generation replaces rec.
+func (g *Gateway) watchHealth(rec *ReloadRecord, gate HealthGateConfig) {
+	services := rec.Diff.services()
+	if !gate.Enabled || len(services) == 0 {
+		return
+	}
+	window := gate.Window
+	if window <= 0 {
+		window = time.Minute
+	}
+	maxRate := gate.MaxErrorRate
+	if maxRate <= 0 {
+		maxRate = 0.5
+	}
+	minRequests := gate.MinRequests
+	if minRequests <= 0 {
+		minRequests = 10
+	}
+	interval := window / 6
+	if interval < 250*time.Millisecond {
+		interval = 250 * time.Millisecond
+	}
+
+	baseReq, baseErr := g.metrics.totals(services)
+	deadline := time.Now().Add(window)
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for range t.C {
+			if live := g.live.Load(); live == nil || live.generation != rec.Generation {
+				g.history.settle(rec.Generation)
+				return
+			}
+			req, errs := g.metrics.totals(services)
+			req, errs = req-baseReq, errs-baseErr
+			if req >= minRequests && float64(errs)/float64(req) > maxRate {
+				reason := fmt.Sprintf("error rate %.0f%% over %d requests for %v", 100*float64(errs)/float64(req), req, services)
+				g.rollback(rec, reason)
+				return
+			}
+			if time.Now().After(deadline) {
+				g.history.settle(rec.Generation)
+				return
+			}
+		}
+	}()
+}
+
+// rollback restores the generation applied before rec.
+func (g *Gateway) rollback(rec *ReloadRecord, reason string) {
+	g.configMu.Lock()
+	defer g.configMu.Unlock()
+
+	if live := g.live.Load(); live == nil || live.generation != rec.Generation {
+		return
+	}
+	prev := g.history.previousApplied(rec.Generation)
+	if prev == nil {
+		g.logger.Warning("rollback", fmt.Sprintf("generation %d is unhealthy (%s) but there is nothing to roll back to", rec.Generation, reason))
+		return
+	}
+	g.logger.Warning("rollback", fmt.Sprintf("rolling back generation %d to %d: %s", rec.Generation, prev.Generation, reason))
+	g.history.markRolledBack(rec.Generation, reason)
+	if err := g.applySourceLocked(prev.source, "rollback"); err != nil {
+		g.logger.Error("rollback", fmt.Sprintf("rollback of generation %d failed: %v", rec.Generation, err), err)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReloadHistory_RecordsDiffAndFailures(t *testing.T) {
+	path := writeConfig(t, "services:\n  - name: a\n    host: http://localhost:1\n  - name: b\n    host: http://localhost:2\n")
+	gw := setupGateway(t, map[string]*Service{})
+	if err := gw.reloadFromPath(path); err != nil {
+		t.Fatal(err)
+	}
+
+	os.WriteFile(path, []byte("services:\n  - name: a\n    host: http://localhost:9\n  - name: c\n    host: http://localhost:3\n"), 0644)
+	if err := gw.reloadFromPath(path); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(path, []byte("services:\n  - name: a\n    hots: typo\n"), 0644)
+	if err := gw.reloadFromPath(path); err == nil {
+		t.Fatal("expected invalid config to be rejected")
+	}
+
+	h := gw.history.list()
+	if len(h) != 3 {
+		t.Fatalf("expected 3 history records, got %d", len(h))
+	}
+	if h[0].Outcome != "rejected" || h[0].Error == "" {
+		t.Errorf("newest record should be the rejected reload, got %+v", h[0])
+	}
+	d := h[1].Diff
+	if len(d.Added) != 1 || d.Added[0] != "c" || len(d.Removed) != 1 || d.Removed[0] != "b" || len(d.Changed) != 1 || d.Changed[0] != "a" {
+		t.Errorf("unexpected diff %+v", d)
+	}
+}
+
+func TestHealthGate_RollsBackUnhealthyReload(t *testing.T) {
+	gate := "reload:\n  health_gate:\n    enabled: true\n    window: 2s\n    max_error_rate: 0.5\n    min_requests: 4\n"
+	path := writeConfig(t, gate+"services:\n  - name: a\n    host: http://localhost:1\n")
+	gw := setupGateway(t, map[string]*Service{})
+	if err := gw.reloadFromPath(path); err != nil {
+		t.Fatal(err)
+	}
+	good := gw.live.Load().generation
+
+	os.WriteFile(path, []byte(gate+"services:\n  - name: a\n    host: http://localhost:2\n"), 0644)
+	if err := gw.reloadFromPath(path); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		gw.metrics.observe("a", http.StatusBadGateway, time.Millisecond)
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		live := gw.live.Load()
+		if live.generation > good+1 {
+			// rollback holds configMu until it has finished logging.
+			gw.configMu.Lock()
+			gw.configMu.Unlock()
+			if host := live.cfg.Routes["/a"].Host; host != "http://localhost:1" {
+				t.Fatalf("rollback restored wrong config: %s", host)
+			}
+			if h := gw.history.list(); h[1].Outcome != "rolled_back" {
+				t.Fatalf("bad generation should be marked rolled_back, got %+v", h[1])
+			}
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("expected automatic rollback")
+}
+
+func TestReload_RejectedConfigChangesNothing(t *testing.T) {
+	dir := t.TempDir()
+	path := writeConfig(t, "quotas: {default_tier: free}\nservices:\n  - name: a\n    host: http://localhost:1\n")
+	gw := setupGateway(t, map[string]*Service{})
+	if err := gw.reloadFromPath(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// The quota store opens, but the blocklist does not exist.
+	os.WriteFile(path, []byte(fmt.Sprintf(`quotas:
+  default_tier: pro
+  store: {type: file, path: %s}
+ip_filter: {blocklist_file: %s}
+services:
+  - name: a
+    host: http://localhost:1
+`, filepath.Join(dir, "quotas.json"), filepath.Join(dir, "missing.txt"))), 0644)
+	if err := gw.reloadFromPath(path); err == nil {
+		t.Fatal("expected the missing blocklist to reject the reload")
+	}
+	gw.quotas.mu.Lock()
+	defer gw.quotas.mu.Unlock()
+	if gw.quotas.cfg.DefaultTier != "free" || gw.quotas.storeCfg.Type != "" {
+		t.Errorf("rejected quota config went live: tier %q, store %+v", gw.quotas.cfg.DefaultTier, gw.quotas.storeCfg)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// sourceFile is one file of a configuration as it was read from disk.
+type sourceFile struct {
+	path string
+	data []byte
+}
+
+// configSource is every file that makes up one configuration: the file or
+// directory given with -config, followed by the files it includes. The
+// services of all files are merged; any other top-level key may only be set
+// in one of them.
+type configSource struct {
+	root  string
+	dir   bool
+	files []sourceFile
+}
+
+func (s configSource) hash() string {
+	h := sha256.New()
+	for _, f := range s.files {
+		fmt.Fprintf(h, "%s\x00%d\x00", f.path, len(f.data))
+		h.Write(f.data)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// defaultFile is where services added through the admin API are written:
+// the main file, or <name>.yml when the configuration is a directory.
+func (s configSource) defaultFile(service string) string {
+	if s.dir {
+		return filepath.Join(s.root, service+".yml")
+	}
+	return s.root
+}
+
+func singleFileSource(path string, data []byte) configSource {
+	return configSource{root: path, files: []sourceFile{{path: path, data: data}}}
+}
+
+func isConfigFile(name string) bool {
+	ext := filepath.Ext(name)
+	return ext == ".yml" || ext == ".yaml"
+}
+
+// configFiles lists the files of the configuration at path, which must be
+// absolute. A directory contributes every *.yml and *.yaml file below it,
+// skipping hidden entries such as the ..data links of a Kubernetes volume.
+// A file contributes itself and the files matched by its include globs,
+// which are relative to the file's directory.
+func configFiles(path string) (files []string, dir bool, err error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, false, err
+	}
+	if fi.IsDir() {
+		err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if p != path && strings.HasPrefix(d.Name(), ".") {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if isConfigFile(p) && !d.IsDir() {
+				if st, err := os.Stat(p); err == nil && st.Mode().IsRegular() {
+					files = append(files, p)
+				}
+			}
+			return nil
+		})
+		if err == nil && len(files) == 0 {
+			err = fmt.Errorf("no *.yml or *.yaml files in %s", path)
+		}
+		return files, true, err
+	}
+
+	files = []string{path}
+	patterns, err := includePatterns(path)
+	if err != nil {
+		return nil, false, err
+	}
+	seen := map[string]bool{path: true}
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, false, fmt.Errorf("%s: include %q: %w", path, pattern, err)
+		}
+		sort.Strings(matches)
+		for _, m := range matches {
+			if !seen[m] {
+				seen[m] = true
+				files = append(files, m)
+			}
+		}
+	}
+	return files, false, nil
+}
+
+// includePatterns returns the absolute include globs of the file at path.
+// A file that does not parse has none; parseConfig reports why.
+func includePatterns(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var head struct {
+		Include []string `yaml:"include"`
+	}
+	_ = yaml.Unmarshal(data, &head)
+	patterns := make([]string, 0, len(head.Include))
+	for _, p := range head.Include {
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(filepath.Dir(path), p)
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// readConfigSource reads every file of the configuration at path.
+func readConfigSource(path string) (configSource, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return configSource{}, err
+	}
+	files, dir, err := configFiles(abs)
+	if err != nil {
+		return configSource{}, err
+	}
+	src := configSource{root: abs, dir: dir}
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return configSource{}, err
+		}
+		src.files = append(src.files, sourceFile{path: f, data: data})
+	}
+	return src, nil
+}
+
+// configWatchSet returns the directories to watch for the configuration at
+// path and the files it reads, such as descriptor sets, and a filter for
+// the event names that concern them.
+func configWatchSet(path string, extra []string) (dirs []string, match func(name string) bool) {
+	addDir := func(d string) {
+		for _, have := range dirs {
+			if have == d {
+				return
+			}
+		}
+		dirs = append(dirs, d)
+	}
+	read := map[string]bool{}
+	for _, f := range extra {
+		if abs, err := filepath.Abs(f); err == nil {
+			read[abs] = true
+			addDir(filepath.Dir(abs))
+		}
+	}
+
+	fi, err := os.Stat(path)
+	if err == nil && fi.IsDir() {
+		_ = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+			if err == nil && d.IsDir() {
+				if p != path && strings.HasPrefix(d.Name(), ".") {
+					return filepath.SkipDir
+				}
+				addDir(p)
+			}
+			return nil
+		})
+		return dirs, func(name string) bool {
+			return read[name] || strings.HasPrefix(name, path+string(filepath.Separator)) &&
+				!strings.HasPrefix(filepath.Base(name), ".")
+		}
+	}
+
+	addDir(filepath.Dir(path))
+	if target, err := filepath.EvalSymlinks(path); err == nil {
+		addDir(filepath.Dir(target))
+	}
+	patterns, _ := includePatterns(path)
+	for _, p := range patterns {
+		// Watch the deepest directory of the glob that has no wildcard.
+		d := filepath.Dir(p)
+		for strings.ContainsAny(d, "*?[") {
+			d = filepath.Dir(d)
+		}
+		addDir(d)
+	}
+	if files, _, err := configFiles(path); err == nil {
+		for _, f := range files {
+			addDir(filepath.Dir(f))
+		}
+	}
+	return dirs, func(name string) bool {
+		if name == path || read[name] {
+			return true
+		}
+		for _, p := range patterns {
+			if ok, _ := filepath.Match(p, name); ok {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// mergeDocuments combines the parsed files of a configuration into one
+// document. Services are concatenated in file order; every other top-level
+// key must be set in a single file. The file each merged node came from is
+// recorded so errors can name it.
+func mergeDocuments(c *configIssues, src configSource, docs []*yaml.Node) *yaml.Node {
+	merged := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	services := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	owner := map[string]string{}
+
+	for i, doc := range docs {
+		file := src.files[i].path
+		if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+			continue
+		}
+		m := doc.Content[0]
+		for j := 0; j+1 < len(m.Content); j += 2 {
+			key, value := m.Content[j], m.Content[j+1]
+			switch {
+			case key.Value == "services" && value.Kind == yaml.SequenceNode:
+				for _, item := range value.Content {
+					c.origins[item] = file
+					services.Content = append(services.Content, item)
+				}
+			case key.Value == "include" && (i > 0 || src.dir):
+				c.errs = append(c.errs, ConfigError{File: file, Line: key.Line, Column: key.Column, Path: "include",
+					Message: "include is only supported in the main configuration file, not in a config directory or an included file"})
+			case owner[key.Value] != "":
+				c.errs = append(c.errs, ConfigError{File: file, Line: key.Line, Column: key.Column, Path: key.Value,
+					Message: fmt.Sprintf("%s is already set in %s", key.Value, owner[key.Value])})
+			default:
+				owner[key.Value] = file
+				c.origins[value] = file
+				merged.Content = append(merged.Content, key, value)
+			}
+		}
+	}
+	if len(services.Content) > 0 {
+		merged.Content = append(merged.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "services"}, services)
+	}
+	return &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{merged}}
+}
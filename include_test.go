@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLoadConfigFile_Directory(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"gateway.yml":         "trusted_proxies: [10.0.0.0/8]\n",
+		"services.d/user.yml": "services:\n  - name: user\n    host: http://localhost:1\n",
+		"services.d/bill.yml": "services:\n  - name: bill\n    host: http://localhost:2\n",
+		".hidden/skip.yml":    "services: [{name: ghost, host: 'http://localhost:3'}]\n",
+	})
+	cfg, err := loadConfigFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Routes) != 2 || cfg.Routes["/user"] == nil || cfg.Routes["/bill"] == nil {
+		t.Fatalf("expected user and bill services, got %v", cfg.Routes)
+	}
+
+	writeFiles(t, dir, map[string]string{
+		"services.d/copy.yml": "trusted_proxies: []\nservices:\n  - name: user\n    host: http://localhost:4\n",
+	})
+	_, err = loadConfigFile(dir)
+	var ve ValidationError
+	if !errors.As(err, &ve) {
+		t.Fatalf("expected ValidationError, got %v", err)
+	}
+	// Files are merged in path order, so the second user is the one in user.yml.
+	var dupName, dupKey bool
+	for _, e := range ve {
+		switch filepath.Base(e.File) {
+		case "user.yml":
+			dupName = dupName || (e.Path == "services[0].name" && strings.Contains(e.Message, "copy.yml:3"))
+		case "copy.yml":
+			dupKey = dupKey || (e.Path == "trusted_proxies" && strings.Contains(e.Message, "gateway.yml"))
+		}
+	}
+	if !dupName || !dupKey {
+		t.Fatalf("errors should name both files of each duplicate, got:\n%v", err)
+	}
+}
+
+func TestWatchConfig_IncludeGlob(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"aimas.yml":           "include: [services.d/*.yml]\nservices:\n  - name: a\n    host: http://localhost:1\n",
+		"services.d/keep.txt": "",
+	})
+	gw := setupGateway(t, map[string]*Service{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := gw.WatchConfig(filepath.Join(dir, "aimas.yml"), ctx); err != nil {
+		t.Fatal(err)
+	}
+	waitForService(t, gw, "/a")
+
+	writeFiles(t, dir, map[string]string{"services.d/b.yml": "services:\n  - name: b\n    host: http://localhost:2\n"})
+	waitForService(t, gw, "/b")
+}
+
+func TestAdmin_PersistsToOwningFile(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"main.yml": "services:\n  - name: a\n    host: http://localhost:1\n",
+		"team.yml": "services:\n  - name: b\n    host: http://localhost:2\n",
+	})
+	gw := setupGateway(t, map[string]*Service{})
+	if err := gw.reloadFromPath(dir); err != nil {
+		t.Fatal(err)
+	}
+	admin := gw.AdminHandler("admin-secret")
+
+	if w := adminRequest(t, admin, http.MethodPost, "/admin/services/b/maintenance?persist=true", `{"enabled":true}`); w.Code != http.StatusOK {
+		t.Fatalf("maintenance: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := adminRequest(t, admin, http.MethodPost, "/admin/services?persist=true", `{"name":"c","host":"http://localhost:3"}`); w.Code != http.StatusCreated {
+		t.Fatalf("add: expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+
+	team, _ := os.ReadFile(filepath.Join(dir, "team.yml"))
+	if !strings.Contains(string(team), "maintenance: true") {
+		t.Errorf("team.yml should hold the change to b:\n%s", team)
+	}
+	main, _ := os.ReadFile(filepath.Join(dir, "main.yml"))
+	if string(main) != "services:\n  - name: a\n    host: http://localhost:1\n" {
+		t.Errorf("main.yml should be untouched:\n%s", main)
+	}
+	if c, err := os.ReadFile(filepath.Join(dir, "c.yml")); err != nil || !strings.Contains(string(c), "name: c") {
+		t.Errorf("new service should get its own file, got %q (%v)", c, err)
+	}
+}
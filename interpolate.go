@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// interpolate expands ${VAR}, ${VAR:-default} and ${file:/path} references
+// in s. "$$" produces a literal "$".
+func interpolate(s string) (string, error) {
+	if !strings.Contains(s, "$") {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '$' || i+1 >= len(s) {
+			b.WriteByte(c)
+			continue
+		}
+		if s[i+1] == '$' {
+			b.WriteByte('$')
+			i++
+			continue
+		}
+		if s[i+1] != '{' {
+			b.WriteByte(c)
+			continue
+		}
+		end := strings.IndexByte(s[i+2:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated reference in %q", s)
+		}
+		expr := s[i+2 : i+2+end]
+		v, err := resolveReference(expr)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(v)
+		i += end + 2
+	}
+	return b.String(), nil
+}
+
+func resolveReference(expr string) (string, error) {
+	if path, ok := strings.CutPrefix(expr, "file:"); ok {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("cannot read secret file %s: %w", path, err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+
+	name, def, hasDefault := strings.Cut(expr, ":-")
+	if name == "" {
+		return "", fmt.Errorf("empty variable reference ${%s}", expr)
+	}
+	if v, ok := os.LookupEnv(name); ok && (v != "" || !hasDefault) {
+		return v, nil
+	}
+	if hasDefault {
+		return def, nil
+	}
+	return "", fmt.Errorf("unresolved variable ${%s}", name)
+}
+
+// interpolateNode expands references in every scalar value below n and
+// reports whether all of them resolved. Errors name the service (when
+// inside services[]) and the field path.
+func interpolateNode(c *configIssues, n *yaml.Node) bool {
+	before := len(c.errs)
+	walkInterpolate(c, n, "", "")
+	return len(c.errs) == before
+}
+
+func walkInterpolate(c *configIssues, n *yaml.Node, path, service string) {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		for _, child := range n.Content {
+			walkInterpolate(c, child, path, service)
+		}
+	case yaml.MappingNode:
+		if service == "" && strings.HasPrefix(path, "services[") && !strings.Contains(path, ".") {
+			service = serviceNameOf(n, path)
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := n.Content[i].Value
+			child := key
+			if path != "" {
+				child = path + "." + key
+			}
+			walkInterpolate(c, n.Content[i+1], child, service)
+		}
+	case yaml.SequenceNode:
+		for i, child := range n.Content {
+			walkInterpolate(c, child, path+"["+strconv.Itoa(i)+"]", service)
+		}
+	case yaml.ScalarNode:
+		v, err := interpolate(n.Value)
+		if err != nil {
+			msg := fmt.Sprintf("field %s: %v", path, err)
+			if service != "" {
+				field := strings.TrimPrefix(path, servicePathPrefix(path)+".")
+				msg = fmt.Sprintf("service %s: field %s: %v", service, field, err)
+			}
+			c.errs = append(c.errs, ConfigError{File: c.file, Line: n.Line, Column: n.Column, Message: msg})
+			return
+		}
+		if v != n.Value {
+			if c.interpolated != nil {
+				c.interpolated[n] = n.Value
+			}
+			n.Value = v
+			// Let plain scalars be re-resolved so "${PORT}" can fill an int.
+			if n.Style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle|yaml.LiteralStyle|yaml.FoldedStyle) == 0 {
+				n.Tag = ""
+			}
+		}
+	}
+}
+
+// interpolatedFields collects the field paths below n, such as
+// request_headers.set.Authorization or backends[0].host, whose values were
+// interpolated, with the text they were written as.
+func interpolatedFields(c *configIssues, n *yaml.Node, path string, out map[string]string) {
+	switch n.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			child := n.Content[i].Value
+			if path != "" {
+				child = path + "." + child
+			}
+			interpolatedFields(c, n.Content[i+1], child, out)
+		}
+	case yaml.SequenceNode:
+		for i, child := range n.Content {
+			interpolatedFields(c, child, path+"["+strconv.Itoa(i)+"]", out)
+		}
+	case yaml.ScalarNode:
+		if raw, ok := c.interpolated[n]; ok {
+			out[path] = raw
+		}
+	}
+}
+
+func serviceNameOf(n *yaml.Node, path string) string {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == "name" {
+			if v, err := interpolate(n.Content[i+1].Value); err == nil && v != "" {
+				return v
+			}
+		}
+	}
+	return path
+}
+
+// servicePathPrefix returns the "services[N]" part of a field path.
+func servicePathPrefix(path string) string {
+	if !strings.HasPrefix(path, "services[") {
+		return ""
+	}
+	if i := strings.IndexByte(path, ']'); i >= 0 {
+		return path[:i+1]
+	}
+	return ""
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+type IPFilterConfig struct {
+	Allow         []string `yaml:"allow"`
+	Deny          []string `yaml:"deny"`
+	BlocklistFile string   `yaml:"blocklist_file"`
+}
+
+// defaultTrustedProxies is used when trusted_proxies is not configured:
+// loopback and private ranges, where platform load balancers live.
+var defaultTrustedProxies = []string{
+	"127.0.0.0/8", "::1/128",
+	"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7",
+}
+
+type cidrSet []netip.Prefix
+
+func parseCIDRs(entries []string) (cidrSet, error) {
+	var out cidrSet
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		if strings.Contains(e, "/") {
+			p, err := netip.ParsePrefix(e)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q: %w", e, err)
+			}
+			out = append(out, p.Masked())
+			continue
+		}
+		a, err := netip.ParseAddr(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP %q: %w", e, err)
+		}
+		out = append(out, netip.PrefixFrom(a, a.BitLen()))
+	}
+	return out, nil
+}
+
+func (c cidrSet) contains(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, p := range c {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type ipFilter struct {
+	allow cidrSet
+	deny  cidrSet
+}
+
+func compileIPFilter(cfg IPFilterConfig) (*ipFilter, error) {
+	allow, err := parseCIDRs(cfg.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parseCIDRs(cfg.Deny)
+	if err != nil {
+		return nil, err
+	}
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	return &ipFilter{allow: allow, deny: deny}, nil
+}
+
+// permits reports whether ip passes the filter. Deny entries win over allow
+// entries; an empty allow list admits everything not denied.
+func (f *ipFilter) permits(ip netip.Addr) bool {
+	if f == nil {
+		return true
+	}
+	if !ip.IsValid() {
+		return len(f.allow) == 0
+	}
+	if f.deny.contains(ip) {
+		return false
+	}
+	return len(f.allow) == 0 || f.allow.contains(ip)
+}
+
+type clientIPKey struct{}
+
+func withClientIP(r *http.Request, ip string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip))
+}
+
+// resolveClientIP walks X-Forwarded-For from the right, skipping hops that
+// are trusted proxies. Entries added by untrusted peers are never believed.
+func resolveClientIP(r *http.Request, trusted cidrSet) string {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(remote)
+	if err != nil || !trusted.contains(addr) {
+		return remote
+	}
+
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, h := range strings.Split(v, ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				hops = append(hops, h)
+			}
+		}
+	}
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		a, err := netip.ParseAddr(hops[i])
+		if err != nil {
+			break
+		}
+		client = a.Unmap().String()
+		if !trusted.contains(a) {
+			break
+		}
+	}
+	return client
+}
+
+func (g *Gateway) denyIP(w http.ResponseWriter, ip string) {
+	JSONBadResponse(w, "access denied", http.StatusForbidden, fmt.Sprintf("client %s is not allowed", ip))
+}
+
+func (g *Gateway) IPFilterMiddleware(filter *ipFilter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if filter == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := getClientIP(r)
+			addr, _ := netip.ParseAddr(ip)
+			if !filter.permits(addr) {
+				g.denyIP(w, ip)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// blocklist is a file of IPs or CIDRs, one per line, watched independently
+// of aimas.yml so abusive clients can be blocked without a config reload.
+type blocklist struct {
+	path    string
+	entries atomic.Pointer[cidrSet]
+	cancel  context.CancelFunc
+	logger  *Log
+}
+
+func loadBlocklistFile(path string) (cidrSet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		lines = append(lines, line)
+	}
+	return parseCIDRs(lines)
+}
+
+func startBlocklist(path string, logger *Log) (*blocklist, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	set, err := loadBlocklistFile(abs)
+	if err != nil {
+		return nil, fmt.Errorf("blocklist %s: %w", path, err)
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := w.Add(filepath.Dir(abs)); err != nil {
+		_ = w.Close()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &blocklist{path: abs, cancel: cancel, logger: logger}
+	b.entries.Store(&set)
+
+	go func() {
+		defer w.Close()
+		debounce := time.NewTimer(0)
+		if !debounce.Stop() {
+			<-debounce.C
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if filepath.Base(ev.Name) != filepath.Base(abs) {
+					continue
+				}
+				debounce.Reset(200 * time.Millisecond)
+			case <-debounce.C:
+				set, err := loadBlocklistFile(abs)
+				if err != nil {
+					b.logger.Warning("blocklist", fmt.Sprintf("blocklist reload failed: %v", err))
+					continue
+				}
+				b.entries.Store(&set)
+				b.logger.Info("blocklist", fmt.Sprintf("blocklist reloaded: %d entries", len(set)))
+			case err := <-w.Errors:
+				b.logger.Warning("blocklist", fmt.Sprintf("fsnotify error: %v", err))
+			}
+		}
+	}()
+	return b, nil
+}
+
+func (b *blocklist) contains(ip netip.Addr) bool {
+	if b == nil || !ip.IsValid() {
+		return false
+	}
+	return b.entries.Load().contains(ip)
+}
+
+func (b *blocklist) Close() {
+	if b != nil {
+		b.cancel()
+	}
+}
+
+// networkPolicy is the gateway-wide part of the IP configuration, swapped
+// atomically on reload.
+type networkPolicy struct {
+	trusted cidrSet
+	filter  *ipFilter
+}
+
+type blocklistHolder struct {
+	mu      sync.Mutex
+	current atomic.Pointer[blocklist]
+}
+
+// blocklistUpdate is the blocklist a configuration asks for: keep the
+// current one, or switch to next, which is nil to stop blocking.
+type blocklistUpdate struct {
+	keep bool
+	next *blocklist
+}
+
+// prepare starts watching path when it is not the current blocklist,
+// without making it current. An empty path stops watching on commit.
+func (h *blocklistHolder) prepare(path string, logger *Log) (blocklistUpdate, error) {
+	if path == "" {
+		return blocklistUpdate{}, nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if abs, _ := filepath.Abs(path); h.current.Load() != nil && h.current.Load().path == abs {
+		return blocklistUpdate{keep: true}, nil
+	}
+	b, err := startBlocklist(path, logger)
+	if err != nil {
+		return blocklistUpdate{}, err
+	}
+	return blocklistUpdate{next: b}, nil
+}
+
+func (h *blocklistHolder) commit(u blocklistUpdate) {
+	if u.keep {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.current.Swap(u.next).Close()
+}
+
+func (h *blocklistHolder) get() *blocklist {
+	return h.current.Load()
+}
+
+func (h *blocklistHolder) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.current.Swap(nil).Close()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveClientIP_TrustedProxies(t *testing.T) {
+	trusted, _ := parseCIDRs([]string{"10.0.0.0/8"})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.1.2.3:5000"
+	req.Header.Set("X-Forwarded-For", "1.1.1.1, 203.0.113.7, 10.9.9.9")
+	if got := resolveClientIP(req, trusted); got != "203.0.113.7" {
+		t.Fatalf("expected first untrusted hop, got %s", got)
+	}
+
+	req.RemoteAddr = "198.51.100.1:5000"
+	if got := resolveClientIP(req, trusted); got != "198.51.100.1" {
+		t.Fatalf("forwarded header from untrusted peer must be ignored, got %s", got)
+	}
+}
+
+func TestGateway_IPFilter(t *testing.T) {
+	mock := mockService(t, "ok", http.StatusOK)
+	svcURL, _ := url.Parse(mock.URL)
+
+	svcFilter, _ := compileIPFilter(IPFilterConfig{Allow: []string{"192.0.2.0/24"}})
+	service := &Service{Name: "logs", URL: svcURL, Prefix: "/logs", ipFilter: svcFilter}
+	gw := setupGateway(t, map[string]*Service{"/logs": service})
+
+	globalFilter, _ := compileIPFilter(IPFilterConfig{Deny: []string{"198.51.100.0/24"}})
+	gw.network.Store(&networkPolicy{filter: globalFilter})
+
+	req := httptest.NewRequest(http.MethodGet, "/logs/x", nil)
+	req.RemoteAddr = "198.51.100.20:1234"
+	w := httptest.NewRecorder()
+	gw.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("global deny: expected 403, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/logs/x", nil)
+	req.RemoteAddr = "203.0.113.5:1234"
+	w = httptest.NewRecorder()
+	gw.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("service allow list: expected 403, got %d", w.Code)
+	}
+}
+
+func TestBlocklistFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocked.txt")
+	if err := os.WriteFile(path, []byte("# abusive\n203.0.113.0/24\n2001:db8::1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	set, err := loadBlocklistFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(set) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(set))
+	}
+}
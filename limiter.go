@@ -1,7 +1,6 @@
 package main
 
 import (
-	"net"
 	"net/http"
 	"strings"
 	"sync"
@@ -12,6 +11,8 @@ import (
 
 type clientLimiter struct {
 	limiter  *rate.Limiter
+	limit    rate.Limit
+	burst    int
 	lastSeen time.Time
 }
 
@@ -31,11 +32,18 @@ func (r *RateLimiter) getRateLimiter(clientID string, limit rate.Limit, burst in
 	cl, exists := r.limiters[clientID]
 	if !exists {
 		limiter := rate.NewLimiter(limit, burst)
-		r.limiters[clientID] = &clientLimiter{limiter, time.Now()}
+		r.limiters[clientID] = &clientLimiter{limiter: limiter, limit: limit, burst: burst, lastSeen: time.Now()}
 		return limiter
 	}
 
 	cl.lastSeen = time.Now()
+	if cl.limit != limit || cl.burst != burst {
+		// Each bucket belongs to one service or route, so its limit only
+		// changes with a reload.
+		cl.limiter.SetLimit(limit)
+		cl.limiter.SetBurst(burst)
+		cl.limit, cl.burst = limit, burst
+	}
 	return cl.limiter
 }
 
@@ -53,13 +61,11 @@ func extractClientID(r *http.Request) string {
 	return "unknown-client"
 }
 
+var fallbackTrustedProxies, _ = parseCIDRs(defaultTrustedProxies)
+
 func getClientIP(r *http.Request) string {
-	ip := r.Header.Get("X-Forwarded-For")
-	if ip == "" {
-		ip, _, _ = net.SplitHostPort(r.RemoteAddr)
-	} else {
-		parts := strings.Split(ip, ",")
-		ip = strings.TrimSpace(parts[0])
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
 	}
-	return ip
+	return resolveClientIP(r, fallbackTrustedProxies)
 }
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// ServerConfig bounds how long a client may take over a request and how
+// large its headers may be, so slow or oversized clients cannot hold
+// connections open. Zero timeouts are unlimited. Streams clear the read
+// and write deadlines and are bounded by their own limits instead.
+type ServerConfig struct {
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+}
+
+// serverFlags registers the server limits on fs.
+func serverFlags(fs *flag.FlagSet) *ServerConfig {
+	c := &ServerConfig{}
+	fs.DurationVar(&c.ReadHeaderTimeout, "read-header-timeout", 10*time.Second, "time allowed to send the request headers")
+	fs.DurationVar(&c.ReadTimeout, "read-timeout", 0, "time allowed to send a whole request, body included (0 for none)")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", 0, "time allowed to handle a request and write its response (0 for none)")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", 2*time.Minute, "time a keep-alive connection may wait for its next request")
+	fs.IntVar(&c.MaxHeaderBytes, "max-header-bytes", http.DefaultMaxHeaderBytes, "largest request line and headers accepted, in bytes")
+	return c
+}
+
+func (c *ServerConfig) apply(srv *http.Server) {
+	srv.ReadHeaderTimeout = c.ReadHeaderTimeout
+	srv.ReadTimeout = c.ReadTimeout
+	srv.WriteTimeout = c.WriteTimeout
+	srv.IdleTimeout = c.IdleTimeout
+	srv.MaxHeaderBytes = c.MaxHeaderBytes
+}
+
+// limitBody enforces the service's max_body_bytes. A request that declares
+// a larger body is answered 413 at once; one whose body turns out larger
+// fails to read, and the proxy answers 413 then.
+func (g *Gateway) limitBody(svc *Service, next http.Handler) http.Handler {
+	limit := svc.MaxBodyBytes
+	if limit <= 0 {
+		return next
+	}
+	name := svc.Name
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > limit {
+			g.metrics.rejectBody(name)
+			bodyTooLarge(w, name, limit)
+			return
+		}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = &limitedBody{ReadCloser: http.MaxBytesReader(w, r.Body, limit), exceeded: func() { g.metrics.rejectBody(name) }}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitedBody counts the request once when its body goes over the limit.
+type limitedBody struct {
+	io.ReadCloser
+	exceeded func()
+	counted  bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	var tooLarge *http.MaxBytesError
+	if err != nil && !b.counted && errors.As(err, &tooLarge) {
+		b.counted = true
+		b.exceeded()
+	}
+	return n, err
+}
+
+func bodyTooLarge(w http.ResponseWriter, service string, limit int64) {
+	JSONBadResponse(w, "request body too large", http.StatusRequestEntityTooLarge,
+		fmt.Sprintf("service %s accepts request bodies of up to %d bytes", service, limit))
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBodyLimit_RejectsLargeBodiesAndCounts(t *testing.T) {
+	var calls atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%d bytes", len(body))
+	}))
+	t.Cleanup(upstream.Close)
+	cfg, err := loadConfigFile(writeConfig(t, fmt.Sprintf(`services:
+  - name: files
+    host: %s
+    prefix: /files
+    auth: none
+    max_body_bytes: 16
+    routes:
+      - path: /files/upload
+        methods: [POST]
+        max_body_bytes: 1024
+`, upstream.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw := setupGateway(t, cfg.Routes)
+	post := func(path string, size int, chunked bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(strings.Repeat("x", size)))
+		if chunked {
+			req.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		gw.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := post("/files/notes", 10, false); w.Code != http.StatusOK || w.Body.String() != "10 bytes" {
+		t.Fatalf("small body: %d %q", w.Code, w.Body.String())
+	}
+	w := post("/files/notes", 32, false)
+	if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), "up to 16 bytes") {
+		t.Errorf("expected 413 for a declared 32-byte body, got %d %s", w.Code, w.Body.String())
+	}
+	if calls.Load() != 1 {
+		t.Errorf("a body declared too large reached the upstream")
+	}
+	// Without a Content-Length the limit is hit while proxying.
+	if w := post("/files/notes", 32, true); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 for a streamed 32-byte body, got %d %s", w.Code, w.Body.String())
+	}
+	if w := post("/files/upload", 100, true); w.Code != http.StatusOK || w.Body.String() != "100 bytes" {
+		t.Errorf("route limit: %d %q", w.Code, w.Body.String())
+	}
+
+	var metrics strings.Builder
+	gw.metrics.WritePrometheus(&metrics)
+	if !strings.Contains(metrics.String(), `aimas_request_body_too_large_total{service="files"} 2`) {
+		t.Errorf("expected two rejections counted:\n%s", metrics.String())
+	}
+
+	_, err = loadConfigFile(writeConfig(t, `services:
+  - name: files
+    host: http://files:8080
+    prefix: /files
+    max_body_bytes: -1
+    routes:
+      - path: /files/upload
+        max_body_bytes: -5
+`))
+	if err == nil || !strings.Contains(err.Error(), "max_body_bytes: must not be negative, got -1") ||
+		!strings.Contains(err.Error(), "must not be negative, got -5") {
+		t.Errorf("expected negative limits to be rejected, got %v", err)
+	}
+}
+
+func TestServer_LimitsSlowClientsButNotStreams(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 6; i++ {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	cfg, err := loadConfigFile(writeConfig(t, fmt.Sprintf(`services:
+  - name: live
+    host: %s
+    prefix: /live
+    auth: none
+    streams: {enabled: true}
+`, upstream.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(setupGateway(t, cfg.Routes))
+	(&ServerConfig{ReadHeaderTimeout: 100 * time.Millisecond, WriteTimeout: 150 * time.Millisecond, MaxHeaderBytes: 4096}).apply(srv.Config)
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	// A client that never finishes its headers is disconnected.
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "GET /health HTTP/1.1\r\nHost: gateway\r\n")
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := bufio.NewReader(conn).ReadByte(); err != io.EOF {
+		t.Errorf("expected the slow client to be disconnected, got %v", err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/health", nil)
+	req.Header.Set("X-Padding", strings.Repeat("x", 8192))
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("expected 431 for oversized headers, got %v %v", resp, err)
+	}
+
+	// The event stream runs past the write timeout.
+	req, _ = http.NewRequest(http.MethodGet, srv.URL+"/live/events", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || strings.Count(string(body), "data:") != 6 {
+		t.Errorf("expected all 6 events, got %q, %v", body, err)
+	}
+}
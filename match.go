@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// MatchConfig adds conditions to a service's prefix, so several services
+// can share a prefix and be told apart by host, headers, query parameters
+// or client address. All conditions must hold.
+type MatchConfig struct {
+	// Hosts are exact names or wildcards like *.aimas.dev, which match any
+	// subdomain but not aimas.dev itself. The port is ignored.
+	Hosts []string `yaml:"hosts"`
+	// Headers and Query require a value; "*" only requires presence.
+	Headers     map[string]string `yaml:"headers"`
+	Query       map[string]string `yaml:"query"`
+	ClientCIDRs []string          `yaml:"client_cidrs"`
+}
+
+func (m MatchConfig) empty() bool {
+	return len(m.Hosts)+len(m.Headers)+len(m.Query)+len(m.ClientCIDRs) == 0
+}
+
+// key is a canonical form of the conditions, to detect services that
+// could never be told apart.
+func (m MatchConfig) key() string {
+	hosts := make([]string, len(m.Hosts))
+	for i, h := range m.Hosts {
+		hosts[i] = strings.ToLower(h)
+	}
+	sort.Strings(hosts)
+	var b strings.Builder
+	fmt.Fprintf(&b, "hosts=%v", hosts)
+	for _, k := range sortedKeys(m.Headers) {
+		fmt.Fprintf(&b, " h:%s=%s", strings.ToLower(k), m.Headers[k])
+	}
+	for _, k := range sortedKeys(m.Query) {
+		fmt.Fprintf(&b, " q:%s=%s", k, m.Query[k])
+	}
+	cidrs := append([]string(nil), m.ClientCIDRs...)
+	sort.Strings(cidrs)
+	fmt.Fprintf(&b, " cidrs=%v", cidrs)
+	return b.String()
+}
+
+// matcher is a compiled MatchConfig.
+type matcher struct {
+	exact     map[string]bool
+	wildcards []string // ".aimas.dev" for *.aimas.dev
+	headers   [][2]string
+	query     [][2]string
+	cidrs     cidrSet
+}
+
+func compileMatcher(m MatchConfig) *matcher {
+	if m.empty() {
+		return nil
+	}
+	c := &matcher{exact: map[string]bool{}}
+	for _, h := range m.Hosts {
+		h = strings.ToLower(h)
+		if strings.HasPrefix(h, "*.") {
+			c.wildcards = append(c.wildcards, h[1:])
+		} else {
+			c.exact[h] = true
+		}
+	}
+	for _, k := range sortedKeys(m.Headers) {
+		c.headers = append(c.headers, [2]string{k, m.Headers[k]})
+	}
+	for _, k := range sortedKeys(m.Query) {
+		c.query = append(c.query, [2]string{k, m.Query[k]})
+	}
+	c.cidrs, _ = parseCIDRs(m.ClientCIDRs)
+	return c
+}
+
+// matchScore ranks a match; see (matchScore).better for the precedence.
+type matchScore struct {
+	host       int // 2 exact, 1 wildcard, 0 no host condition
+	hostLength int // length of the matching wildcard suffix
+	conditions int // header and query conditions
+	client     bool
+}
+
+// better reports whether s takes precedence over o. The host is compared
+// first (exact over wildcard over none, longer wildcards first), then the
+// number of header and query conditions, then whether the client address
+// is restricted.
+func (s matchScore) better(o matchScore) bool {
+	switch {
+	case s.host != o.host:
+		return s.host > o.host
+	case s.hostLength != o.hostLength:
+		return s.hostLength > o.hostLength
+	case s.conditions != o.conditions:
+		return s.conditions > o.conditions
+	}
+	return s.client && !o.client
+}
+
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+func (m *matcher) match(r *http.Request, host string, client netip.Addr) (matchScore, bool) {
+	var s matchScore
+	if m == nil {
+		return s, true
+	}
+	if len(m.exact)+len(m.wildcards) > 0 {
+		if m.exact[host] {
+			s.host = 2
+		} else {
+			for _, w := range m.wildcards {
+				if strings.HasSuffix(host, w) && len(host) > len(w) && len(w) > s.hostLength {
+					s.host, s.hostLength = 1, len(w)
+				}
+			}
+		}
+		if s.host == 0 {
+			return s, false
+		}
+	}
+	for _, h := range m.headers {
+		v := r.Header.Values(h[0])
+		if len(v) == 0 || (h[1] != "*" && !contains(v, h[1])) {
+			return s, false
+		}
+	}
+	if len(m.query) > 0 {
+		q := r.URL.Query()
+		for _, p := range m.query {
+			v, ok := q[p[0]]
+			if !ok || (p[1] != "*" && !contains(v, p[1])) {
+				return s, false
+			}
+		}
+	}
+	if len(m.cidrs) > 0 {
+		if !m.cidrs.contains(client) {
+			return s, false
+		}
+		s.client = true
+	}
+	s.conditions = len(m.headers) + len(m.query)
+	return s, true
+}
+
+func contains(values []string, v string) bool {
+	for _, x := range values {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// routeKey identifies a service in ServiceConfigFile.Routes: its prefix,
+// or prefix and name when match conditions let it share the prefix.
+func routeKey(svc *Service) string {
+	if svc.Match.empty() {
+		return svc.Prefix
+	}
+	return svc.Prefix + "#" + svc.Name
+}
+
+func validateMatch(c *configIssues, m MatchConfig, path []interface{}) {
+	for i, h := range m.Hosts {
+		name := strings.TrimPrefix(h, "*.")
+		if name == "" || strings.ContainsAny(name, "*/: ") {
+			c.addf(appendPath(appendPath(path, "hosts"), i), "invalid host %q, expected a name like api.example.com or *.example.com", h)
+		}
+	}
+	for i, e := range m.ClientCIDRs {
+		if _, err := parseCIDRs([]string{e}); err != nil {
+			c.add(err.Error(), appendPath(appendPath(path, "client_cidrs"), i)...)
+		}
+	}
+}
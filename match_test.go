@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMatch_HostHeaderQueryAndCIDRPrecedence(t *testing.T) {
+	var yml strings.Builder
+	yml.WriteString("defaults:\n  auth: none\n  middlewares: []\nservices:\n")
+	for _, s := range []struct{ name, match string }{
+		{"fallback", ""},
+		{"partners", "{hosts: ['*.partners.aimas.dev']}"},
+		{"partners-eu", "{hosts: ['*.eu.partners.aimas.dev']}"},
+		{"api", "{hosts: [api.aimas.dev]}"},
+		{"internal", "{hosts: [api.aimas.dev], headers: {X-Internal: 'true'}}"},
+		{"beta", "{query: {beta: '*'}, client_cidrs: [10.0.0.0/8]}"},
+	} {
+		upstream := mockService(t, s.name, http.StatusOK)
+		fmt.Fprintf(&yml, "  - name: %s\n    host: %s\n    prefix: /users\n", s.name, upstream.URL)
+		if s.match != "" {
+			fmt.Fprintf(&yml, "    match: %s\n", s.match)
+		}
+	}
+	cfg, err := loadConfigFile(writeConfig(t, yml.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw := setupGateway(t, cfg.Routes)
+
+	cases := []struct {
+		host, path, remote, header, want string
+	}{
+		{"api.aimas.dev:443", "/users/me", "", "", "api"},
+		{"api.aimas.dev", "/users/me", "", "true", "internal"},
+		{"acme.partners.aimas.dev", "/users/me", "", "", "partners"},
+		{"acme.eu.partners.aimas.dev", "/users/me", "", "", "partners-eu"},
+		{"partners.aimas.dev", "/users/me", "", "", "fallback"},
+		{"other.dev", "/users/me?beta=1", "10.1.2.3:5000", "", "beta"},
+		{"other.dev", "/users/me?beta=1", "192.0.2.1:5000", "", "fallback"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, c.path, nil)
+		req.Host = c.host
+		if c.remote != "" {
+			req.RemoteAddr = c.remote
+		}
+		if c.header != "" {
+			req.Header.Set("X-Internal", c.header)
+		}
+		w := httptest.NewRecorder()
+		gw.ServeHTTP(w, req)
+		if body, _ := io.ReadAll(w.Body); string(body) != c.want {
+			t.Errorf("%s%s from %s: expected %s, got %q (%d)", c.host, c.path, c.remote, c.want, body, w.Code)
+		}
+	}
+}
+
+func TestLoadConfigFile_SharedPrefixNeedsDistinctMatch(t *testing.T) {
+	path := writeConfig(t, `services:
+  - name: a
+    host: http://localhost:1
+    prefix: /x
+    match: {hosts: [a.dev]}
+  - name: b
+    host: http://localhost:2
+    prefix: /x
+    match: {hosts: [A.dev]}
+  - name: c
+    host: http://localhost:3
+    prefix: /x
+    match: {hosts: ["*"], client_cidrs: [nope]}
+`)
+	_, err := loadConfigFile(path)
+	if err == nil {
+		t.Fatal("expected errors")
+	}
+	for _, want := range []string{"services[1].match: prefix /x with the same match conditions as services[0]", "invalid host \"*\"", "client_cidrs[0]"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("missing %q in:\n%v", want, err)
+		}
+	}
+}
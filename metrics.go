@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type serviceCounters struct {
+	requests    atomic.Int64
+	errors      atomic.Int64
+	durationSum atomic.Int64
+	// bodyTooLarge counts requests rejected for their body size.
+	bodyTooLarge atomic.Int64
+	// quotaStoreErrors counts requests let through unchecked because the
+	// quota store failed.
+	quotaStoreErrors atomic.Int64
+}
+
+// backendKey names one backend of a service.
+type backendKey struct{ service, backend string }
+
+// Metrics keeps per-service request counters, and per-backend counters for
+// services that split traffic. Errors are 5xx responses, including those
+// generated by the gateway itself.
+type Metrics struct {
+	mu       sync.RWMutex
+	services map[string]*serviceCounters
+	backends map[backendKey]*serviceCounters
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{services: make(map[string]*serviceCounters), backends: make(map[backendKey]*serviceCounters)}
+}
+
+func (m *Metrics) counters(service string) *serviceCounters {
+	m.mu.RLock()
+	c, ok := m.services[service]
+	m.mu.RUnlock()
+	if ok {
+		return c
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c, ok = m.services[service]; !ok {
+		c = &serviceCounters{}
+		m.services[service] = c
+	}
+	return c
+}
+
+func (m *Metrics) backendCounters(k backendKey) *serviceCounters {
+	m.mu.RLock()
+	c, ok := m.backends[k]
+	m.mu.RUnlock()
+	if ok {
+		return c
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c, ok = m.backends[k]; !ok {
+		c = &serviceCounters{}
+		m.backends[k] = c
+	}
+	return c
+}
+
+func (m *Metrics) observe(service string, status int, d time.Duration) {
+	m.counters(service).add(status, d)
+}
+
+// rejectBody counts a request turned away because its body was larger
+// than the service allows.
+func (m *Metrics) rejectBody(service string) {
+	m.counters(service).bodyTooLarge.Add(1)
+}
+
+// quotaStoreError counts a request whose quota could not be checked.
+func (m *Metrics) quotaStoreError(service string) {
+	m.counters(service).quotaStoreErrors.Add(1)
+}
+
+// observeBackend counts a request proxied to one backend of a service.
+func (m *Metrics) observeBackend(service, backend string, status int, d time.Duration) {
+	m.backendCounters(backendKey{service, backend}).add(status, d)
+}
+
+func (c *serviceCounters) add(status int, d time.Duration) {
+	c.requests.Add(1)
+	if status >= 500 {
+		c.errors.Add(1)
+	}
+	c.durationSum.Add(int64(d))
+}
+
+// totals sums requests and errors over the given services.
+func (m *Metrics) totals(services []string) (requests, errors int64) {
+	for _, s := range services {
+		c := m.counters(s)
+		requests += c.requests.Load()
+		errors += c.errors.Load()
+	}
+	return requests, errors
+}
+
+// WritePrometheus renders the counters in the Prometheus text format.
+func (m *Metrics) WritePrometheus(w io.Writer) {
+	m.mu.RLock()
+	names := make([]string, 0, len(m.services))
+	for name := range m.services {
+		names = append(names, name)
+	}
+	m.mu.RUnlock()
+	sort.Strings(names)
+
+	fmt.Fprintln(w, "# TYPE aimas_requests_total counter")
+	for _, n := range names {
+		fmt.Fprintf(w, "aimas_requests_total{service=%q} %d\n", n, m.counters(n).requests.Load())
+	}
+	fmt.Fprintln(w, "# TYPE aimas_request_errors_total counter")
+	for _, n := range names {
+		fmt.Fprintf(w, "aimas_request_errors_total{service=%q} %d\n", n, m.counters(n).errors.Load())
+	}
+	fmt.Fprintln(w, "# TYPE aimas_request_duration_seconds_sum counter")
+	for _, n := range names {
+		secs := time.Duration(m.counters(n).durationSum.Load()).Seconds()
+		fmt.Fprintf(w, "aimas_request_duration_seconds_sum{service=%q} %g\n", n, secs)
+	}
+	fmt.Fprintln(w, "# TYPE aimas_request_body_too_large_total counter")
+	for _, n := range names {
+		fmt.Fprintf(w, "aimas_request_body_too_large_total{service=%q} %d\n", n, m.counters(n).bodyTooLarge.Load())
+	}
+	fmt.Fprintln(w, "# TYPE aimas_quota_store_errors_total counter")
+	for _, n := range names {
+		fmt.Fprintf(w, "aimas_quota_store_errors_total{service=%q} %d\n", n, m.counters(n).quotaStoreErrors.Load())
+	}
+
+	m.mu.RLock()
+	keys := make([]backendKey, 0, len(m.backends))
+	for k := range m.backends {
+		keys = append(keys, k)
+	}
+	m.mu.RUnlock()
+	if len(keys) == 0 {
+		return
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].service != keys[j].service {
+			return keys[i].service < keys[j].service
+		}
+		return keys[i].backend < keys[j].backend
+	})
+	fmt.Fprintln(w, "# TYPE aimas_backend_requests_total counter")
+	for _, k := range keys {
+		fmt.Fprintf(w, "aimas_backend_requests_total{service=%q,backend=%q} %d\n", k.service, k.backend, m.backendCounters(k).requests.Load())
+	}
+	fmt.Fprintln(w, "# TYPE aimas_backend_errors_total counter")
+	for _, k := range keys {
+		fmt.Fprintf(w, "aimas_backend_errors_total{service=%q,backend=%q} %d\n", k.service, k.backend, m.backendCounters(k).errors.Load())
+	}
+	fmt.Fprintln(w, "# TYPE aimas_backend_duration_seconds_sum counter")
+	for _, k := range keys {
+		secs := time.Duration(m.backendCounters(k).durationSum.Load()).Seconds()
+		fmt.Fprintf(w, "aimas_backend_duration_seconds_sum{service=%q,backend=%q} %g\n", k.service, k.backend, secs)
+	}
+}
+
+func (m *Metrics) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m.WritePrometheus(w)
+	})
+}
@@ -22,15 +22,81 @@ func applyMiddleWare(handler http.Handler, middlewares ...MiddleWare) http.Handl
 
 }
 
+// middlewareFactory builds a service's instance of a named middleware once,
+// when its route is compiled.
+type middlewareFactory func(g *Gateway, svc *Service) MiddleWare
+
+var middlewareRegistry = map[string]middlewareFactory{
+	"logging": func(g *Gateway, svc *Service) MiddleWare {
+		return LoggingMiddleware(*svc, g.logger)
+	},
+	"ip_filter": func(g *Gateway, svc *Service) MiddleWare {
+		return g.IPFilterMiddleware(svc.ipFilter)
+	},
+	"rate_limit": func(g *Gateway, svc *Service) MiddleWare {
+		return g.rateLimiter.Middleware(svc.limitKey(), svc.RateLimit.RequestsPerMinute)
+	},
+	"cors": func(g *Gateway, svc *Service) MiddleWare {
+		return CORSMiddleware(svc.CORS)
+	},
+	"auth": func(g *Gateway, svc *Service) MiddleWare {
+		switch svc.Auth {
+		case "none":
+			return AnonymousMiddleware
+		case "api_key":
+			return g.APIKeyMiddleware
+		}
+		return g.AuthMiddleware
+	},
+	"quota": func(g *Gateway, svc *Service) MiddleWare {
+		return g.quotas.Middleware(svc.Name, func(err error) {
+			g.metrics.quotaStoreError(svc.Name)
+			g.logger.Warning("quota", fmt.Sprintf("quota store failed for service %s, request allowed: %v", svc.Name, err))
+		})
+	},
+	"concurrency": func(g *Gateway, svc *Service) MiddleWare {
+		return g.concurrency.Middleware(svc.Name, svc.Concurrency)
+	},
+	"recover": func(g *Gateway, svc *Service) MiddleWare {
+		return RecoverMiddleware
+	},
+	"security_headers": func(g *Gateway, svc *Service) MiddleWare {
+		return SecurityHeadersMiddleware
+	},
+}
+
+// defaultMiddlewares is the chain used by services that don't declare
+// their own, outermost first.
+var defaultMiddlewares = []string{
+	"logging", "ip_filter", "cors", "rate_limit", "auth", "quota", "concurrency", "recover", "security_headers",
+}
+
+// compileChain wraps handler in the service's middlewares. Names are
+// validated when the config is loaded, so unknown ones are skipped here.
+// Stream requests are recognised before the first middleware runs.
+func (g *Gateway) compileChain(svc *Service, handler http.Handler) http.Handler {
+	names := svc.Middlewares
+	if names == nil {
+		names = defaultMiddlewares
+	}
+	chain := make([]MiddleWare, 0, len(names))
+	for _, name := range names {
+		if factory, ok := middlewareRegistry[name]; ok {
+			chain = append(chain, factory(g, svc))
+		}
+	}
+	return allowStreams(svc.Streams, applyMiddleWare(handler, chain...))
+}
+
 func (r *RateLimiter) Middleware(serviceName string, rpm int) func(http.Handler) http.Handler {
 	if rpm <= 0 {
-		rpm = 120
+		rpm = defaultRequestsPerMinute
 	}
 	limit := rate.Every(time.Minute / time.Duration(rpm))
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 
-			rate_ley := extractClientID(req)
+			rate_ley := serviceName + "|" + extractClientID(req)
 			limiter := r.getRateLimiter(rate_ley, limit, rpm)
 			if !limiter.Allow() {
 				reserve := limiter.Reserve()
@@ -52,6 +118,11 @@ func LoggingMiddleware(config Service, log *Log) func(http.Handler) http.Handler
 	return func(next http.Handler) http.Handler {
 		return hlog.NewHandler(log.lg)(
 			hlog.AccessHandler(func(r *http.Request, status, size int, duration time.Duration) {
+				// Streams that were let through are logged when they close,
+				// with the bytes of both directions.
+				if status < 400 && streamKind(r) != "" {
+					return
+				}
 				logger := hlog.FromRequest(r)
 				switch {
 				case status >= 100 && status < 400:
@@ -94,6 +165,9 @@ func RecoverMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if rec := recover(); rec != nil {
+				if rec == http.ErrAbortHandler {
+					panic(rec)
+				}
 				log.Printf("panic recovered: %v\n%s", rec, string(debug.Stack()))
 				JSONBadResponse(w, "internal server error", http.StatusInternalServerError, nil)
 			}
@@ -107,7 +181,10 @@ func SecurityHeadersMiddleware(next http.Handler) http.Handler {
 		w.Header().Set("X-Frame-Options", "DENY")
 		w.Header().Set("X-Content-Type-Options", "nosniff")
 		w.Header().Set("X-XSS-Protection", "1; mode=block")
-		w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, private")
+		// Event streams and upgrades keep the upstream's caching headers.
+		if streamKind(r) == "" {
+			w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, private")
+		}
 		w.Header().Set("Cross-Origin-Opener-Policy", "same-origin")
 		w.Header().Set("Cross-Origin-Resource-Policy", "same-origin")
 		w.Header().Set("Content-Security-Policy", "default-src 'self'")
@@ -123,6 +200,13 @@ func (g *Gateway) AuthMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
+		if key, ok := g.quotas.lookupAPIKey(r.Header.Get("X-Api-Key")); ok {
+			r.Header.Del("X-User-ID")
+			r.Header.Set("X-Consumer-ID", key.Consumer)
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		tokenStr := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
 		if tokenStr == "" {
 			JSONBadResponse(w, "missing token", http.StatusUnauthorized, nil)
@@ -136,6 +220,31 @@ func (g *Gateway) AuthMiddleware(next http.Handler) http.Handler {
 			return
 		}
 		r.Header.Set("X-User-ID", claims.UserID)
+		next.ServeHTTP(w, withClaims(r, claims))
+	})
+}
+
+// APIKeyMiddleware admits only requests carrying a known X-Api-Key, for
+// services with auth: api_key.
+func (g *Gateway) APIKeyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, ok := g.quotas.lookupAPIKey(r.Header.Get("X-Api-Key"))
+		if !ok {
+			JSONBadResponse(w, "missing or unknown api key", http.StatusUnauthorized, nil)
+			return
+		}
+		r.Header.Del("X-User-ID")
+		r.Header.Set("X-Consumer-ID", key.Consumer)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AnonymousMiddleware is the auth step of services with auth: none. It
+// drops identity headers a client may have set itself.
+func AnonymousMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del("X-User-ID")
+		r.Header.Del("X-Consumer-ID")
 		next.ServeHTTP(w, r)
 	})
 }
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func signedToken(tb testing.TB, claims jwt.MapClaims) string {
+	tb.Helper()
+	tb.Setenv("JWT_SECRET", "test-secret")
+	tok, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("test-secret"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return tok
+}
+
+func TestCompileChain_ServiceMiddlewares(t *testing.T) {
+	mock := mockService(t, "open", http.StatusOK)
+	svcURL, _ := url.Parse(mock.URL)
+	service := &Service{Name: "public", URL: svcURL, Prefix: "/public", Middlewares: []string{"logging", "recover"}}
+	gw := setupGateway(t, map[string]*Service{"/public": service})
+
+	w := httptest.NewRecorder()
+	gw.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/public/x", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("service without auth middleware should pass, got %d", w.Code)
+	}
+	if w.Header().Get("X-Frame-Options") != "" {
+		t.Error("security_headers was not declared and should not run")
+	}
+}
+
+func TestLoadConfigFile_MiddlewaresCannotDropConfiguredSecurity(t *testing.T) {
+	_, err := loadConfigFile(writeConfig(t, `quotas:
+  tiers:
+    free: {"*": {per_day: 100}}
+services:
+  - name: a
+    host: http://localhost:1
+    middlewares: [logging]
+  - name: b
+    host: http://localhost:2
+    auth: none
+    ip_filter: {deny: [10.0.0.0/8]}
+    middlewares: [logging, quota]
+  - name: c
+    host: http://localhost:3
+    auth: none
+    middlewares: [logging, quota]
+    routes:
+      - {path: /c/admin, auth: api_key}
+  - name: d
+    host: http://localhost:4
+    auth: none
+    middlewares: [logging, quota]
+`))
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, want := range []string{
+		"services[0].middlewares: service sets auth: jwt but its middlewares omit auth",
+		"services[0].middlewares: tier free sets a quota for the service but its middlewares omit quota",
+		"services[1].middlewares: service sets an ip_filter but its middlewares omit ip_filter",
+		"services[2].middlewares: route /c/admin sets auth: api_key but the service middlewares omit auth",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in:\n%v", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), "services[3]") {
+		t.Errorf("a list that covers every setting should be accepted:\n%v", err)
+	}
+}
+
+func benchmarkChain(b *testing.B, precompiled bool) {
+	gw := NewGateway(NewLogger())
+	svcURL, _ := url.Parse("http://upstream.invalid")
+	svc := &Service{Name: "bench", URL: svcURL, Prefix: "/bench"}
+	final := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	token := signedToken(b, jwt.MapClaims{"user_id": "u1"})
+
+	compiled := gw.compileChain(svc, final)
+	req := httptest.NewRequest(http.MethodGet, "/bench/items", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h := compiled
+		if !precompiled {
+			h = applyMiddleWare(final,
+				LoggingMiddleware(*svc, gw.logger),
+				gw.IPFilterMiddleware(svc.ipFilter),
+				gw.rateLimiter.Middleware(svc.Name, 1<<30),
+				gw.AuthMiddleware,
+				gw.quotas.Middleware(svc.Name, nil),
+				gw.concurrency.Middleware(svc.Name, svc.Concurrency),
+				RecoverMiddleware,
+				SecurityHeadersMiddleware,
+			)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
+
+// Compare with: go test -run '^$' -bench MiddlewareChain -benchmem
+func BenchmarkMiddlewareChain_PerRequest(b *testing.B)  { benchmarkChain(b, false) }
+func BenchmarkMiddlewareChain_Precompiled(b *testing.B) { benchmarkChain(b, true) }
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	defaultMirrorBodyBytes   = 64 << 10
+	defaultMirrorConcurrency = 16
+	defaultMirrorTimeout     = 10 * time.Second
+)
+
+// MirrorConfig sends a copy of a sample of a service's requests to a
+// second upstream and discards its responses. Requests whose body is
+// larger than MaxBodyBytes, and requests arriving while Concurrency
+// mirrored calls are in flight, are not mirrored.
+type MirrorConfig struct {
+	Host         string        `yaml:"host"`
+	Percent      float64       `yaml:"percent"`
+	MaxBodyBytes int64         `yaml:"max_body_bytes"`
+	Concurrency  int           `yaml:"concurrency"`
+	Timeout      time.Duration `yaml:"timeout"`
+	// Compare logs the status and latency of the mirror next to the
+	// primary's.
+	Compare bool `yaml:"compare"`
+}
+
+// mirror wraps the upstream of a service. The copy is built by the
+// mirror's own reverse proxy director, so it gets the same path rewriting,
+// header rules and signing as the primary request.
+type mirror struct {
+	cfg       MirrorConfig
+	service   string
+	next      http.Handler
+	director  func(*http.Request)
+	transport http.RoundTripper
+	slots     chan struct{}
+	logger    *Log
+}
+
+type mirrorResult struct {
+	status  int
+	latency time.Duration
+	aborted bool
+}
+
+func (g *Gateway) newMirror(svc *Service, next http.Handler, transportFor func(*url.URL) http.RoundTripper) http.Handler {
+	cfg := svc.Mirror
+	u, err := url.Parse(cfg.Host)
+	if err != nil {
+		return next // rejected by validation
+	}
+	if cfg.MaxBodyBytes == 0 {
+		cfg.MaxBodyBytes = defaultMirrorBodyBytes
+	}
+	if cfg.Concurrency == 0 {
+		cfg.Concurrency = defaultMirrorConcurrency
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultMirrorTimeout
+	}
+	ms := *svc
+	ms.URL = u
+	transport := transportFor(u)
+	return &mirror{
+		cfg:       cfg,
+		service:   svc.Name,
+		next:      next,
+		director:  g.newReverseProxy(&ms, transport).Director,
+		transport: transport,
+		slots:     make(chan struct{}, cfg.Concurrency),
+		logger:    g.logger,
+	}
+}
+
+func (m *mirror) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if streamKind(r) != "" || (m.cfg.Percent < 100 && rand.Float64()*100 >= m.cfg.Percent) {
+		m.next.ServeHTTP(w, r)
+		return
+	}
+	body, ok := m.bufferBody(r)
+	if !ok {
+		m.next.ServeHTTP(w, r)
+		return
+	}
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		m.next.ServeHTTP(w, r)
+		return
+	}
+
+	// The copy must not depend on the client request, which is canceled
+	// as soon as the primary response is written.
+	req := r.Clone(context.WithoutCancel(r.Context()))
+	primary := make(chan mirrorResult, 1)
+	go m.send(req, body, primary)
+
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w}
+	finished := false
+	// The result is sent even when the primary panics, as the proxy does
+	// when an upstream body breaks off, so the comparison never waits for
+	// it forever.
+	defer func() {
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		primary <- mirrorResult{status: sw.status, latency: time.Since(start), aborted: !finished}
+	}()
+	m.next.ServeHTTP(sw, r)
+	finished = true
+}
+
+// bufferBody reads the request body so it can be sent twice. It reports
+// false, leaving the body readable as before, when the body is too large.
+func (m *mirror) bufferBody(r *http.Request) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+	if r.ContentLength > m.cfg.MaxBodyBytes {
+		return nil, false
+	}
+	buf, err := io.ReadAll(io.LimitReader(r.Body, m.cfg.MaxBodyBytes+1))
+	rest := io.Reader(r.Body)
+	if err != nil {
+		rest = errReader{err}
+	}
+	if err != nil || int64(len(buf)) > m.cfg.MaxBodyBytes {
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(buf), rest), r.Body}
+		return nil, false
+	}
+	r.Body = readCloser{bytes.NewReader(buf), r.Body}
+	return buf, true
+}
+
+func (m *mirror) send(req *http.Request, body []byte, primary <-chan mirrorResult) {
+	defer func() { <-m.slots }()
+	ctx, cancel := context.WithTimeout(req.Context(), m.cfg.Timeout)
+	defer cancel()
+
+	req = req.WithContext(ctx)
+	req.RequestURI = ""
+	req.Body = http.NoBody
+	if body != nil {
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	m.director(req)
+
+	start := time.Now()
+	status := 0
+	resp, err := m.transport.RoundTrip(req)
+	if err == nil {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		status = resp.StatusCode
+	}
+	latency := time.Since(start)
+	if !m.cfg.Compare {
+		return
+	}
+
+	p := <-primary
+	switch {
+	case p.aborted:
+		m.logger.Warning("mirror", fmt.Sprintf("service %s: %s %s: primary aborted after %s, mirror %d in %s",
+			m.service, req.Method, req.URL.Path, p.latency, status, latency))
+	case err != nil:
+		m.logger.Warning("mirror", fmt.Sprintf("service %s: mirror of %s %s failed after %s: %v (primary %d in %s)",
+			m.service, req.Method, req.URL.Path, latency, err, p.status, p.latency))
+	case status != p.status:
+		m.logger.Warning("mirror", fmt.Sprintf("service %s: %s %s: primary %d in %s, mirror %d in %s",
+			m.service, req.Method, req.URL.Path, p.status, p.latency, status, latency))
+	default:
+		m.logger.Info("mirror", fmt.Sprintf("service %s: %s %s: %d, primary %s, mirror %s (%+dms)",
+			m.service, req.Method, req.URL.Path, status, p.latency, latency, (latency-p.latency).Milliseconds()))
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type errReader struct{ err error }
+
+func (e errReader) Read([]byte) (int, error) { return 0, e.err }
+
+func validateMirror(c *configIssues, cfg MirrorConfig, path []interface{}) {
+	if cfg == (MirrorConfig{}) {
+		return
+	}
+	u, err := url.Parse(cfg.Host)
+	switch {
+	case cfg.Host == "":
+		c.add("host is required", appendPath(path, "host")...)
+	case err != nil || u.Host == "":
+		c.addf(appendPath(path, "host"), "invalid host %q", cfg.Host)
+	case !validateScheme(u):
+		c.addf(appendPath(path, "host"), "unsupported scheme %q, expected http or https", u.Scheme)
+	}
+	if cfg.Percent <= 0 || cfg.Percent > 100 {
+		c.addf(appendPath(path, "percent"), "must be between 0 and 100, got %g", cfg.Percent)
+	}
+	if cfg.MaxBodyBytes < 0 {
+		c.addf(appendPath(path, "max_body_bytes"), "must not be negative, got %d", cfg.MaxBodyBytes)
+	}
+	if cfg.Concurrency < 0 {
+		c.addf(appendPath(path, "concurrency"), "must not be negative, got %d", cfg.Concurrency)
+	}
+	if cfg.Timeout < 0 {
+		c.addf(appendPath(path, "timeout"), "must not be negative, got %s", cfg.Timeout)
+	}
+}
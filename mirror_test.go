@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMirror_CopiesRequestsWithoutDelayingClients(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s", r.URL.Path, body)
+	}))
+	t.Cleanup(primary.Close)
+	mirrored := make(chan string, 10)
+	release := make(chan struct{})
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mirrored <- r.URL.Path + " " + string(body)
+		<-release
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(shadow.Close)
+	t.Cleanup(func() { close(release) })
+
+	cfg, err := loadConfigFile(writeConfig(t, fmt.Sprintf(`services:
+  - name: logs
+    host: %s
+    prefix: /logs
+    strip_prefix: true
+    auth: none
+    middlewares: []
+    mirror:
+      host: %s
+      percent: 100
+      max_body_bytes: 16
+      compare: true
+`, primary.URL, shadow.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw := setupGateway(t, cfg.Routes)
+
+	post := func(body string) string {
+		req := httptest.NewRequest(http.MethodPost, "/logs/entries", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		done := make(chan struct{})
+		go func() { gw.ServeHTTP(w, req); close(done) }()
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("client response waited for the mirror")
+		}
+		return w.Body.String()
+	}
+
+	if got := post(`{"level":"info"}`); got != `/entries {"level":"info"}` {
+		t.Errorf("primary got %q", got)
+	}
+	select {
+	case got := <-mirrored:
+		if got != `/entries {"level":"info"}` {
+			t.Errorf("mirror got %q", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("request was not mirrored")
+	}
+
+	large := strings.Repeat("x", 32)
+	if got := post(large); got != "/entries "+large {
+		t.Errorf("primary got %q for a body over the mirror limit", got)
+	}
+	select {
+	case got := <-mirrored:
+		t.Errorf("body over the limit was mirrored: %q", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMirror_AbortedPrimaryFreesItsSlot(t *testing.T) {
+	mirrored := make(chan struct{}, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrored <- struct{}{}
+	}))
+	t.Cleanup(shadow.Close)
+	target, _ := url.Parse(shadow.URL)
+	m := &mirror{
+		cfg:     MirrorConfig{Percent: 100, MaxBodyBytes: 16, Concurrency: 1, Timeout: time.Second, Compare: true},
+		service: "logs",
+		next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			panic(http.ErrAbortHandler)
+		}),
+		director:  func(r *http.Request) { r.URL.Scheme, r.URL.Host = target.Scheme, target.Host },
+		transport: http.DefaultTransport,
+		slots:     make(chan struct{}, 1),
+		logger:    NewLogger(),
+	}
+	serve := func() {
+		defer func() {
+			if rec := recover(); rec != http.ErrAbortHandler {
+				t.Errorf("expected the abort to propagate, got %v", rec)
+			}
+		}()
+		m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/logs/tail", nil))
+	}
+
+	for i := 0; i < 2; i++ {
+		serve()
+		select {
+		case <-mirrored:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("request %d was not mirrored", i)
+		}
+		waitFor(t, "the mirror slot to be released", func() bool { return len(m.slots) == 0 })
+	}
+}
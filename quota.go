@@ -0,0 +1,464 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const QuotaExceededCode = "QUOTA_EXCEEDED"
+
+type QuotaConfig struct {
+	TierClaim   string                            `yaml:"tier_claim"`
+	DefaultTier string                            `yaml:"default_tier"`
+	Store       QuotaStoreConfig                  `yaml:"store"`
+	Tiers       map[string]map[string]QuotaLimits `yaml:"tiers"`
+	APIKeys     []APIKey                          `yaml:"api_keys"`
+}
+
+type QuotaStoreConfig struct {
+	Type          string        `yaml:"type"`
+	Path          string        `yaml:"path"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+}
+
+// QuotaLimits holds the per-window request allowance of a tier for one
+// service. A zero value means the window is unlimited.
+type QuotaLimits struct {
+	PerMinute int64 `yaml:"per_minute"`
+	PerHour   int64 `yaml:"per_hour"`
+	PerDay    int64 `yaml:"per_day"`
+	PerMonth  int64 `yaml:"per_month"`
+}
+
+type APIKey struct {
+	Key      string `yaml:"key"`
+	Consumer string `yaml:"consumer"`
+	Tier     string `yaml:"tier"`
+}
+
+type quotaWindow struct {
+	name  string
+	limit int64
+	start time.Time
+	end   time.Time
+}
+
+func (l QuotaLimits) windows(now time.Time) []quotaWindow {
+	now = now.UTC()
+	minute := now.Truncate(time.Minute)
+	hour := now.Truncate(time.Hour)
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	var out []quotaWindow
+	if l.PerMinute > 0 {
+		out = append(out, quotaWindow{"minute", l.PerMinute, minute, minute.Add(time.Minute)})
+	}
+	if l.PerHour > 0 {
+		out = append(out, quotaWindow{"hour", l.PerHour, hour, hour.Add(time.Hour)})
+	}
+	if l.PerDay > 0 {
+		out = append(out, quotaWindow{"day", l.PerDay, day, day.AddDate(0, 0, 1)})
+	}
+	if l.PerMonth > 0 {
+		out = append(out, quotaWindow{"month", l.PerMonth, month, month.AddDate(0, 1, 0)})
+	}
+	return out
+}
+
+// QuotaStore persists quota counters. Keys embed the window start, so a
+// counter is never reset in place; it simply expires.
+type QuotaStore interface {
+	Get(key string) (int64, error)
+	Add(key string, delta int64, expires time.Time) (int64, error)
+	Close() error
+}
+
+type quotaCounter struct {
+	Count   int64     `json:"count"`
+	Expires time.Time `json:"expires"`
+}
+
+// quotaSweepInterval is how often a memory store drops expired counters.
+const quotaSweepInterval = time.Minute
+
+type memoryQuotaStore struct {
+	mu       sync.Mutex
+	counters map[string]*quotaCounter
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func newMemoryQuotaStore() *memoryQuotaStore {
+	return &memoryQuotaStore{counters: make(map[string]*quotaCounter)}
+}
+
+func (m *memoryQuotaStore) Get(key string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.counters[key]
+	if !ok || time.Now().After(c.Expires) {
+		return 0, nil
+	}
+	return c.Count, nil
+}
+
+func (m *memoryQuotaStore) Add(key string, delta int64, expires time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.counters[key]
+	if !ok || time.Now().After(c.Expires) {
+		c = &quotaCounter{Expires: expires}
+		m.counters[key] = c
+	}
+	c.Count += delta
+	return c.Count, nil
+}
+
+func (m *memoryQuotaStore) sweep() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for k, c := range m.counters {
+		if now.After(c.Expires) {
+			delete(m.counters, k)
+		}
+	}
+}
+
+// sweepEvery drops expired counters in the background until the store is
+// closed, so consumers that stop calling do not stay in memory.
+func (m *memoryQuotaStore) sweepEvery(interval time.Duration) *memoryQuotaStore {
+	m.stop, m.done = make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(m.done)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-t.C:
+				m.sweep()
+			}
+		}
+	}()
+	return m
+}
+
+func (m *memoryQuotaStore) Close() error {
+	if m.stop != nil {
+		close(m.stop)
+		<-m.done
+		m.stop = nil
+	}
+	return nil
+}
+
+// fileQuotaStore keeps counters in memory and snapshots them to a JSON file
+// so they survive restarts.
+type fileQuotaStore struct {
+	*memoryQuotaStore
+	path string
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newFileQuotaStore(path string, flushEvery time.Duration) (*fileQuotaStore, error) {
+	if flushEvery <= 0 {
+		flushEvery = 10 * time.Second
+	}
+	fs := &fileQuotaStore{
+		memoryQuotaStore: newMemoryQuotaStore(),
+		path:             path,
+		stop:             make(chan struct{}),
+		done:             make(chan struct{}),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &fs.counters); err != nil {
+			return nil, fmt.Errorf("corrupt quota store %s: %w", path, err)
+		}
+		fs.sweep()
+	}
+
+	go func() {
+		defer close(fs.done)
+		t := time.NewTicker(flushEvery)
+		defer t.Stop()
+		for {
+			select {
+			case <-fs.stop:
+				return
+			case <-t.C:
+				fs.sweep()
+				_ = fs.flush()
+			}
+		}
+	}()
+	return fs, nil
+}
+
+func (f *fileQuotaStore) flush() error {
+	f.mu.Lock()
+	data, err := json.Marshal(f.counters)
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+		return err
+	}
+	tmp := f.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path)
+}
+
+func (f *fileQuotaStore) Close() error {
+	close(f.stop)
+	<-f.done
+	return f.flush()
+}
+
+func openQuotaStore(cfg QuotaStoreConfig) (QuotaStore, error) {
+	switch cfg.Type {
+	case "", "memory":
+		return newMemoryQuotaStore().sweepEvery(quotaSweepInterval), nil
+	case "file":
+		if cfg.Path == "" {
+			return nil, errors.New("quota store type file requires a path")
+		}
+		return newFileQuotaStore(cfg.Path, cfg.FlushInterval)
+	default:
+		return nil, fmt.Errorf("unsupported quota store type: %s", cfg.Type)
+	}
+}
+
+type QuotaManager struct {
+	mu       sync.Mutex
+	cfg      QuotaConfig
+	keys     map[string]APIKey
+	store    QuotaStore
+	storeCfg QuotaStoreConfig
+}
+
+func NewQuotaManager() *QuotaManager {
+	return &QuotaManager{keys: map[string]APIKey{}, store: newMemoryQuotaStore().sweepEvery(quotaSweepInterval)}
+}
+
+// quotaUpdate is a quota configuration ready to be swapped in, with the
+// counter store it needs already open. store is nil when the current one
+// is kept.
+type quotaUpdate struct {
+	cfg   QuotaConfig
+	keys  map[string]APIKey
+	store QuotaStore
+}
+
+// Configure swaps in a new quota configuration. The counter store is only
+// reopened when its own settings change, so a reload keeps the counts.
+func (q *QuotaManager) Configure(cfg QuotaConfig) error {
+	u, err := q.prepare(cfg)
+	if err != nil {
+		return err
+	}
+	q.commit(u)
+	return nil
+}
+
+// prepare opens what cfg needs without changing the live configuration,
+// so a reload can check every part before committing any of them.
+func (q *QuotaManager) prepare(cfg QuotaConfig) (*quotaUpdate, error) {
+	if cfg.TierClaim == "" {
+		cfg.TierClaim = "tier"
+	}
+	u := &quotaUpdate{cfg: cfg, keys: make(map[string]APIKey, len(cfg.APIKeys))}
+	for _, k := range cfg.APIKeys {
+		u.keys[k.Key] = k
+	}
+
+	q.mu.Lock()
+	reopen := q.store == nil || cfg.Store != q.storeCfg
+	q.mu.Unlock()
+	if reopen {
+		store, err := openQuotaStore(cfg.Store)
+		if err != nil {
+			return nil, err
+		}
+		u.store = store
+	}
+	return u, nil
+}
+
+func (q *QuotaManager) commit(u *quotaUpdate) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if u.store != nil {
+		if q.store != nil {
+			_ = q.store.Close()
+		}
+		q.store = u.store
+		q.storeCfg = u.cfg.Store
+	}
+	q.keys = u.keys
+	q.cfg = u.cfg
+}
+
+// discard closes the store opened for an update that was not committed.
+func (u *quotaUpdate) discard() {
+	if u != nil && u.store != nil {
+		_ = u.store.Close()
+	}
+}
+
+func (q *QuotaManager) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.store == nil {
+		return nil
+	}
+	err := q.store.Close()
+	q.store = nil
+	return err
+}
+
+func (q *QuotaManager) lookupAPIKey(key string) (APIKey, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	k, ok := q.keys[key]
+	return k, ok && key != ""
+}
+
+// consumer resolves who is calling and which tier they are on. API key
+// records win over JWT claims; anonymous callers get the default tier.
+func (q *QuotaManager) consumer(r *http.Request) (string, string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if k, ok := q.keys[r.Header.Get("X-Api-Key")]; ok && k.Key != "" {
+		tier := k.Tier
+		if tier == "" {
+			tier = q.cfg.DefaultTier
+		}
+		return "key:" + k.Consumer, tier
+	}
+	if claims := claimsFromRequest(r); claims != nil && claims.UserID != "" {
+		tier := claims.Get(q.cfg.TierClaim)
+		if tier == "" {
+			tier = q.cfg.DefaultTier
+		}
+		return "user:" + claims.UserID, tier
+	}
+	return "ip:" + getClientIP(r), q.cfg.DefaultTier
+}
+
+func (q *QuotaManager) limitsFor(tier, service string) (QuotaLimits, bool) {
+	limits, ok := q.cfg.Tiers[tier]
+	if !ok {
+		return QuotaLimits{}, false
+	}
+	if l, ok := limits[service]; ok {
+		return l, true
+	}
+	l, ok := limits["*"]
+	return l, ok
+}
+
+type quotaDecision struct {
+	allowed   bool
+	tier      string
+	window    quotaWindow
+	remaining int64
+}
+
+func (q *QuotaManager) take(consumer, tier, service string, now time.Time) (quotaDecision, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	limits, ok := q.limitsFor(tier, service)
+	if !ok || q.store == nil {
+		return quotaDecision{allowed: true, tier: tier, remaining: -1}, nil
+	}
+	windows := limits.windows(now)
+	if len(windows) == 0 {
+		return quotaDecision{allowed: true, tier: tier, remaining: -1}, nil
+	}
+
+	keys := make([]string, len(windows))
+	tightest := quotaDecision{allowed: true, tier: tier, remaining: -1}
+	for i, win := range windows {
+		keys[i] = fmt.Sprintf("%s|%s|%s|%d", consumer, service, win.name, win.start.Unix())
+		used, err := q.store.Get(keys[i])
+		if err != nil {
+			return quotaDecision{}, err
+		}
+		if used >= win.limit {
+			return quotaDecision{allowed: false, tier: tier, window: win}, nil
+		}
+		if left := win.limit - used - 1; tightest.remaining < 0 || left < tightest.remaining {
+			tightest.remaining = left
+			tightest.window = win
+		}
+	}
+	for i, win := range windows {
+		if _, err := q.store.Add(keys[i], 1, win.end); err != nil {
+			return quotaDecision{}, err
+		}
+	}
+	return tightest, nil
+}
+
+// Middleware enforces the quotas of a service. When the store fails, the
+// request is let through: an unavailable store must not take the service
+// down with it. failed is told about every such error so it is not
+// missed.
+func (q *QuotaManager) Middleware(serviceName string, failed func(error)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			consumer, tier := q.consumer(req)
+			now := time.Now()
+			decision, err := q.take(consumer, tier, serviceName, now)
+			if err != nil {
+				if failed != nil {
+					failed(err)
+				}
+				next.ServeHTTP(w, req)
+				return
+			}
+
+			if decision.remaining >= 0 {
+				w.Header().Set("X-Quota-Limit", strconv.FormatInt(decision.window.limit, 10))
+				w.Header().Set("X-Quota-Remaining", strconv.FormatInt(decision.remaining, 10))
+				w.Header().Set("X-Quota-Reset", strconv.FormatInt(decision.window.end.Unix(), 10))
+			}
+			if !decision.allowed {
+				retryAfter := decision.window.end.Sub(now)
+				w.Header().Set("Retry-After", fmt.Sprintf("%.0f", retryAfter.Seconds()))
+				w.Header().Set("X-Quota-Limit", strconv.FormatInt(decision.window.limit, 10))
+				w.Header().Set("X-Quota-Remaining", "0")
+				w.Header().Set("X-Quota-Reset", strconv.FormatInt(decision.window.end.Unix(), 10))
+				JSONBadResponse(w, "quota exceeded", http.StatusTooManyRequests, map[string]interface{}{
+					"code":     QuotaExceededCode,
+					"tier":     decision.tier,
+					"window":   decision.window.name,
+					"limit":    decision.window.limit,
+					"reset_at": decision.window.end.Format(time.RFC3339),
+				})
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
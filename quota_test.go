@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuota_DailyLimitPerTier(t *testing.T) {
+	mock := mockService(t, "ok", http.StatusOK)
+	svcURL, _ := url.Parse(mock.URL)
+	service := &Service{Name: "rec", URL: svcURL, Prefix: "/rec"}
+	gw := setupGateway(t, map[string]*Service{"/rec": service})
+
+	err := gw.quotas.Configure(QuotaConfig{
+		DefaultTier: "free",
+		Tiers: map[string]map[string]QuotaLimits{
+			"free": {"rec": {PerDay: 2}},
+		},
+		APIKeys: []APIKey{{Key: "k1", Consumer: "acme", Tier: "free"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/rec/items", nil)
+		req.Header.Set("X-Api-Key", "k1")
+		w := httptest.NewRecorder()
+		gw.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d: expected 200, got %d: %s", i, w.Code, w.Body.String())
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/rec/items", nil)
+	req.Header.Set("X-Api-Key", "k1")
+	w := httptest.NewRecorder()
+	gw.ServeHTTP(w, req)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", w.Code)
+	}
+
+	var resp struct {
+		Error map[string]interface{} `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error["code"] != QuotaExceededCode || resp.Error["window"] != "day" {
+		t.Fatalf("unexpected error payload: %v", resp.Error)
+	}
+}
+
+func TestQuota_FileStoreSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quotas.json")
+	expires := time.Now().Add(time.Hour)
+
+	store, err := newFileQuotaStore(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Add("user:1|rec|day|0", 3, expires); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := newFileQuotaStore(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	n, _ := reopened.Get("user:1|rec|day|0")
+	if n != 3 {
+		t.Fatalf("expected counter 3 after reopen, got %d", n)
+	}
+}
+
+func TestQuota_MemoryStoreSweepsExpiredCounters(t *testing.T) {
+	store := newMemoryQuotaStore().sweepEvery(10 * time.Millisecond)
+	defer store.Close()
+	store.Add("ip:10.0.0.1|rec|minute|0", 1, time.Now().Add(20*time.Millisecond))
+	store.Add("ip:10.0.0.2|rec|day|0", 1, time.Now().Add(time.Hour))
+
+	waitFor(t, "the expired counter to be swept", func() bool {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		return len(store.counters) == 1
+	})
+	if n, _ := store.Get("ip:10.0.0.2|rec|day|0"); n != 1 {
+		t.Errorf("live counter was swept, got %d", n)
+	}
+}
+
+// failingQuotaStore fails every operation, like a file store on a full disk.
+type failingQuotaStore struct{}
+
+func (failingQuotaStore) Get(string) (int64, error) { return 0, errors.New("disk full") }
+func (failingQuotaStore) Add(string, int64, time.Time) (int64, error) {
+	return 0, errors.New("disk full")
+}
+func (failingQuotaStore) Close() error { return nil }
+
+func TestQuota_StoreErrorsAreCountedAndFailOpen(t *testing.T) {
+	mock := mockService(t, "ok", http.StatusOK)
+	svcURL, _ := url.Parse(mock.URL)
+	service := &Service{Name: "rec", URL: svcURL, Prefix: "/rec", Auth: "none"}
+	gw := setupGateway(t, map[string]*Service{"/rec": service})
+	if err := gw.quotas.Configure(QuotaConfig{
+		DefaultTier: "free",
+		Tiers:       map[string]map[string]QuotaLimits{"free": {"rec": {PerDay: 1}}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	gw.quotas.mu.Lock()
+	gw.quotas.store.Close()
+	gw.quotas.store = failingQuotaStore{}
+	gw.quotas.mu.Unlock()
+
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		gw.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/rec/items", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d: expected the request to be let through, got %d", i, w.Code)
+		}
+	}
+	var metrics strings.Builder
+	gw.metrics.WritePrometheus(&metrics)
+	if !strings.Contains(metrics.String(), `aimas_quota_store_errors_total{service="rec"} 3`) {
+		t.Errorf("expected 3 quota store errors, got:\n%s", metrics.String())
+	}
+}
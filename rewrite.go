@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// RewriteRule maps a request path to the path sent upstream. The path is
+// matched either by a regular expression (match) or by a pattern with
+// named segments (path, e.g. /rec/v1/items/{id}); to is the new path, in
+// which {name} or {1} is replaced by the captured value. Rules see the
+// full request path, prefix included, and the first match wins.
+type RewriteRule struct {
+	Match string `yaml:"match"`
+	Path  string `yaml:"path"`
+	To    string `yaml:"to"`
+}
+
+var pathParamRe = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)(\.\.\.)?\}`)
+
+// compilePathPattern turns /items/{id} into an anchored regexp with a
+// named group per parameter. {name...} matches the rest of the path,
+// slashes included.
+func compilePathPattern(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	last := 0
+	for _, m := range pathParamRe.FindAllStringSubmatchIndex(pattern, -1) {
+		b.WriteString(regexp.QuoteMeta(pattern[last:m[0]]))
+		name := pattern[m[2]:m[3]]
+		if m[4] >= 0 {
+			fmt.Fprintf(&b, "(?P<%s>.*)", name)
+		} else {
+			fmt.Fprintf(&b, "(?P<%s>[^/]+)", name)
+		}
+		last = m[1]
+	}
+	rest := pattern[last:]
+	if strings.ContainsAny(rest, "{}") {
+		return nil, fmt.Errorf("invalid parameter in %q", pattern)
+	}
+	b.WriteString(regexp.QuoteMeta(rest))
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// rewriter is a compiled RewriteRule. to is split around its
+// placeholders; groups holds the submatch index of each placeholder.
+// Placeholders from queryFrom on sit in the query of to.
+type rewriter struct {
+	re        *regexp.Regexp
+	to        []string
+	groups    []int
+	queryFrom int
+}
+
+func compileRewrite(rule RewriteRule) (*rewriter, error) {
+	var re *regexp.Regexp
+	var err error
+	switch {
+	case rule.Match != "" && rule.Path != "":
+		return nil, fmt.Errorf("set either match or path, not both")
+	case rule.Match != "":
+		re, err = regexp.Compile(rule.Match)
+	case rule.Path != "":
+		re, err = compilePathPattern(rule.Path)
+	default:
+		return nil, fmt.Errorf("a rewrite needs match or path")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(rule.To, "/") {
+		return nil, fmt.Errorf("to must start with /, got %q", rule.To)
+	}
+
+	rw := &rewriter{re: re, queryFrom: -1}
+	to := rule.To
+	for {
+		start := strings.IndexByte(to, '{')
+		if start < 0 {
+			break
+		}
+		if rw.queryFrom < 0 && strings.Contains(rule.To[:len(rule.To)-len(to)+start], "?") {
+			rw.queryFrom = len(rw.groups)
+		}
+		end := strings.IndexByte(to[start:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated {} in %q", rule.To)
+		}
+		name := to[start+1 : start+end]
+		group := re.SubexpIndex(name)
+		if n, err := strconv.Atoi(name); err == nil && n <= re.NumSubexp() {
+			group = n
+		}
+		if group < 0 {
+			return nil, fmt.Errorf("to references {%s}, which the pattern does not capture", name)
+		}
+		rw.to = append(rw.to, to[:start])
+		rw.groups = append(rw.groups, group)
+		to = to[start+end+1:]
+	}
+	rw.to = append(rw.to, to)
+	if rw.queryFrom < 0 {
+		rw.queryFrom = len(rw.groups)
+	}
+	return rw, nil
+}
+
+// expand builds the rewritten path from the submatches of a match. The
+// captures are escaped path text; those placed in the query are
+// re-escaped for it so a captured & or = cannot add parameters.
+func (rw *rewriter) expand(path string, m []int) string {
+	var b strings.Builder
+	for i, literal := range rw.to {
+		b.WriteString(literal)
+		if i >= len(rw.groups) {
+			continue
+		}
+		g := rw.groups[i]
+		if m[2*g] < 0 {
+			continue
+		}
+		value := path[m[2*g]:m[2*g+1]]
+		if i >= rw.queryFrom {
+			if unescaped, err := url.PathUnescape(value); err == nil {
+				value = unescaped
+			}
+			value = url.QueryEscape(value)
+		}
+		b.WriteString(value)
+	}
+	return b.String()
+}
+
+type rewriteRules []*rewriter
+
+func compileRewrites(rules []RewriteRule) (rewriteRules, error) {
+	var out rewriteRules
+	for i, rule := range rules {
+		rw, err := compileRewrite(rule)
+		if err != nil {
+			return nil, fmt.Errorf("rewrite[%d]: %w", i, err)
+		}
+		out = append(out, rw)
+	}
+	return out, nil
+}
+
+// apply rewrites an escaped request path. It returns the new escaped path,
+// possibly with a query, and the unescaped named captures.
+func (rules rewriteRules) apply(path string) (string, map[string]string, bool) {
+	for _, rw := range rules {
+		m := rw.re.FindStringSubmatchIndex(path)
+		if m == nil {
+			continue
+		}
+		params := captureParams(rw.re, path, m)
+		return rw.expand(path, m), params, true
+	}
+	return path, nil, false
+}
+
+// withRewriteParams attaches the parameters captured by the first
+// matching rewrite to the request, so header templates can use them. The
+// proxy director applies the rewrite itself.
+func withRewriteParams(rules rewriteRules, next http.Handler) http.Handler {
+	if len(rules) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, params, ok := rules.apply(r.URL.EscapedPath()); ok {
+			r = withRouteParams(r, params)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// joinURLPath joins an upstream base path and a request path, both
+// escaped, with exactly one slash between them.
+func joinURLPath(base, path string) string {
+	if base == "" || base == "/" {
+		return path
+	}
+	switch {
+	case strings.HasSuffix(base, "/") && strings.HasPrefix(path, "/"):
+		return base + path[1:]
+	case !strings.HasSuffix(base, "/") && !strings.HasPrefix(path, "/"):
+		return base + "/" + path
+	}
+	return base + path
+}
+
+// setEscapedPath sets u's path from its escaped form, keeping RawPath so
+// encoded characters such as %2F reach the upstream unchanged.
+func setEscapedPath(u *url.URL, escaped string) {
+	path, err := url.PathUnescape(escaped)
+	if err != nil {
+		u.Path, u.RawPath = escaped, ""
+		return
+	}
+	u.Path, u.RawPath = path, ""
+	if u.EscapedPath() != escaped {
+		u.RawPath = escaped
+	}
+}
+
+// mergeQuery adds the query of a rewrite target in front of the request's
+// own query parameters.
+func mergeQuery(ruleQuery, query string) string {
+	switch {
+	case ruleQuery == "":
+		return query
+	case query == "":
+		return ruleQuery
+	}
+	return ruleQuery + "&" + query
+}
+
+func validateRewrites(c *configIssues, rules []RewriteRule, path []interface{}) {
+	for i, rule := range rules {
+		if _, err := compileRewrite(rule); err != nil {
+			c.add(err.Error(), appendPath(path, i)...)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestRewrite_PathsQueriesAndBasePath(t *testing.T) {
+	var gotURI, gotParam string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotURI = r.RequestURI
+		gotParam = r.Header.Get("X-Item")
+	}))
+	t.Cleanup(upstream.Close)
+	u, _ := url.Parse(upstream.URL + "/base")
+	svc := &Service{Name: "rec", URL: u, Prefix: "/rec", StripPefix: true, Auth: "none", Middlewares: []string{},
+		Rewrite: []RewriteRule{
+			{Path: "/rec/v1/items/{id}", To: "/api/items/{id}"},
+			{Match: `^/rec/v1/search/(\w+)$`, To: "/api/search?kind={1}"},
+			{Path: "/rec/v1/tags/{tag}", To: "/api/tags?name={tag}"},
+		},
+		RequestHeaders: HeaderRules{Set: map[string]string{"X-Item": "{{param.id}}"}},
+	}
+	gw := setupGateway(t, map[string]*Service{"/rec": svc})
+
+	cases := []struct{ in, want string }{
+		{"/rec/v1/items/a%2Fb?x=1", "/base/api/items/a%2Fb?x=1"},
+		{"/rec/v1/search/books?q=go", "/base/api/search?kind=books&q=go"},
+		{"/rec/v1/tags/a&admin=1", "/base/api/tags?name=a%26admin%3D1"},
+		{"/rec/v1/tags/a%20b%2Fc", "/base/api/tags?name=a+b%2Fc"},
+		{"/rec/other/p%2Fq?y=2", "/base/other/p%2Fq?y=2"},
+		{"/rec", "/base/"},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		gw.ServeHTTP(w, httptest.NewRequest(http.MethodGet, c.in, nil))
+		if w.Code != http.StatusOK || gotURI != c.want {
+			t.Errorf("%s: expected upstream %s, got %s (%d)", c.in, c.want, gotURI, w.Code)
+		}
+	}
+
+	gw.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/rec/v1/items/a%2Fb", nil))
+	if gotParam != "a/b" {
+		t.Errorf("named param should be available unescaped to header templates, got %q", gotParam)
+	}
+}
+
+func TestLoadConfigFile_RewriteErrors(t *testing.T) {
+	path := writeConfig(t, `services:
+  - name: a
+    host: http://localhost:1
+    rewrite:
+      - path: /a/{id}
+        to: /items/{name}
+      - match: "(unclosed"
+        to: /x
+      - to: /y
+`)
+	_, err := loadConfigFile(path)
+	ve, ok := err.(ValidationError)
+	if !ok || len(ve) != 3 {
+		t.Fatalf("expected three rewrite errors, got %v", err)
+	}
+	if ve[0].Path != "services[0].rewrite[0]" || ve[0].Line != 5 {
+		t.Errorf("unexpected first error %+v", ve[0])
+	}
+}
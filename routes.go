@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// transportDrainTimeout is how long a retired transport keeps serving
+// in-flight requests before its remaining idle connections are closed.
+const transportDrainTimeout = 30 * time.Second
+
+// route is one service as served by a single config generation. The proxy
+// and the middleware chain are built from svc and are never shared with a
+// route that has different settings. Transports, one per upstream host, are
+// carried over when the service is rebuilt, so changing its settings does
+// not drop connections.
+type route struct {
+	key        string
+	svc        *Service
+	match      *matcher
+	hash       string
+	order      int // position of the service in the file, for lookup ties
+	proxy      http.Handler
+	transports map[string]*http.Transport
+	handler    http.Handler
+	endpoints  []*endpoint
+}
+
+// serve hands r to the route's handler, or to one of its endpoints when
+// the service declares routes.
+func (rt *route) serve(w http.ResponseWriter, r *http.Request) {
+	if len(rt.endpoints) == 0 {
+		rt.handler.ServeHTTP(w, r)
+		return
+	}
+	fallback := rt.handler
+	if rt.svc.Unmatched == "reject" {
+		fallback = nil
+	}
+	dispatch(rt.endpoints, fallback, w, r)
+}
+
+type routeTable struct {
+	generation uint64
+	routes     map[string]*route
+	// candidates lists the routes sharing each prefix in config order.
+	candidates map[string][]*route
+}
+
+// lookup returns the route for a request to prefix. Among the services
+// whose match conditions hold, the most specific wins (see
+// matchScore.better); ties go to the service listed first.
+func (t *routeTable) lookup(r *http.Request, prefix string, client netip.Addr) *route {
+	var best *route
+	var bestScore matchScore
+	host := requestHost(r)
+	for _, rt := range t.candidates[prefix] {
+		score, ok := rt.match.match(r, host, client)
+		if ok && (best == nil || score.better(bestScore)) {
+			best, bestScore = rt, score
+		}
+	}
+	return best
+}
+
+// serviceHash fingerprints everything in a Service that affects how its
+// requests are proxied, including the descriptors it transcodes with. It
+// returns "" when the service cannot be fingerprinted, and such a service
+// is rebuilt on every reload.
+func serviceHash(svc *Service) string {
+	data, err := json.Marshal(svc)
+	if err != nil {
+		return ""
+	}
+	if svc.transcoder != nil {
+		data = append(data, svc.transcoder.digest...)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// buildRouteTable creates the routes of the next generation, reusing the
+// previous route of a service when its content hash is unchanged.
+func (g *Gateway) buildRouteTable(services map[string]*Service, prev *routeTable) (*routeTable, []*route) {
+	previous := map[string]*route{}
+	if prev != nil {
+		for _, rt := range prev.routes {
+			previous[rt.svc.Name] = rt
+		}
+	}
+
+	table := &routeTable{
+		generation: g.generation + 1,
+		routes:     make(map[string]*route, len(services)),
+		candidates: make(map[string][]*route),
+	}
+	reused := map[*route]bool{}
+	for key, svc := range services {
+		hash := serviceHash(svc)
+		if old, ok := previous[svc.Name]; ok && hash != "" && old.hash == hash && old.key == key {
+			// The position of the service in the file is not part of the
+			// hash; the reused route takes the new one.
+			old.order = svc.order
+			table.routes[key] = old
+			reused[old] = true
+			continue
+		}
+		rt := &route{
+			key:        key,
+			svc:        svc,
+			match:      compileMatcher(svc.Match),
+			hash:       hash,
+			order:      svc.order,
+			transports: map[string]*http.Transport{},
+		}
+		transportFor := routeTransports(rt, previous[svc.Name])
+		rt.proxy = g.newUpstream(svc, transportFor)
+		rt.handler = g.compileChain(svc, g.serviceHandler(svc, rt.proxy))
+		rt.endpoints = g.compileEndpoints(svc, transportFor)
+		table.routes[key] = rt
+	}
+
+	for key, rt := range table.routes {
+		prefix, _, _ := strings.Cut(key, "#")
+		table.candidates[prefix] = append(table.candidates[prefix], rt)
+	}
+	for _, list := range table.candidates {
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].order != list[j].order {
+				return list[i].order < list[j].order
+			}
+			return list[i].svc.Name < list[j].svc.Name
+		})
+	}
+
+	var retired []*route
+	for _, rt := range previous {
+		if !reused[rt] {
+			retired = append(retired, rt)
+		}
+	}
+	return table, retired
+}
+
+// routeTransports returns the transportFor function of a new route: one
+// transport per upstream host and protocol, taken over from the service's
+// previous route when it used the same, and wrapped for retries.
+func routeTransports(rt *route, old *route) func(*url.URL) http.RoundTripper {
+	return func(u *url.URL) http.RoundTripper {
+		host := rt.svc.Protocol + " " + u.Scheme + "://" + u.Host
+		t, ok := rt.transports[host]
+		if !ok {
+			if old != nil {
+				t = old.transports[host]
+			}
+			if t == nil {
+				t = newTransport(rt.svc.Protocol)
+			}
+			rt.transports[host] = t
+		}
+		if rt.svc.Retries.Attempts > 0 {
+			return &retryTransport{base: t, cfg: rt.svc.Retries}
+		}
+		return t
+	}
+}
+
+// applyRoutes atomically swaps in a route table for services and retires
+// the transports no route uses any more.
+func (g *Gateway) applyRoutes(services map[string]*Service) *routeTable {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	prev, _ := g.atomicRoutes.Load().(*routeTable)
+	table, retired := g.buildRouteTable(services, prev)
+	g.atomicRoutes.Store(table)
+	g.generation = table.generation
+
+	if len(retired) > 0 {
+		live := map[*http.Transport]bool{}
+		for _, rt := range table.routes {
+			for _, t := range rt.transports {
+				live[t] = true
+			}
+		}
+		names := make([]string, 0, len(retired))
+		for _, rt := range retired {
+			names = append(names, rt.svc.Name)
+			for _, t := range rt.transports {
+				if !live[t] {
+					retireTransport(t)
+				}
+			}
+		}
+		sort.Strings(names)
+		g.logger.Info("reload", fmt.Sprintf("generation %d: rebuilt or removed proxies for %s", table.generation, strings.Join(names, ", ")))
+	}
+	return table
+}
+
+// retireTransport closes idle connections now and again once in-flight
+// requests have had time to finish, so no connection to the old upstream
+// is left open.
+func retireTransport(t *http.Transport) {
+	if t == nil {
+		return
+	}
+	t.CloseIdleConnections()
+	time.AfterFunc(transportDrainTimeout, t.CloseIdleConnections)
+}
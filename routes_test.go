@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestApplyRoutes_RebuildsChangedServices(t *testing.T) {
+	oldSrv := mockService(t, "old", http.StatusOK)
+	newSrv := mockService(t, "new", http.StatusOK)
+	otherSrv := mockService(t, "other", http.StatusOK)
+	oldURL, _ := url.Parse(oldSrv.URL)
+	newURL, _ := url.Parse(newSrv.URL)
+	otherURL, _ := url.Parse(otherSrv.URL)
+
+	gw := setupGateway(t, map[string]*Service{
+		"/user":  {Name: "user", Host: oldSrv.URL, URL: oldURL, Prefix: "/user"},
+		"/other": {Name: "other", Host: otherSrv.URL, URL: otherURL, Prefix: "/other"},
+	})
+	first := gw.atomicRoutes.Load().(*routeTable)
+
+	second := gw.applyRoutes(map[string]*Service{
+		"/user":  {Name: "user", Host: newSrv.URL, URL: newURL, Prefix: "/user"},
+		"/other": {Name: "other", Host: otherSrv.URL, URL: otherURL, Prefix: "/other"},
+	})
+
+	if second.generation != first.generation+1 {
+		t.Fatalf("expected generation to advance, got %d -> %d", first.generation, second.generation)
+	}
+	if second.routes["/other"] != first.routes["/other"] {
+		t.Error("unchanged service should keep its proxy")
+	}
+	if second.routes["/user"].proxy == first.routes["/user"].proxy {
+		t.Fatal("changed service should get a new proxy")
+	}
+
+	w := httptest.NewRecorder()
+	second.routes["/user"].proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/user/me", nil))
+	body, _ := io.ReadAll(w.Result().Body)
+	if string(body) != "new" {
+		t.Fatalf("expected traffic on the new host, got %q", body)
+	}
+}
+
+func TestApplyRoutes_ReusedRoutesFollowTheNewServiceOrder(t *testing.T) {
+	upstreams := map[string]string{"a": mockService(t, "a", http.StatusOK).URL, "b": mockService(t, "b", http.StatusOK).URL}
+	apply := func(gw *Gateway, first, second string) *Gateway {
+		yml := "defaults: {auth: none, middlewares: []}\nservices:\n"
+		for _, name := range []string{first, second} {
+			yml += fmt.Sprintf("  - {name: %s, host: %s, prefix: /users, match: {headers: {X-%s: '1'}}}\n", name, upstreams[name], name)
+		}
+		cfg, err := loadConfigFile(writeConfig(t, yml))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gw == nil {
+			return setupGateway(t, cfg.Routes)
+		}
+		gw.applyRoutes(cfg.Routes)
+		return gw
+	}
+	winner := func(gw *Gateway) string {
+		req := httptest.NewRequest(http.MethodGet, "/users/me", nil)
+		req.Header.Set("X-a", "1")
+		req.Header.Set("X-b", "1")
+		w := httptest.NewRecorder()
+		gw.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+
+	gw := apply(nil, "a", "b")
+	if got := winner(gw); got != "a" {
+		t.Fatalf("expected the first listed service, got %q", got)
+	}
+	// Both services are unchanged, so their routes are reused.
+	apply(gw, "b", "a")
+	if got := winner(gw); got != "b" {
+		t.Errorf("expected b after it moved first, got %q", got)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// StreamConfig governs long-lived requests: WebSocket (and other Upgrade)
+// connections and server-sent event streams. Only services that enable
+// streams treat such requests differently; elsewhere they are subject to
+// the usual limits. Zero values mean no limit.
+type StreamConfig struct {
+	Enabled        bool          `yaml:"enabled"`
+	MaxConnections int           `yaml:"max_connections"`
+	IdleTimeout    time.Duration `yaml:"idle_timeout"`
+	MaxLifetime    time.Duration `yaml:"max_lifetime"`
+	// FlushInterval is how often the proxy flushes responses it does not
+	// recognise as streams; event streams are always flushed at once.
+	FlushInterval time.Duration `yaml:"flush_interval"`
+}
+
+var (
+	errStreamIdle     = errors.New("idle timeout")
+	errStreamLifetime = errors.New("max lifetime reached")
+)
+
+type streamKindKey struct{}
+
+// requestedStream returns "upgrade" or "sse" for requests that ask to open
+// a long-lived stream, and "" otherwise. It goes by the client's headers
+// alone.
+func requestedStream(r *http.Request) string {
+	if r.Header.Get("Upgrade") != "" && headerHasToken(r.Header, "Connection", "upgrade") {
+		return "upgrade"
+	}
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		return "sse"
+	}
+	return ""
+}
+
+// streamKind returns the kind of stream r opens once allowStreams has
+// accepted it as one, and "" otherwise. Streams skip the concurrency limit,
+// the upstream timeout, the cache, coalescing, mirroring and the access log,
+// so a client cannot opt out of them by sending stream headers to a
+// service that does not serve streams.
+func streamKind(r *http.Request) string {
+	kind, _ := r.Context().Value(streamKindKey{}).(string)
+	return kind
+}
+
+// allowStreams marks the stream requests of a service with streams enabled.
+func allowStreams(cfg StreamConfig, next http.Handler) http.Handler {
+	if !cfg.Enabled {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if kind := requestedStream(r); kind != "" {
+			r = r.WithContext(context.WithValue(r.Context(), streamKindKey{}, kind))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// openStreams returns the counter of open streams of a service. It is kept
+// by name so streams opened before a reload still count after it.
+func (g *Gateway) openStreams(service string) *atomic.Int64 {
+	v, _ := g.streams.LoadOrStore(service, new(atomic.Int64))
+	return v.(*atomic.Int64)
+}
+
+// streamHandler applies the service's stream limits to long-lived requests
+// and logs each stream when it closes. Other requests pass through.
+type streamHandler struct {
+	service string
+	cfg     StreamConfig
+	open    *atomic.Int64
+	next    http.Handler
+	logger  *Log
+}
+
+func (g *Gateway) newStreamHandler(svc *Service, next http.Handler) *streamHandler {
+	return &streamHandler{service: svc.Name, cfg: svc.Streams, open: g.openStreams(svc.Name), next: next, logger: g.logger}
+}
+
+func (h *streamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	kind := streamKind(r)
+	if kind == "" {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	if n := h.open.Add(1); h.cfg.MaxConnections > 0 && n > int64(h.cfg.MaxConnections) {
+		h.open.Add(-1)
+		w.Header().Set("Retry-After", "1")
+		JSONBadResponse(w, "too many open streams", http.StatusServiceUnavailable,
+			fmt.Sprintf("service %s allows %d concurrent streams", h.service, h.cfg.MaxConnections))
+		return
+	}
+	defer h.open.Add(-1)
+	// Streams outlive the server's read and write timeouts; their idle
+	// timeout and lifetime apply instead.
+	rc := http.NewResponseController(w)
+	_ = rc.SetReadDeadline(time.Time{})
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	// Canceling the request ends the stream: the proxy closes the hijacked
+	// connection of an upgrade, or stops copying events.
+	ctx, cancel := context.WithCancelCause(r.Context())
+	defer cancel(nil)
+	s := &streamWriter{ResponseWriter: w, start: time.Now()}
+	s.touch()
+	stop := s.watch(h.cfg, cancel)
+	defer func() {
+		stop()
+		reason := "closed"
+		ended := context.Cause(ctx)
+		if errors.Is(ended, errStreamIdle) || errors.Is(ended, errStreamLifetime) {
+			reason = ended.Error()
+		}
+		h.logger.Info("stream", fmt.Sprintf("service %s: %s stream %s %s %s after %s, %d bytes in, %d bytes out",
+			h.service, kind, r.Method, r.URL.Path, reason, time.Since(s.start).Round(time.Millisecond),
+			s.in.Load(), s.out.Load()))
+		// The proxy aborts the handler when copying a response body fails.
+		// When we ended the stream, finish the response instead.
+		if rec := recover(); rec != nil && (rec != http.ErrAbortHandler || reason == "closed") {
+			panic(rec)
+		}
+	}()
+	h.next.ServeHTTP(s, r.WithContext(ctx))
+}
+
+// streamWriter counts the bytes of a stream and when it last carried
+// data. A hijacked connection is wrapped so both directions are counted.
+type streamWriter struct {
+	http.ResponseWriter
+	start    time.Time
+	lastSeen atomic.Int64
+	in, out  atomic.Int64
+}
+
+func (s *streamWriter) touch() {
+	s.lastSeen.Store(time.Now().UnixNano())
+}
+
+// watch cancels the stream when it has been idle for cfg.IdleTimeout or
+// open for cfg.MaxLifetime. The returned function stops the timers.
+func (s *streamWriter) watch(cfg StreamConfig, cancel context.CancelCauseFunc) func() {
+	var timers []*time.Timer
+	if cfg.MaxLifetime > 0 {
+		timers = append(timers, time.AfterFunc(cfg.MaxLifetime, func() { cancel(errStreamLifetime) }))
+	}
+	if cfg.IdleTimeout > 0 {
+		var idle *time.Timer
+		idle = time.AfterFunc(cfg.IdleTimeout, func() {
+			quiet := time.Since(time.Unix(0, s.lastSeen.Load()))
+			if quiet >= cfg.IdleTimeout {
+				cancel(errStreamIdle)
+				return
+			}
+			idle.Reset(cfg.IdleTimeout - quiet)
+		})
+		timers = append(timers, idle)
+	}
+	return func() {
+		for _, t := range timers {
+			t.Stop()
+		}
+	}
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	n, err := s.ResponseWriter.Write(p)
+	s.out.Add(int64(n))
+	s.touch()
+	return n, err
+}
+
+func (s *streamWriter) Flush() {
+	_ = http.NewResponseController(s.ResponseWriter).Flush()
+}
+
+func (s *streamWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(s.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &streamConn{Conn: conn, stream: s}, brw, nil
+}
+
+func (s *streamWriter) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+type streamConn struct {
+	net.Conn
+	stream *streamWriter
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.stream.in.Add(int64(n))
+	c.stream.touch()
+	return n, err
+}
+
+func (c *streamConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.stream.out.Add(int64(n))
+	c.stream.touch()
+	return n, err
+}
+
+func validateStreams(c *configIssues, cfg StreamConfig, path []interface{}) {
+	if cfg.MaxConnections < 0 {
+		c.addf(appendPath(path, "max_connections"), "must not be negative, got %d", cfg.MaxConnections)
+	}
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{{"idle_timeout", cfg.IdleTimeout}, {"max_lifetime", cfg.MaxLifetime}, {"flush_interval", cfg.FlushInterval}} {
+		if d.value < 0 {
+			c.addf(appendPath(path, d.name), "must not be negative, got %s", d.value)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// echoUpgrade answers an "Upgrade: echo" request by echoing every byte.
+func echoUpgrade(t *testing.T) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		brw.Flush()
+		io.Copy(conn, brw)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func dialUpgrade(t *testing.T, addr string) (net.Conn, *bufio.Reader, int) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	fmt.Fprint(conn, "GET /live/tail HTTP/1.1\r\nHost: gateway\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, br, resp.StatusCode
+}
+
+func TestStreams_UpgradeLimitsAndIdleTimeout(t *testing.T) {
+	upstream := echoUpgrade(t)
+	cfg, err := loadConfigFile(writeConfig(t, fmt.Sprintf(`services:
+  - name: live
+    host: %s
+    prefix: /live
+    auth: none
+    timeout: 50ms
+    concurrency: {max_in_flight: 1}
+    streams:
+      enabled: true
+      max_connections: 1
+      idle_timeout: 300ms
+`, upstream.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw := httptest.NewServer(setupGateway(t, cfg.Routes))
+	t.Cleanup(gw.Close)
+	addr := strings.TrimPrefix(gw.URL, "http://")
+
+	conn, br, status := dialUpgrade(t, addr)
+	if status != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %d", status)
+	}
+	// Outlives the service timeout as long as data flows.
+	for i := 0; i < 3; i++ {
+		time.Sleep(100 * time.Millisecond)
+		fmt.Fprint(conn, "ping")
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(br, buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("echo %d: got %q, %v", i, buf, err)
+		}
+	}
+
+	if _, _, status := dialUpgrade(t, addr); status != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 over max_connections, got %d", status)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := br.ReadByte(); err == nil {
+		t.Fatal("expected the idle stream to be closed")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("idle stream was not closed by the gateway")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if _, _, status := dialUpgrade(t, addr); status != http.StatusSwitchingProtocols {
+		t.Errorf("expected the slot to be released, got %d", status)
+	}
+}
+
+func TestStreams_EventStreamMaxLifetime(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		for i := 0; ; i++ {
+			if _, err := fmt.Fprintf(w, "data: %d\n\n", i); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	cfg, err := loadConfigFile(writeConfig(t, fmt.Sprintf(`services:
+  - name: live
+    host: %s
+    prefix: /live
+    auth: none
+    streams: {enabled: true, max_lifetime: 200ms}
+`, upstream.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw := httptest.NewServer(setupGateway(t, cfg.Routes))
+	t.Cleanup(gw.Close)
+
+	req, _ := http.NewRequest(http.MethodGet, gw.URL+"/live/events", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if cc := resp.Header.Values("Cache-Control"); len(cc) != 1 || cc[0] != "no-cache" {
+		t.Errorf("expected the upstream's Cache-Control, got %q", cc)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("stream was not ended by max_lifetime (%s)", elapsed)
+	}
+	if !strings.Contains(string(body), "data: 1\n\n") {
+		t.Errorf("expected events to be flushed, got %q", body)
+	}
+}
+
+func TestStreams_HeadersAloneDoNotLiftLimits(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	cfg, err := loadConfigFile(writeConfig(t, fmt.Sprintf(`services:
+  - name: orders
+    host: %s
+    prefix: /orders
+    auth: none
+    timeout: 50ms
+`, upstream.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw := setupGateway(t, cfg.Routes)
+
+	req := httptest.NewRequest(http.MethodGet, "/orders/1", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	w := httptest.NewRecorder()
+	start := time.Now()
+	gw.ServeHTTP(w, req)
+	if w.Code != http.StatusGatewayTimeout || time.Since(start) > 500*time.Millisecond {
+		t.Errorf("expected the service timeout to apply, got %d after %s", w.Code, time.Since(start))
+	}
+}
@@ -0,0 +1,729 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// TranscodeConfig lets REST clients call the gRPC methods of a service with
+// JSON. Descriptors is a descriptor set built with protoc --include_imports
+// --descriptor_set_out. Methods are mapped by their google.api.http
+// annotations and by Rules, which are tried first.
+type TranscodeConfig struct {
+	Descriptors string          `yaml:"descriptors"`
+	Rules       []TranscodeRule `yaml:"rules"`
+}
+
+// TranscodeRule maps an HTTP route to a gRPC method, like a google.api.http
+// annotation. HTTP is a method and a path template such as
+// "GET /v1/users/{user_id}". Body names the request field the JSON body
+// fills, or "*" for the whole request message.
+type TranscodeRule struct {
+	Method string `yaml:"method"` // package.Service/Method
+	HTTP   string `yaml:"http"`
+	Body   string `yaml:"body"`
+}
+
+// httpRuleField is the field number of the google.api.http extension of
+// MethodOptions. The extension is read from the unknown fields of the
+// options, so the annotations package need not be linked in.
+const httpRuleField = 72295728
+
+const maxGRPCMessageBytes = 4 << 20
+
+// httpTemplate is a compiled google.api.http path template. fields holds
+// the request field path bound by each capturing group.
+type httpTemplate struct {
+	re     *regexp.Regexp
+	fields []string
+}
+
+// compileHTTPTemplate compiles templates like /v1/{name=shelves/*}/books
+// or /v1/users/{user_id}:activate. A variable without a pattern matches
+// one segment; ** matches the rest of the path.
+func compileHTTPTemplate(tmpl string) (*httpTemplate, error) {
+	if !strings.HasPrefix(tmpl, "/") {
+		return nil, fmt.Errorf("path template %q must start with /", tmpl)
+	}
+	var verb string
+	if i := strings.LastIndex(tmpl, ":"); i > strings.LastIndex(tmpl, "/") && i > strings.LastIndex(tmpl, "}") {
+		tmpl, verb = tmpl[:i], tmpl[i:]
+	}
+	t := &httpTemplate{}
+	var b strings.Builder
+	b.WriteString("^")
+	for rest := tmpl; rest != ""; {
+		if rest[0] != '/' {
+			return nil, fmt.Errorf("unexpected %q in path template", rest)
+		}
+		rest = rest[1:]
+		b.WriteString("/")
+		if strings.HasPrefix(rest, "{") {
+			end := strings.IndexByte(rest, '}')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated variable in path template %q", tmpl)
+			}
+			field, pattern, ok := strings.Cut(rest[1:end], "=")
+			if !ok {
+				pattern = "*"
+			}
+			if field == "" || pattern == "" {
+				return nil, fmt.Errorf("invalid variable {%s}", rest[1:end])
+			}
+			t.fields = append(t.fields, field)
+			b.WriteString("(" + segmentsRegexp(pattern) + ")")
+			rest = rest[end+1:]
+			continue
+		}
+		end := strings.IndexByte(rest, '/')
+		if end < 0 {
+			end = len(rest)
+		}
+		if strings.ContainsAny(rest[:end], "{}") {
+			return nil, fmt.Errorf("invalid segment %q", rest[:end])
+		}
+		b.WriteString(segmentsRegexp(rest[:end]))
+		rest = rest[end:]
+	}
+	b.WriteString(regexp.QuoteMeta(verb) + "$")
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return nil, err
+	}
+	t.re = re
+	return t, nil
+}
+
+func segmentsRegexp(pattern string) string {
+	parts := strings.Split(pattern, "/")
+	for i, p := range parts {
+		switch p {
+		case "*":
+			parts[i] = "[^/]+"
+		case "**":
+			parts[i] = ".+"
+		default:
+			parts[i] = regexp.QuoteMeta(p)
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// match returns the unescaped values of the template's variables.
+func (t *httpTemplate) match(path string) ([]string, bool) {
+	m := t.re.FindStringSubmatch(path)
+	if m == nil {
+		return nil, false
+	}
+	values := m[1:]
+	for i, v := range values {
+		if u, err := url.PathUnescape(v); err == nil {
+			values[i] = u
+		}
+	}
+	return values, true
+}
+
+type transcodeBinding struct {
+	verb     string
+	template *httpTemplate
+	body     string
+	method   protoreflect.MethodDescriptor
+	path     string // /package.Service/Method
+}
+
+// transcoder is a compiled TranscodeConfig. digest fingerprints the
+// descriptor set, so a changed file rebuilds the route on reload.
+type transcoder struct {
+	digest   string
+	bindings []*transcodeBinding
+}
+
+func loadTranscoder(cfg TranscodeConfig) (*transcoder, error) {
+	data, err := os.ReadFile(cfg.Descriptors)
+	if err != nil {
+		return nil, err
+	}
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("%s is not a descriptor set: %w", cfg.Descriptors, err)
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", cfg.Descriptors, err)
+	}
+	t := &transcoder{digest: descriptorDigest(data)}
+
+	for i, rule := range cfg.Rules {
+		b, err := compileTranscodeRule(files, rule)
+		if err != nil {
+			return nil, fmt.Errorf("rules[%d]: %w", i, err)
+		}
+		t.bindings = append(t.bindings, b)
+	}
+	for _, fdp := range set.File {
+		fd, err := files.FindFileByPath(fdp.GetName())
+		if err != nil {
+			continue
+		}
+		for i := 0; i < fd.Services().Len(); i++ {
+			methods := fd.Services().Get(i).Methods()
+			for j := 0; j < methods.Len(); j++ {
+				m := methods.Get(j)
+				if m.IsStreamingClient() || m.IsStreamingServer() {
+					continue
+				}
+				for _, rule := range httpRules(m) {
+					b, err := newTranscodeBinding(m, rule.verb, rule.path, rule.body)
+					if err != nil {
+						return nil, fmt.Errorf("%s: %w", m.FullName(), err)
+					}
+					t.bindings = append(t.bindings, b)
+				}
+			}
+		}
+	}
+	if len(t.bindings) == 0 {
+		return nil, fmt.Errorf("no method in %s has a google.api.http annotation, and no rules are set", cfg.Descriptors)
+	}
+	return t, nil
+}
+
+func descriptorDigest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// descriptorFiles returns the descriptor sets read by the services of
+// routes, sorted.
+func descriptorFiles(routes map[string]*Service) []string {
+	seen := map[string]bool{}
+	var files []string
+	for _, svc := range routes {
+		if f := svc.Transcode.Descriptors; f != "" && !seen[f] {
+			seen[f] = true
+			files = append(files, f)
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// loadedDescriptors fingerprints the descriptor sets as the services of
+// routes loaded them; descriptorsOnDisk fingerprints the same files as
+// they are now. The two are equal while no descriptor set has changed.
+func loadedDescriptors(routes map[string]*Service) string {
+	digests := map[string]string{}
+	for _, svc := range routes {
+		if svc.transcoder != nil {
+			digests[svc.Transcode.Descriptors] = svc.transcoder.digest
+		}
+	}
+	var b strings.Builder
+	for _, f := range descriptorFiles(routes) {
+		fmt.Fprintf(&b, "%s=%s\n", f, digests[f])
+	}
+	return b.String()
+}
+
+func descriptorsOnDisk(files []string) string {
+	var b strings.Builder
+	for _, f := range files {
+		digest := ""
+		if data, err := os.ReadFile(f); err == nil {
+			digest = descriptorDigest(data)
+		}
+		fmt.Fprintf(&b, "%s=%s\n", f, digest)
+	}
+	return b.String()
+}
+
+func compileTranscodeRule(files *protoregistry.Files, rule TranscodeRule) (*transcodeBinding, error) {
+	name := strings.ReplaceAll(strings.TrimPrefix(rule.Method, "/"), "/", ".")
+	d, err := files.FindDescriptorByName(protoreflect.FullName(name))
+	if err != nil {
+		return nil, fmt.Errorf("unknown method %q", rule.Method)
+	}
+	m, ok := d.(protoreflect.MethodDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%q is not a method", rule.Method)
+	}
+	if m.IsStreamingClient() || m.IsStreamingServer() {
+		return nil, fmt.Errorf("streaming method %q cannot be transcoded", rule.Method)
+	}
+	verb, path, ok := strings.Cut(strings.TrimSpace(rule.HTTP), " ")
+	verb = strings.ToUpper(verb)
+	if !ok || !knownMethods[verb] {
+		return nil, fmt.Errorf("http must be a method and a path, such as \"GET /v1/items/{id}\", got %q", rule.HTTP)
+	}
+	return newTranscodeBinding(m, verb, strings.TrimSpace(path), rule.Body)
+}
+
+func newTranscodeBinding(m protoreflect.MethodDescriptor, verb, path, body string) (*transcodeBinding, error) {
+	tmpl, err := compileHTTPTemplate(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range tmpl.fields {
+		if _, err := fieldPath(m.Input(), f); err != nil {
+			return nil, err
+		}
+	}
+	if body != "" && body != "*" {
+		if m.Input().Fields().ByName(protoreflect.Name(body)) == nil {
+			return nil, fmt.Errorf("body field %q is not in %s", body, m.Input().FullName())
+		}
+	}
+	return &transcodeBinding{
+		verb:     verb,
+		template: tmpl,
+		body:     body,
+		method:   m,
+		path:     "/" + string(m.Parent().FullName()) + "/" + string(m.Name()),
+	}, nil
+}
+
+type httpRule struct {
+	verb, path, body string
+}
+
+// httpRules returns the google.api.http rule of a method and its
+// additional bindings.
+func httpRules(m protoreflect.MethodDescriptor) []httpRule {
+	opts, ok := m.Options().(*descriptorpb.MethodOptions)
+	if !ok || opts == nil {
+		return nil
+	}
+	var out []httpRule
+	raw := opts.ProtoReflect().GetUnknown()
+	for len(raw) > 0 {
+		num, typ, n := protowire.ConsumeTag(raw)
+		if n < 0 {
+			break
+		}
+		raw = raw[n:]
+		if num == httpRuleField && typ == protowire.BytesType {
+			v, n := protowire.ConsumeBytes(raw)
+			if n < 0 {
+				break
+			}
+			out = parseHTTPRule(v, out)
+			raw = raw[n:]
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, raw)
+		if n < 0 {
+			break
+		}
+		raw = raw[n:]
+	}
+	return out
+}
+
+// parseHTTPRule decodes a google.api.HttpRule message.
+func parseHTTPRule(b []byte, out []httpRule) []httpRule {
+	var r httpRule
+	var additional [][]byte
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			break
+		}
+		b = b[n:]
+		if typ != protowire.BytesType {
+			if n = protowire.ConsumeFieldValue(num, typ, b); n < 0 {
+				break
+			}
+			b = b[n:]
+			continue
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			break
+		}
+		b = b[n:]
+		switch num {
+		case 2:
+			r.verb, r.path = http.MethodGet, string(v)
+		case 3:
+			r.verb, r.path = http.MethodPut, string(v)
+		case 4:
+			r.verb, r.path = http.MethodPost, string(v)
+		case 5:
+			r.verb, r.path = http.MethodDelete, string(v)
+		case 6:
+			r.verb, r.path = http.MethodPatch, string(v)
+		case 7:
+			r.body = string(v)
+		case 8: // custom: CustomHttpPattern{kind = 1, path = 2}
+			for len(v) > 0 {
+				cnum, ctyp, cn := protowire.ConsumeTag(v)
+				if cn < 0 || ctyp != protowire.BytesType {
+					break
+				}
+				s, sn := protowire.ConsumeBytes(v[cn:])
+				if sn < 0 {
+					break
+				}
+				if cnum == 1 {
+					r.verb = strings.ToUpper(string(s))
+				} else if cnum == 2 {
+					r.path = string(s)
+				}
+				v = v[cn+sn:]
+			}
+		case 11:
+			additional = append(additional, v)
+		}
+	}
+	if r.path != "" {
+		out = append(out, r)
+	}
+	for _, a := range additional {
+		out = parseHTTPRule(a, out)
+	}
+	return out
+}
+
+// fieldPath resolves a dotted field path, by proto or JSON names, to the
+// descriptors of each step.
+func fieldPath(md protoreflect.MessageDescriptor, path string) ([]protoreflect.FieldDescriptor, error) {
+	var out []protoreflect.FieldDescriptor
+	names := strings.Split(path, ".")
+	for i, name := range names {
+		fd := md.Fields().ByName(protoreflect.Name(name))
+		if fd == nil {
+			fd = md.Fields().ByJSONName(name)
+		}
+		if fd == nil {
+			return nil, fmt.Errorf("field %q is not in %s", path, md.FullName())
+		}
+		out = append(out, fd)
+		if i == len(names)-1 {
+			break
+		}
+		if fd.Kind() != protoreflect.MessageKind || fd.IsList() || fd.IsMap() {
+			return nil, fmt.Errorf("field %q: %s is not a message", path, name)
+		}
+		md = fd.Message()
+	}
+	return out, nil
+}
+
+// setParam adds a URL parameter to params, the JSON form of a request
+// message, under the field's JSON name.
+func setParam(md protoreflect.MessageDescriptor, params map[string]interface{}, path string, values []string) error {
+	fds, err := fieldPath(md, path)
+	if err != nil {
+		return err
+	}
+	m := params
+	for _, fd := range fds[:len(fds)-1] {
+		sub, ok := m[fd.JSONName()].(map[string]interface{})
+		if !ok {
+			sub = map[string]interface{}{}
+			m[fd.JSONName()] = sub
+		}
+		m = sub
+	}
+	fd := fds[len(fds)-1]
+	if fd.IsMap() {
+		return fmt.Errorf("map field %q cannot be set from the URL", path)
+	}
+	// protojson takes numbers as strings, but bools and enum numbers as
+	// JSON literals only.
+	value := func(s string) interface{} {
+		switch fd.Kind() {
+		case protoreflect.BoolKind:
+			if b, err := strconv.ParseBool(s); err == nil {
+				return b
+			}
+		case protoreflect.EnumKind:
+			if n, err := strconv.Atoi(s); err == nil {
+				return n
+			}
+		}
+		return s
+	}
+	if fd.IsList() {
+		list := make([]interface{}, len(values))
+		for i, v := range values {
+			list[i] = value(v)
+		}
+		m[fd.JSONName()] = list
+		return nil
+	}
+	m[fd.JSONName()] = value(values[0])
+	return nil
+}
+
+// request builds the gRPC request message from the JSON body, the path
+// variables and, for fields not bound otherwise, the query parameters.
+func (b *transcodeBinding) request(r *http.Request, values []string) (proto.Message, error) {
+	input := b.method.Input()
+	msg := dynamicpb.NewMessage(input)
+	if b.body != "" && r.Body != nil {
+		data, err := io.ReadAll(io.LimitReader(r.Body, maxGRPCMessageBytes+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > maxGRPCMessageBytes {
+			return nil, fmt.Errorf("body is larger than %d bytes", maxGRPCMessageBytes)
+		}
+		if len(bytes.TrimSpace(data)) > 0 {
+			if b.body != "*" {
+				name, _ := json.Marshal(input.Fields().ByName(protoreflect.Name(b.body)).JSONName())
+				data = []byte(fmt.Sprintf("{%s:%s}", name, data))
+			}
+			if err := protojson.Unmarshal(data, msg); err != nil {
+				return nil, fmt.Errorf("invalid JSON body: %v", err)
+			}
+		}
+	}
+
+	params := map[string]interface{}{}
+	bound := map[string]bool{b.body: true}
+	for i, f := range b.template.fields {
+		bound[f] = true
+		if err := setParam(input, params, f, values[i:i+1]); err != nil {
+			return nil, err
+		}
+	}
+	if b.body != "*" {
+		for key, vals := range r.URL.Query() {
+			if bound[key] || bound[strings.SplitN(key, ".", 2)[0]] {
+				continue
+			}
+			// Parameters that are not fields, such as cache busters, are
+			// ignored.
+			_ = setParam(input, params, key, vals)
+		}
+	}
+	if len(params) > 0 {
+		data, _ := json.Marshal(params)
+		p := dynamicpb.NewMessage(input)
+		if err := protojson.Unmarshal(data, p); err != nil {
+			return nil, fmt.Errorf("invalid parameter: %v", err)
+		}
+		proto.Merge(msg, p)
+	}
+	return msg, nil
+}
+
+// transcodeHandler turns REST calls into unary gRPC calls. Requests that
+// already speak gRPC go to next, the plain proxy.
+type transcodeHandler struct {
+	t         *transcoder
+	service   string
+	prefix    string
+	strip     bool
+	next      http.Handler
+	director  func(*http.Request)
+	onError   func(http.ResponseWriter, *http.Request, error)
+	transport http.RoundTripper
+}
+
+func (g *Gateway) newTranscoder(svc *Service, next http.Handler, transportFor func(*url.URL) http.RoundTripper) http.Handler {
+	transport := transportFor(svc.URL)
+	proxy := g.newReverseProxy(svc, transport)
+	return &transcodeHandler{
+		t:         svc.transcoder,
+		service:   svc.Name,
+		prefix:    svc.Prefix,
+		strip:     svc.StripPefix,
+		next:      next,
+		director:  proxy.Director,
+		onError:   proxy.ErrorHandler,
+		transport: transport,
+	}
+}
+
+func (h *transcodeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if isGRPCRequest(r) {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	path := r.URL.EscapedPath()
+	if h.strip {
+		if path = strings.TrimPrefix(path, h.prefix); path == "" {
+			path = "/"
+		}
+	}
+	var binding *transcodeBinding
+	var values []string
+	for _, b := range h.t.bindings {
+		if v, ok := b.template.match(path); ok && b.verb == r.Method {
+			binding, values = b, v
+			break
+		}
+	}
+	if binding == nil {
+		JSONBadResponse(w, "route not found", http.StatusNotFound,
+			fmt.Sprintf("no gRPC method of service %s is mapped to %s %s", h.service, r.Method, path))
+		return
+	}
+	msg, err := binding.request(r, values)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		bodyTooLarge(w, h.service, tooLarge.Limit)
+		return
+	}
+	if err != nil {
+		JSONBadResponse(w, "invalid request", http.StatusBadRequest, err.Error())
+		return
+	}
+	payload, err := proto.Marshal(msg)
+	if err != nil {
+		JSONBadResponse(w, "invalid request", http.StatusBadRequest, err.Error())
+		return
+	}
+	frame := make([]byte, 5+len(payload))
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(payload)))
+	copy(frame[5:], payload)
+
+	out := r.Clone(r.Context())
+	out.Method = http.MethodPost
+	out.Body = io.NopCloser(bytes.NewReader(frame))
+	out.ContentLength = int64(len(frame))
+	out.GetBody = nil
+	out.RequestURI = ""
+	h.director(out)
+	for _, k := range []string{"Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade", "Accept", "Accept-Encoding", "Content-Length"} {
+		out.Header.Del(k)
+	}
+	out.Header.Set("Content-Type", "application/grpc")
+	out.Header.Set("Te", "trailers")
+	out.URL.Path, out.URL.RawPath, out.URL.RawQuery = binding.path, "", ""
+
+	resp, err := h.transport.RoundTrip(out)
+	if err != nil {
+		h.onError(w, r, err)
+		return
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 5+maxGRPCMessageBytes+1))
+	if err != nil {
+		h.onError(w, r, err)
+		return
+	}
+	// The trailers follow the body, so a reply cut off here has no status.
+	if len(data) > 5+maxGRPCMessageBytes {
+		JSONBadResponse(w, "response too large", http.StatusBadGateway,
+			fmt.Sprintf("service %s sent a reply larger than %d bytes for %s", h.service, maxGRPCMessageBytes, binding.path))
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		JSONBadResponse(w, "bad gateway", http.StatusBadGateway,
+			fmt.Sprintf("service %s answered HTTP %d to %s", h.service, resp.StatusCode, binding.path))
+		return
+	}
+
+	code, message := grpcStatus(resp)
+	if code != grpcOK {
+		name := grpcCodeNames[grpcUnknown]
+		if code >= 0 && code < len(grpcCodeNames) {
+			name = grpcCodeNames[code]
+		}
+		if message == "" {
+			message = strings.ToLower(strings.ReplaceAll(name, "_", " "))
+		}
+		JSONBadResponse(w, message, grpcHTTPStatus(code), map[string]interface{}{"grpc_code": code, "grpc_status": name})
+		return
+	}
+
+	reply := dynamicpb.NewMessage(binding.method.Output())
+	if err := decodeGRPCFrame(data, reply); err != nil {
+		JSONBadResponse(w, "bad gateway", http.StatusBadGateway,
+			fmt.Sprintf("invalid response from service %s: %v", h.service, err))
+		return
+	}
+	body, err := protojson.Marshal(reply)
+	if err != nil {
+		JSONBadResponse(w, "bad gateway", http.StatusBadGateway, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(body)
+}
+
+// grpcStatus reads the status of a gRPC response from its trailers, or
+// from its headers for a trailers-only response.
+func grpcStatus(resp *http.Response) (int, string) {
+	status, message := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	if status == "" {
+		return grpcUnknown, "upstream sent no grpc-status"
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return grpcUnknown, "invalid grpc-status " + status
+	}
+	if m, err := url.PathUnescape(message); err == nil {
+		message = m
+	}
+	return code, message
+}
+
+// decodeGRPCFrame unmarshals the single message of a unary response.
+func decodeGRPCFrame(data []byte, msg proto.Message) error {
+	if len(data) < 5 {
+		return errors.New("no message")
+	}
+	if data[0] != 0 {
+		return errors.New("compressed messages are not supported")
+	}
+	n := binary.BigEndian.Uint32(data[1:5])
+	if uint64(len(data)-5) < uint64(n) {
+		return errors.New("truncated message")
+	}
+	return proto.Unmarshal(data[5:5+n], msg)
+}
+
+// validateTranscode checks the transcoding of svc and loads its
+// descriptor set, keeping the transcoder on svc so the file is read once.
+func validateTranscode(c *configIssues, svc *Service, path []interface{}) {
+	cfg := svc.Transcode
+	if cfg.Descriptors == "" {
+		if len(cfg.Rules) > 0 {
+			c.add("descriptors is required", appendPath(path, "descriptors")...)
+		}
+		return
+	}
+	if svc.Protocol != "grpc" {
+		c.add("transcoding needs protocol: grpc", path...)
+	}
+	if len(svc.Backends) > 0 {
+		c.add("transcoding cannot be combined with backends", path...)
+	}
+	t, err := loadTranscoder(cfg)
+	if err != nil {
+		c.add(err.Error(), path...)
+		return
+	}
+	svc.transcoder = t
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// recsDescriptors describes recs.v1.Recommender, whose List method has a
+// google.api.http annotation and whose Rate method has none.
+func recsDescriptors(t *testing.T) (*descriptorpb.FileDescriptorProto, string) {
+	field := func(name string, num int32, typ descriptorpb.FieldDescriptorProto_Type, label descriptorpb.FieldDescriptorProto_Label, msg string) *descriptorpb.FieldDescriptorProto {
+		f := &descriptorpb.FieldDescriptorProto{Name: proto.String(name), Number: proto.Int32(num), Type: typ.Enum(), Label: label.Enum()}
+		if msg != "" {
+			f.TypeName = proto.String(msg)
+		}
+		return f
+	}
+	opt := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+	rep := descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+	str := descriptorpb.FieldDescriptorProto_TYPE_STRING
+
+	var rule []byte
+	rule = protowire.AppendTag(rule, 2, protowire.BytesType)
+	rule = protowire.AppendString(rule, "/v1/users/{user_id}/recommendations")
+	listOpts := &descriptorpb.MethodOptions{}
+	var ext []byte
+	ext = protowire.AppendTag(ext, httpRuleField, protowire.BytesType)
+	ext = protowire.AppendBytes(ext, rule)
+	listOpts.ProtoReflect().SetUnknown(ext)
+
+	fd := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("recs/v1/recs.proto"),
+		Package: proto.String("recs.v1"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{Name: proto.String("ListRequest"), Field: []*descriptorpb.FieldDescriptorProto{
+				field("user_id", 1, str, opt, ""),
+				field("limit", 2, descriptorpb.FieldDescriptorProto_TYPE_INT32, opt, ""),
+				field("fresh", 3, descriptorpb.FieldDescriptorProto_TYPE_BOOL, opt, ""),
+			}},
+			{Name: proto.String("Item"), Field: []*descriptorpb.FieldDescriptorProto{
+				field("id", 1, str, opt, ""),
+				field("score", 2, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE, opt, ""),
+			}},
+			{Name: proto.String("ListResponse"), Field: []*descriptorpb.FieldDescriptorProto{
+				field("items", 1, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, rep, ".recs.v1.Item"),
+			}},
+			{Name: proto.String("RateRequest"), Field: []*descriptorpb.FieldDescriptorProto{
+				field("user_id", 1, str, opt, ""),
+				field("item", 2, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, opt, ".recs.v1.Item"),
+			}},
+		},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Recommender"),
+			Method: []*descriptorpb.MethodDescriptorProto{
+				{Name: proto.String("List"), InputType: proto.String(".recs.v1.ListRequest"), OutputType: proto.String(".recs.v1.ListResponse"), Options: listOpts},
+				{Name: proto.String("Rate"), InputType: proto.String(".recs.v1.RateRequest"), OutputType: proto.String(".recs.v1.Item")},
+			},
+		}},
+	}
+	data, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{fd}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "recs.pb")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fd, path
+}
+
+func TestTranscode_JSONToGRPCAndStatusMapping(t *testing.T) {
+	fdp, descriptors := recsDescriptors(t)
+	file, err := protodesc.NewFile(fdp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := file.Messages()
+
+	upstream := h2cServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		frame, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		var reply *dynamicpb.Message
+		switch r.URL.Path {
+		case "/recs.v1.Recommender/List":
+			req := dynamicpb.NewMessage(messages.ByName("ListRequest"))
+			proto.Unmarshal(frame[5:], req)
+			user := req.Get(messages.ByName("ListRequest").Fields().ByName("user_id")).String()
+			if user == "ghost" {
+				w.Header().Set("Grpc-Status", "5")
+				w.Header().Set("Grpc-Message", "no user ghost")
+				return
+			}
+			if user == "huge" {
+				out := make([]byte, 5+maxGRPCMessageBytes+1)
+				binary.BigEndian.PutUint32(out[1:], maxGRPCMessageBytes+1)
+				w.Write(out)
+				w.Header().Set("Grpc-Status", "0")
+				return
+			}
+			reply = dynamicpb.NewMessage(messages.ByName("ListResponse"))
+			items := reply.Mutable(messages.ByName("ListResponse").Fields().ByName("items")).List()
+			item := dynamicpb.NewMessage(messages.ByName("Item"))
+			// Echo the request so the test can check the conversion.
+			item.Set(messages.ByName("Item").Fields().ByName("id"), protoreflect.ValueOfString(fmt.Sprintf("%s/%v/%v", user,
+				req.Get(messages.ByName("ListRequest").Fields().ByName("limit")),
+				req.Get(messages.ByName("ListRequest").Fields().ByName("fresh")))))
+			items.Append(protoreflect.ValueOfMessage(item))
+		case "/recs.v1.Recommender/Rate":
+			req := dynamicpb.NewMessage(messages.ByName("RateRequest"))
+			proto.Unmarshal(frame[5:], req)
+			reply = req.Get(messages.ByName("RateRequest").Fields().ByName("item")).Message().Interface().(*dynamicpb.Message)
+		}
+		payload, _ := proto.Marshal(reply)
+		out := make([]byte, 5, 5+len(payload))
+		binary.BigEndian.PutUint32(out[1:], uint32(len(payload)))
+		w.Write(append(out, payload...))
+		w.Header().Set("Grpc-Status", "0")
+	}))
+
+	cfg, err := loadConfigFile(writeConfig(t, fmt.Sprintf(`services:
+  - name: recommendations
+    host: %s
+    prefix: /recs
+    strip_prefix: true
+    protocol: grpc
+    auth: none
+    transcode:
+      descriptors: %s
+      rules:
+        - method: recs.v1.Recommender/Rate
+          http: POST /v1/users/{user_id}/ratings
+          body: item
+`, upstream.URL, descriptors)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw := setupGateway(t, cfg.Routes)
+
+	cases := []struct {
+		method, path, body string
+		status             int
+		want               string
+	}{
+		{http.MethodGet, "/recs/v1/users/ada/recommendations?limit=5&fresh=true&_=123", "", http.StatusOK, `"id":"ada/5/true"`},
+		{http.MethodPost, "/recs/v1/users/ada/ratings", `{"id":"book-1","score":4.5}`, http.StatusOK, `"score":4.5`},
+		{http.MethodGet, "/recs/v1/users/ghost/recommendations", "", http.StatusNotFound, `"grpc_status":"NOT_FOUND"`},
+		{http.MethodGet, "/recs/v1/users/huge/recommendations", "", http.StatusBadGateway, `response too large`},
+		{http.MethodPost, "/recs/v1/users/ada/ratings", `{"score":"high"}`, http.StatusBadRequest, `invalid JSON body`},
+		{http.MethodDelete, "/recs/v1/users/ada/ratings", "", http.StatusNotFound, `no gRPC method`},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.path, strings.NewReader(c.body))
+		w := httptest.NewRecorder()
+		gw.ServeHTTP(w, req)
+		// protojson output varies its whitespace.
+		body := strings.ReplaceAll(w.Body.String(), " ", "")
+		if w.Code != c.status || !strings.Contains(body, strings.ReplaceAll(c.want, " ", "")) {
+			t.Errorf("%s %s: expected %d with %s, got %d %s", c.method, c.path, c.status, c.want, w.Code, body)
+		}
+	}
+}
+
+func TestTranscode_Validation(t *testing.T) {
+	_, descriptors := recsDescriptors(t)
+	_, err := loadConfigFile(writeConfig(t, fmt.Sprintf(`services:
+  - name: recommendations
+    host: http://recs:50051
+    prefix: /recs
+    transcode:
+      descriptors: %s
+      rules:
+        - method: recs.v1.Recommender/Missing
+          http: GET /v1/missing
+`, descriptors)))
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, want := range []string{"needs protocol: grpc", `unknown method "recs.v1.Recommender/Missing"`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in:\n%v", want, err)
+		}
+	}
+}
+
+func TestReloadIfChanged_FollowsDescriptorSets(t *testing.T) {
+	fdp, descriptors := recsDescriptors(t)
+	path := writeConfig(t, fmt.Sprintf(`services:
+  - name: recommendations
+    host: http://localhost:1
+    prefix: /recs
+    protocol: grpc
+    transcode:
+      descriptors: %s
+`, descriptors))
+	gw := setupGateway(t, map[string]*Service{})
+	if err := gw.reloadFromPath(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded := gw.live.Load().generation
+	if err := gw.reloadIfChanged(path); err != nil {
+		t.Fatal(err)
+	}
+	if gen := gw.live.Load().generation; gen != loaded {
+		t.Fatalf("unchanged files were reloaded as generation %d", gen)
+	}
+
+	if _, match := configWatchSet(path, gw.live.Load().descriptors()); !match(descriptors) {
+		t.Errorf("the descriptor set %s should be watched", descriptors)
+	}
+
+	fdp.MessageType = append(fdp.MessageType, &descriptorpb.DescriptorProto{Name: proto.String("Extra")})
+	data, _ := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{fdp}})
+	os.WriteFile(descriptors, data, 0644)
+	if err := gw.reloadIfChanged(path); err != nil {
+		t.Fatal(err)
+	}
+	if gen := gw.live.Load().generation; gen == loaded {
+		t.Error("a changed descriptor set should be reloaded")
+	}
+
+	os.WriteFile(descriptors, []byte("not a descriptor set"), 0644)
+	if err := gw.reloadIfChanged(path); err == nil || !strings.Contains(err.Error(), "is not a descriptor set") {
+		t.Errorf("expected the descriptor error from the load, got %v", err)
+	}
+}
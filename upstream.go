@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// RetryConfig retries a failed upstream call. Only requests without a body
+// and with an idempotent method are retried, since the body of a proxied
+// request cannot be replayed.
+type RetryConfig struct {
+	Attempts int           `yaml:"attempts"`
+	Backoff  time.Duration `yaml:"backoff"`
+	OnStatus []int         `yaml:"on_status"`
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// retryTransport repeats a round trip up to cfg.Attempts more times when
+// it fails to connect or the upstream answers with one of cfg.OnStatus.
+type retryTransport struct {
+	base http.RoundTripper
+	cfg  RetryConfig
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !idempotent(req.Method) || (req.Body != nil && req.Body != http.NoBody) {
+		return t.base.RoundTrip(req)
+	}
+	for attempt := 0; ; attempt++ {
+		resp, err := t.base.RoundTrip(req)
+		if attempt >= t.cfg.Attempts || !t.retryable(resp, err) {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(t.cfg.Backoff * time.Duration(attempt+1)):
+		}
+	}
+}
+
+func (t *retryTransport) retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+	for _, s := range t.cfg.OnStatus {
+		if resp.StatusCode == s {
+			return true
+		}
+	}
+	return false
+}
+
+// serviceHandler puts the response handling of a service between its
+// middleware chain and its upstream: the rewrite parameters first, then
+// compression, so cached and coalesced responses are stored as the
+// upstream sent them, then the body size limit, which counts inflated
+// bytes, the cache, coalescing and the timeout.
+func (g *Gateway) serviceHandler(svc *Service, upstream http.Handler) http.Handler {
+	// Rewrites are validated with the config, so compiling cannot fail here.
+	rewrites, _ := compileRewrites(svc.Rewrite)
+	return withRewriteParams(rewrites, newCompressor(svc, g.limitBody(svc, g.caches.Handler(svc, newCoalescer(svc, upstreamHandler(upstream, svc.Timeout))))))
+}
+
+// upstreamHandler bounds the time the proxy may spend on a request,
+// retries included. The proxy's error handler turns an expired deadline
+// into a 504. Streams are bounded by their own timeouts instead.
+func upstreamHandler(next http.Handler, timeout time.Duration) http.Handler {
+	if timeout <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if streamKind(r) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func validateRetries(c *configIssues, cfg RetryConfig, path []interface{}) {
+	if cfg.Attempts < 0 {
+		c.addf(appendPath(path, "attempts"), "must not be negative, got %d", cfg.Attempts)
+	}
+	if cfg.Backoff < 0 {
+		c.addf(appendPath(path, "backoff"), "must not be negative, got %s", cfg.Backoff)
+	}
+	for i, s := range cfg.OnStatus {
+		if s < 500 || s > 599 {
+			c.addf(appendPath(appendPath(path, "on_status"), i), "only 5xx statuses can be retried, got %d", s)
+		}
+	}
+}
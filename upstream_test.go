@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUpstream_TimeoutAndRetries(t *testing.T) {
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		case "/flaky":
+			if calls.Add(1) < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		}
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(upstream.Close)
+	u, _ := url.Parse(upstream.URL)
+	svc := &Service{Name: "up", URL: u, Prefix: "/up", StripPefix: true, Auth: "none",
+		Timeout: 50 * time.Millisecond, Retries: RetryConfig{Attempts: 2, OnStatus: []int{503}}}
+	gw := setupGateway(t, map[string]*Service{"/up": svc})
+
+	w := httptest.NewRecorder()
+	gw.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/up/slow", nil))
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("slow upstream: expected 504, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	gw.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/up/flaky", nil))
+	if w.Code != http.StatusOK || calls.Load() != 3 {
+		t.Errorf("flaky upstream: expected 200 after 3 calls, got %d after %d", w.Code, calls.Load())
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
@@ -40,10 +41,15 @@ func JSONSuccess(w http.ResponseWriter, message string, data interface{}, status
 }
 
 func JSONBadResponse(w http.ResponseWriter, message string, statusCode int, error interface{}) {
+	if g := grpcResponse(w); g != nil {
+		g.writeError(w, message, statusCode, error)
+		return
+	}
 	resp := JSONResponse{
 		Status:     http.StatusText(statusCode),
 		Message:    message,
 		StatusCode: statusCode,
+		Error:      error,
 	}
 	writeJSON(w, statusCode, resp)
 }
@@ -63,6 +69,37 @@ func signRequest(req *http.Request, config Service) {
 type Claims struct {
 	UserID string `json:"user_id"`
 	jwt.RegisteredClaims
+	Extra map[string]interface{} `json:"-"`
+}
+
+func (c *Claims) UnmarshalJSON(data []byte) error {
+	type plain Claims
+	if err := json.Unmarshal(data, (*plain)(c)); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &c.Extra)
+}
+
+func (c *Claims) Get(name string) string {
+	if name == "user_id" {
+		return c.UserID
+	}
+	v, ok := c.Extra[name]
+	if !ok || v == nil {
+		return ""
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+type claimsKey struct{}
+
+func withClaims(r *http.Request, claims *Claims) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims))
+}
+
+func claimsFromRequest(r *http.Request) *Claims {
+	claims, _ := r.Context().Value(claimsKey{}).(*Claims)
+	return claims
 }
 
 func ValidateJWT(tokenStr string) (*Claims, error) {
@@ -79,3 +116,26 @@ func ValidateJWT(tokenStr string) (*Claims, error) {
 	}
 	return nil, errors.New("invalid token")
 }
+
+type routeParamsKey struct{}
+
+// withRouteParams stores the named parameters captured while routing r,
+// for header templates and rewrites.
+func withRouteParams(r *http.Request, params map[string]string) *http.Request {
+	if len(params) == 0 {
+		return r
+	}
+	merged := make(map[string]string, len(params))
+	for k, v := range routeParams(r) {
+		merged[k] = v
+	}
+	for k, v := range params {
+		merged[k] = v
+	}
+	return r.WithContext(context.WithValue(r.Context(), routeParamsKey{}, merged))
+}
+
+func routeParams(r *http.Request) map[string]string {
+	params, _ := r.Context().Value(routeParamsKey{}).(map[string]string)
+	return params
+}
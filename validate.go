@@ -0,0 +1,590 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigError is one problem found while loading a configuration file.
+type ConfigError struct {
+	File    string `json:"file"`
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e ConfigError) Error() string {
+	loc := e.File
+	if e.Line > 0 {
+		loc = fmt.Sprintf("%s:%d", loc, e.Line)
+	}
+	if e.Path != "" {
+		return fmt.Sprintf("%s: %s: %s", loc, e.Path, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", loc, e.Message)
+}
+
+// ValidationError collects every ConfigError of a load so they can be
+// reported at once.
+type ValidationError []ConfigError
+
+func (v ValidationError) Error() string {
+	msgs := make([]string, len(v))
+	for i, e := range v {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+type configIssues struct {
+	file string
+	root *yaml.Node
+	errs ValidationError
+
+	// origins maps the nodes of a merged document to the file they were
+	// read from. It is empty for a single-file configuration.
+	origins map[*yaml.Node]string
+	// interpolated maps the scalars that held references to the text they
+	// were written as.
+	interpolated map[*yaml.Node]string
+}
+
+// add records a problem at the node addressed by path (mapping keys as
+// strings, sequence indexes as ints), falling back to the closest parent
+// that exists for the line number.
+func (c *configIssues) add(msg string, path ...interface{}) {
+	line, col := 0, 0
+	if n := lookupNode(c.root, path...); n != nil {
+		line, col = n.Line, n.Column
+	}
+	c.errs = append(c.errs, ConfigError{File: c.fileOf(path...), Line: line, Column: col, Path: formatPath(c.localPath(path)), Message: msg})
+}
+
+// localPath renumbers a services[i] path of a merged document to the
+// index the service has in its own file.
+func (c *configIssues) localPath(path []interface{}) []interface{} {
+	if len(c.origins) == 0 || len(path) < 2 || path[0] != "services" {
+		return path
+	}
+	i, ok := path[1].(int)
+	seq := lookupNode(c.root, "services")
+	if !ok || seq.Kind != yaml.SequenceNode || i >= len(seq.Content) {
+		return path
+	}
+	file, local := c.origins[seq.Content[i]], 0
+	for _, item := range seq.Content[:i] {
+		if c.origins[item] == file {
+			local++
+		}
+	}
+	return append([]interface{}{"services", local}, path[2:]...)
+}
+
+// fileOf returns the file the node addressed by path was read from.
+func (c *configIssues) fileOf(path ...interface{}) string {
+	for k := len(path); k >= 0 && len(c.origins) > 0; k-- {
+		if f, ok := c.origins[lookupNode(c.root, path[:k]...)]; ok {
+			return f
+		}
+	}
+	return c.file
+}
+
+// locate describes where path is for messages that point at a second
+// location, naming the file when it may differ from the error's own.
+func (c *configIssues) locate(path ...interface{}) string {
+	if len(c.origins) == 0 {
+		return formatPath(path)
+	}
+	loc := c.fileOf(path...)
+	if n := lookupNode(c.root, path...); n != nil && n.Line > 0 {
+		loc = fmt.Sprintf("%s:%d", loc, n.Line)
+	}
+	return loc
+}
+
+func (c *configIssues) addf(path []interface{}, format string, args ...interface{}) {
+	c.add(fmt.Sprintf(format, args...), path...)
+}
+
+func (c *configIssues) err() error {
+	if len(c.errs) == 0 {
+		return nil
+	}
+	sort.SliceStable(c.errs, func(i, j int) bool {
+		if c.errs[i].File != c.errs[j].File {
+			return c.errs[i].File < c.errs[j].File
+		}
+		return c.errs[i].Line < c.errs[j].Line
+	})
+	return c.errs
+}
+
+func lookupNode(n *yaml.Node, path ...interface{}) *yaml.Node {
+	if n == nil {
+		return nil
+	}
+	if n.Kind == yaml.DocumentNode && len(n.Content) > 0 {
+		n = n.Content[0]
+	}
+	for _, p := range path {
+		var next *yaml.Node
+		switch k := p.(type) {
+		case string:
+			if n.Kind == yaml.MappingNode {
+				for i := 0; i+1 < len(n.Content); i += 2 {
+					if n.Content[i].Value == k {
+						next = n.Content[i+1]
+						break
+					}
+				}
+			}
+		case int:
+			if n.Kind == yaml.SequenceNode && k < len(n.Content) {
+				next = n.Content[k]
+			}
+		}
+		if next == nil {
+			return n
+		}
+		n = next
+	}
+	return n
+}
+
+func formatPath(path []interface{}) string {
+	var b strings.Builder
+	for _, p := range path {
+		switch k := p.(type) {
+		case int:
+			b.WriteString("[" + strconv.Itoa(k) + "]")
+		default:
+			if b.Len() > 0 {
+				b.WriteByte('.')
+			}
+			fmt.Fprint(&b, k)
+		}
+	}
+	return b.String()
+}
+
+// checkKnownFields reports every mapping key under n that has no matching
+// yaml tag in t, so a typo like strip_prefx fails loudly instead of
+// silently disabling a feature.
+func checkKnownFields(c *configIssues, n *yaml.Node, t reflect.Type, path []interface{}) {
+	if n == nil {
+		return
+	}
+	if n.Kind == yaml.DocumentNode {
+		for _, child := range n.Content {
+			checkKnownFields(c, child, t, path)
+		}
+		return
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		if n.Kind != yaml.MappingNode {
+			return
+		}
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := n.Content[i].Value
+			ft, ok := fields[key]
+			p := appendPath(path, key)
+			if !ok {
+				c.errs = append(c.errs, ConfigError{
+					File: c.file, Line: n.Content[i].Line, Column: n.Content[i].Column,
+					Path: formatPath(p), Message: fmt.Sprintf("unknown field %q", key),
+				})
+				continue
+			}
+			checkKnownFields(c, n.Content[i+1], ft, p)
+		}
+	case reflect.Map:
+		if n.Kind != yaml.MappingNode {
+			return
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			checkKnownFields(c, n.Content[i+1], t.Elem(), appendPath(path, n.Content[i].Value))
+		}
+	case reflect.Slice:
+		if n.Kind != yaml.SequenceNode {
+			return
+		}
+		for i, child := range n.Content {
+			checkKnownFields(c, child, t.Elem(), appendPath(path, i))
+		}
+	}
+}
+
+func appendPath(path []interface{}, p interface{}) []interface{} {
+	out := make([]interface{}, len(path), len(path)+1)
+	copy(out, path)
+	return append(out, p)
+}
+
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	out := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		tag := f.Tag.Get("yaml")
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "-" {
+			continue
+		}
+		if strings.Contains(opts, "inline") {
+			for k, v := range yamlFields(f.Type) {
+				out[k] = v
+			}
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		out[name] = f.Type
+	}
+	return out
+}
+
+var yamlLineRe = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// yamlErrors turns yaml.v3 syntax and type errors into ConfigErrors,
+// keeping the line numbers the decoder reports.
+func yamlErrors(file string, err error) ValidationError {
+	var te *yaml.TypeError
+	msgs := []string{err.Error()}
+	if errors.As(err, &te) {
+		msgs = te.Errors
+	}
+	var out ValidationError
+	for _, m := range msgs {
+		ce := ConfigError{File: file, Message: m}
+		if sub := yamlLineRe.FindStringSubmatch(m); sub != nil {
+			ce.Line, _ = strconv.Atoi(sub[1])
+			ce.Message = sub[2]
+		}
+		out = append(out, ce)
+	}
+	return out
+}
+
+func validateScheme(u *url.URL) bool {
+	return u.Scheme == "http" || u.Scheme == "https"
+}
+
+// validateSemantics checks values the YAML decoder accepts but the gateway
+// cannot use.
+func validateSemantics(c *configIssues, scf *ServiceConfigFile) {
+	names := map[string]int{}
+	for i, svc := range scf.Services {
+		at := func(p ...interface{}) []interface{} { return append([]interface{}{"services", i}, p...) }
+
+		if strings.TrimSpace(svc.Name) == "" {
+			c.add("service name is required", at()...)
+		} else if prev, ok := names[svc.Name]; ok {
+			c.addf(at("name"), "duplicate service name %q (also %s)", svc.Name, c.locate("services", prev))
+		} else {
+			names[svc.Name] = i
+		}
+
+		u, err := url.Parse(svc.Host)
+		switch {
+		case svc.Host == "" && len(svc.Backends) > 0:
+		case svc.Host == "":
+			c.add("host is required", at("host")...)
+		case err != nil || u.Host == "":
+			c.addf(at("host"), "invalid host %q", svc.Host)
+		case !validateScheme(u):
+			c.addf(at("host"), "unsupported scheme %q, expected http or https", u.Scheme)
+		}
+
+		if svc.RateLimit.RequestsPerMinute < 0 {
+			c.addf(at("rate_limit", "requests_per_minute"), "must be positive, got %d", svc.RateLimit.RequestsPerMinute)
+		}
+		validateConcurrency(c, svc.Concurrency, at("concurrency"))
+		if svc.IPFilter.BlocklistFile != "" {
+			c.add("blocklist_file is only supported in the global ip_filter", at("ip_filter", "blocklist_file")...)
+		}
+		validateIPFilter(c, svc.IPFilter, at("ip_filter"))
+		validateMiddlewares(c, svc.Middlewares, at("middlewares"))
+		validateSecurityMiddlewares(c, svc, scf.Quotas, at("middlewares"))
+
+		if svc.Timeout < 0 {
+			c.addf(at("timeout"), "must not be negative, got %s", svc.Timeout)
+		}
+		if svc.MaxBodyBytes < 0 {
+			c.addf(at("max_body_bytes"), "must not be negative, got %d", svc.MaxBodyBytes)
+		}
+		switch svc.Auth {
+		case "", "jwt", "api_key", "none":
+		default:
+			c.addf(at("auth"), "unknown auth mode %q, expected jwt, api_key or none", svc.Auth)
+		}
+		validateCORS(c, svc.CORS, at("cors"))
+		validateRetries(c, svc.Retries, at("retries"))
+		validateRewrites(c, svc.Rewrite, at("rewrite"))
+		validateServiceRoutes(c, svc, at())
+		validateMatch(c, svc.Match, at("match"))
+		validateBackends(c, svc, at())
+		validateMirror(c, svc.Mirror, at("mirror"))
+		validateStreams(c, svc.Streams, at("streams"))
+		validateProtocol(c, svc.Protocol, at("protocol"))
+		validateTranscode(c, &scf.Services[i], at("transcode"))
+		validateCache(c, svc.Cache, at("cache"))
+		validateCoalesce(c, svc.Coalesce, at("coalesce"))
+		validateCompression(c, svc.Compression, at("compression"))
+		validateHeaderRules(c, svc.RequestHeaders, at("request_headers"))
+		validateHeaderRules(c, svc.ResponseHeaders, at("response_headers"))
+	}
+	validatePrefixes(c, scf.Services)
+	validateDefaults(c)
+
+	validateIPFilter(c, scf.IPFilter, []interface{}{"ip_filter"})
+	if _, err := parseCIDRs(scf.TrustedProxies); err != nil {
+		c.add(err.Error(), "trusted_proxies")
+	}
+	validateQuotas(c, scf.Quotas)
+
+	if scf.Reload.HistorySize < 0 {
+		c.add("must not be negative", "reload", "history_size")
+	}
+	gate := scf.Reload.HealthGate
+	if gate.MaxErrorRate < 0 || gate.MaxErrorRate > 1 {
+		c.addf([]interface{}{"reload", "health_gate", "max_error_rate"}, "must be between 0 and 1, got %g", gate.MaxErrorRate)
+	}
+	if gate.Window < 0 {
+		c.add("must not be negative", "reload", "health_gate", "window")
+	}
+}
+
+func validateConcurrency(c *configIssues, cl ConcurrencyLimit, path []interface{}) {
+	if cl.MaxInFlight < 0 {
+		c.addf(appendPath(path, "max_in_flight"), "must be positive, got %d", cl.MaxInFlight)
+	}
+	if cl.QueueSize < 0 {
+		c.addf(appendPath(path, "queue_size"), "must not be negative, got %d", cl.QueueSize)
+	}
+	if cl.QueueTimeout < 0 {
+		c.addf(appendPath(path, "queue_timeout"), "must not be negative, got %s", cl.QueueTimeout)
+	}
+	a := cl.Adaptive
+	ap := appendPath(path, "adaptive")
+	switch a.Mode {
+	case "", "aimd", "gradient":
+	default:
+		c.addf(appendPath(ap, "mode"), "unknown mode %q, expected aimd or gradient", a.Mode)
+	}
+	if a.MinLimit < 0 || a.MaxLimit < 0 {
+		c.add("limits must be positive", ap...)
+	}
+	if a.MaxLimit > 0 && a.MinLimit > a.MaxLimit {
+		c.addf(appendPath(ap, "min_limit"), "min_limit %d exceeds max_limit %d", a.MinLimit, a.MaxLimit)
+	}
+	if a.BackoffRatio < 0 || a.BackoffRatio >= 1 {
+		c.addf(appendPath(ap, "backoff_ratio"), "must be between 0 and 1, got %g", a.BackoffRatio)
+	}
+}
+
+func validateMiddlewares(c *configIssues, names []string, path []interface{}) {
+	seen := map[string]bool{}
+	for i, name := range names {
+		if _, ok := middlewareRegistry[name]; !ok {
+			c.addf(appendPath(path, i), "unknown middleware %q", name)
+		} else if seen[name] {
+			c.addf(appendPath(path, i), "middleware %q listed twice", name)
+		}
+		seen[name] = true
+	}
+}
+
+// validateSecurityMiddlewares rejects a middlewares list that leaves out
+// the middleware enforcing a setting of the service, which would otherwise
+// be ignored without a word.
+func validateSecurityMiddlewares(c *configIssues, svc Service, quotas QuotaConfig, path []interface{}) {
+	if svc.Middlewares == nil {
+		return
+	}
+	listed := map[string]bool{}
+	for _, name := range svc.Middlewares {
+		listed[name] = true
+	}
+	if !listed["auth"] {
+		if mode := svc.Auth; mode != "none" {
+			if mode == "" {
+				mode = defaultAuthMode
+			}
+			c.addf(path, "service sets auth: %s but its middlewares omit auth", mode)
+		} else {
+			for _, r := range svc.Routes {
+				if r.Auth != "" && r.Auth != "none" {
+					c.addf(path, "route %s sets auth: %s but the service middlewares omit auth", r.Path, r.Auth)
+					break
+				}
+			}
+		}
+	}
+	if !listed["ip_filter"] && (len(svc.IPFilter.Allow) > 0 || len(svc.IPFilter.Deny) > 0) {
+		c.add("service sets an ip_filter but its middlewares omit ip_filter", path...)
+	}
+	if !listed["quota"] {
+		tiers := make([]string, 0, len(quotas.Tiers))
+		for tier := range quotas.Tiers {
+			tiers = append(tiers, tier)
+		}
+		sort.Strings(tiers)
+		for _, tier := range tiers {
+			_, named := quotas.Tiers[tier][svc.Name]
+			_, wildcard := quotas.Tiers[tier]["*"]
+			if named || wildcard {
+				c.addf(path, "tier %s sets a quota for the service but its middlewares omit quota", tier)
+				break
+			}
+		}
+	}
+}
+
+func validateIPFilter(c *configIssues, f IPFilterConfig, path []interface{}) {
+	for i, e := range f.Allow {
+		if _, err := parseCIDRs([]string{e}); err != nil {
+			c.add(err.Error(), appendPath(appendPath(path, "allow"), i)...)
+		}
+	}
+	for i, e := range f.Deny {
+		if _, err := parseCIDRs([]string{e}); err != nil {
+			c.add(err.Error(), appendPath(appendPath(path, "deny"), i)...)
+		}
+	}
+}
+
+func validateQuotas(c *configIssues, q QuotaConfig) {
+	switch q.Store.Type {
+	case "", "memory":
+	case "file":
+		if q.Store.Path == "" {
+			c.add("file store requires a path", "quotas", "store", "path")
+		}
+	default:
+		c.addf([]interface{}{"quotas", "store", "type"}, "unsupported quota store type %q", q.Store.Type)
+	}
+	for tier, services := range q.Tiers {
+		for svc, l := range services {
+			if l.PerMinute < 0 || l.PerHour < 0 || l.PerDay < 0 || l.PerMonth < 0 {
+				c.add("quota limits must be positive", "quotas", "tiers", tier, svc)
+			}
+		}
+	}
+	if q.DefaultTier != "" && q.Tiers != nil {
+		if _, ok := q.Tiers[q.DefaultTier]; !ok {
+			c.addf([]interface{}{"quotas", "default_tier"}, "default tier %q is not defined", q.DefaultTier)
+		}
+	}
+	for i, k := range q.APIKeys {
+		if k.Key == "" || k.Consumer == "" {
+			c.add("api key records need both key and consumer", "quotas", "api_keys", i)
+		}
+		if k.Tier != "" && q.Tiers != nil {
+			if _, ok := q.Tiers[k.Tier]; !ok {
+				c.addf([]interface{}{"quotas", "api_keys", i, "tier"}, "tier %q is not defined", k.Tier)
+			}
+		}
+	}
+}
+
+// validatePrefixes rejects prefixes that can never be routed to: routing
+// matches the first path segment only, so prefixes must be one segment,
+// and services sharing a prefix must differ in their match conditions.
+func validatePrefixes(c *configIssues, services []Service) {
+	seen := map[string]int{}
+	for i, svc := range services {
+		p := normalizePrefix(svc)
+		if strings.Count(p, "/") > 1 {
+			c.addf([]interface{}{"services", i, "prefix"}, "prefix %q overlaps %q: only the first path segment is routed", p, extractPrefix(p))
+			continue
+		}
+		key := p + " " + svc.Match.key()
+		if prev, ok := seen[key]; ok {
+			if svc.Match.empty() {
+				c.addf([]interface{}{"services", i, "prefix"}, "duplicate service prefix %s (also %s)", p, c.locate("services", prev))
+			} else {
+				c.addf([]interface{}{"services", i, "match"}, "prefix %s with the same match conditions as %s", p, c.locate("services", prev))
+			}
+			continue
+		}
+		seen[key] = i
+	}
+}
+
+func normalizePrefix(svc Service) string {
+	p := svc.Prefix
+	if p == "" {
+		p = "/" + strings.TrimPrefix(svc.Name, "/")
+	}
+	return "/" + strings.Trim(strings.TrimSpace(p), "/")
+}
+
+type validateReport struct {
+	Valid    bool          `json:"valid"`
+	Config   string        `json:"config"`
+	Services int           `json:"services,omitempty"`
+	Errors   []ConfigError `json:"errors,omitempty"`
+}
+
+// runValidate implements `aimas-gateway validate`. It exits non-zero when
+// the configuration is invalid so CI can gate on it.
+func runValidate(args []string, stdout io.Writer) int {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	configFile := fs.String("config", "aimas.yml", "configuration file or directory")
+	format := fs.String("format", "json", "output format: json or text")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	report := validateReport{Config: *configFile}
+	cfg, err := loadConfigFile(*configFile)
+	if err == nil {
+		report.Valid = true
+		report.Services = len(cfg.Routes)
+	} else {
+		var ve ValidationError
+		if errors.As(err, &ve) {
+			report.Errors = ve
+		} else {
+			report.Errors = []ConfigError{{File: *configFile, Message: err.Error()}}
+		}
+	}
+
+	if *format == "text" {
+		if report.Valid {
+			fmt.Fprintf(stdout, "%s: ok (%d services)\n", report.Config, report.Services)
+		}
+		for _, e := range report.Errors {
+			fmt.Fprintln(stdout, e.Error())
+		}
+	} else {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(report)
+	}
+	if !report.Valid {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func waitForService(t *testing.T, gw *Gateway, prefix string) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if live := gw.live.Load(); live != nil && live.cfg.Routes[prefix] != nil {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("service %s was never loaded", prefix)
+}
+
+// TestWatchConfig_KubernetesSymlinkSwap mimics a mounted ConfigMap, where
+// aimas.yml -> ..data/aimas.yml and ..data is swapped to a new directory.
+func TestWatchConfig_KubernetesSymlinkSwap(t *testing.T) {
+	dir := t.TempDir()
+	write := func(version, body string) {
+		os.MkdirAll(filepath.Join(dir, version), 0755)
+		if err := os.WriteFile(filepath.Join(dir, version, "aimas.yml"), []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+		tmp := filepath.Join(dir, "..data_tmp")
+		os.Remove(tmp)
+		if err := os.Symlink(version, tmp); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, filepath.Join(dir, "..data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("..v1", "services:\n  - name: a\n    host: http://localhost:1\n")
+	path := filepath.Join(dir, "aimas.yml")
+	if err := os.Symlink(filepath.Join("..data", "aimas.yml"), path); err != nil {
+		t.Fatal(err)
+	}
+
+	gw := setupGateway(t, map[string]*Service{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := gw.WatchConfig(path, ctx); err != nil {
+		t.Fatal(err)
+	}
+	waitForService(t, gw, "/a")
+
+	write("..v2", "services:\n  - name: b\n    host: http://localhost:2\n")
+	waitForService(t, gw, "/b")
+}
+
+func TestPollConfig_ReloadsOnlyOnContentChange(t *testing.T) {
+	path := writeConfig(t, "services:\n  - name: a\n    host: http://localhost:1\n")
+	gw := setupGateway(t, map[string]*Service{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := gw.PollConfig(path, 20*time.Millisecond, ctx); err != nil {
+		t.Fatal(err)
+	}
+	waitForService(t, gw, "/a")
+	first := gw.live.Load().generation
+
+	// Touching the file without changing it must not create a generation.
+	later := time.Now().Add(time.Second)
+	os.Chtimes(path, later, later)
+	time.Sleep(100 * time.Millisecond)
+	if gen := gw.live.Load().generation; gen != first {
+		t.Fatalf("unchanged content produced generation %d", gen)
+	}
+
+	os.WriteFile(path, []byte("services:\n  - name: b\n    host: http://localhost:2\n"), 0644)
+	waitForService(t, gw, "/b")
+}
+
+func TestReloadIfChanged_SkipsRolledBackContent(t *testing.T) {
+	path := writeConfig(t, "services:\n  - name: a\n    host: http://localhost:1\n")
+	gw := setupGateway(t, map[string]*Service{})
+	if err := gw.reloadFromPath(path); err != nil {
+		t.Fatal(err)
+	}
+	good := gw.live.Load().source
+
+	os.WriteFile(path, []byte("services:\n  - name: b\n    host: http://localhost:2\n"), 0644)
+	if err := gw.reloadIfChanged(path); err != nil {
+		t.Fatal(err)
+	}
+	gw.configMu.Lock()
+	gw.applySourceLocked(good, "rollback")
+	gw.configMu.Unlock()
+	rolledBack := gw.live.Load().generation
+
+	// The poller's periodic content check must not re-apply the bad file.
+	if err := gw.reloadIfChanged(path); err != nil {
+		t.Fatal(err)
+	}
+	if gen := gw.live.Load().generation; gen != rolledBack {
+		t.Fatalf("rolled back content was applied again as generation %d", gen)
+	}
+
+	os.WriteFile(path, []byte("services:\n  - name: c\n    host: http://localhost:3\n"), 0644)
+	if err := gw.reloadIfChanged(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := gw.atomicRoutes.Load().(*routeTable).routes["/c"]; !ok {
+		t.Error("a new edit should still be applied")
+	}
+}